@@ -1,3 +1,5 @@
 module midnight
 
 go 1.15
+
+require github.com/yuin/gopher-lua v1.1.1
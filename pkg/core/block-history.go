@@ -0,0 +1,416 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"midnight/pkg/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Block history is kept in the levels/history folder. "<level>.log" holds the changes, appended
+// in the order they were made, and "<level>.players" the names of the players who made them.
+//
+// Each change takes 14 bytes: X, Y and Z (int16), the old and the new block, the line of the
+// player's name in the players file (uint16) and the time as a Unix timestamp (uint32).
+const blockChangeSize = 14
+
+// Names are written one per line, with backslashes and newlines escaped
+var (
+	historyNameEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	historyNameUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// Changes are buffered in memory and written once this many bytes are waiting, or when the level is saved
+const historyFlushSize = 64 * 1024
+
+// A change to a block, as recorded in a level's block history.
+type BlockChange struct {
+	X, Y, Z  int16
+	Old, New byte
+	Player   string
+	Time     time.Time
+}
+
+type blockHistory struct {
+	mu        sync.Mutex
+	logPath   string
+	namesPath string
+	names     []string          // Player names by ID
+	ids       map[string]uint16 // Player IDs by name
+	newNames  int               // Number of names at the end of names that haven't been written yet
+	pending   []byte            // Changes that haven't been written yet
+}
+
+// Returns the paths of a level's block history files.
+func historyPaths(level string) (logPath string, namesPath string) {
+	dir := filepath.Join("levels", "history")
+	return filepath.Join(dir, level+".log"), filepath.Join(dir, level+".players")
+}
+
+// Opens the block history of a level. A level without a history gets an empty one.
+func openBlockHistory(level string) (*blockHistory, error) {
+	h := &blockHistory{ids: make(map[string]uint16)}
+	h.logPath, h.namesPath = historyPaths(level)
+
+	data, err := ioutil.ReadFile(h.namesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// A name cut short while it was being written has no changes in the log, since names are
+	// written first. It's dropped so that the next name goes on a line of its own.
+	if end := strings.LastIndexByte(string(data), '\n') + 1; end < len(data) {
+		log.Printf("Removing an incomplete name from the end of %v", h.namesPath)
+		if err := os.Truncate(h.namesPath, int64(end)); err != nil {
+			return nil, err
+		}
+		data = data[:end]
+	}
+
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			name := historyNameUnescaper.Replace(line)
+			h.ids[name] = uint16(len(h.names))
+			h.names = append(h.names, name)
+		}
+	}
+
+	return h, nil
+}
+
+// Queues a change to be written to the history. Changes by names with line breaks are dropped.
+func (h *blockHistory) record(c BlockChange) {
+	if strings.ContainsAny(c.Player, "\r\n") {
+		log.Printf("Not recording a block change by %q [%v]: Names can't contain line breaks", c.Player, h.logPath)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, found := h.ids[c.Player]
+	if !found {
+		if len(h.names) > 0xFFFF {
+			return // Out of IDs
+		}
+
+		id = uint16(len(h.names))
+		h.ids[c.Player] = id
+		h.names = append(h.names, c.Player)
+		h.newNames++
+	}
+
+	var buf [blockChangeSize]byte
+	binary.BigEndian.PutUint16(buf[0:], uint16(c.X))
+	binary.BigEndian.PutUint16(buf[2:], uint16(c.Y))
+	binary.BigEndian.PutUint16(buf[4:], uint16(c.Z))
+	buf[6] = c.Old
+	buf[7] = c.New
+	binary.BigEndian.PutUint16(buf[8:], id)
+	binary.BigEndian.PutUint32(buf[10:], uint32(c.Time.Unix()))
+	h.pending = append(h.pending, buf[:]...)
+
+	if len(h.pending) >= historyFlushSize {
+		if err := h.flushLocked(); err != nil {
+			log.Printf("Could not write block history [%v]: %v", h.logPath, err)
+		}
+	}
+}
+
+// Writes queued changes to disk.
+func (h *blockHistory) flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.flushLocked()
+}
+
+// The caller must hold h.mu.
+func (h *blockHistory) flushLocked() error {
+	if len(h.pending) == 0 && h.newNames == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.logPath), 0755); err != nil {
+		return err
+	}
+
+	// Names are written first, so that every change in the log has a name
+	if h.newNames > 0 {
+		var names strings.Builder
+		for _, name := range h.names[len(h.names)-h.newNames:] {
+			names.WriteString(historyNameEscaper.Replace(name) + "\n")
+		}
+		if err := appendFile(h.namesPath, []byte(names.String())); err != nil {
+			return err
+		}
+		h.newNames = 0
+	}
+
+	if err := appendFile(h.logPath, h.pending); err != nil {
+		return err
+	}
+	h.pending = h.pending[:0]
+
+	return nil
+}
+
+// Returns the recorded changes that match, oldest first.
+func (h *blockHistory) search(match func(c *BlockChange) bool) ([]BlockChange, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.flushLocked(); err != nil {
+		return nil, err
+	}
+
+	var changes []BlockChange
+	err := h.scan(func(c *BlockChange, raw []byte) error {
+		if match(c) {
+			changes = append(changes, *c)
+		}
+		return nil
+	})
+
+	return changes, err
+}
+
+// Removes changes made before a time. Returns the number of changes removed.
+func (h *blockHistory) prune(before time.Time) (removed int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(h.logPath); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	tmp, err := os.Create(h.logPath + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(tmp)
+
+	err = h.scan(func(c *BlockChange, raw []byte) error {
+		if c.Time.Before(before) {
+			removed++
+			return nil
+		}
+
+		_, err := w.Write(raw)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil || removed == 0 {
+		os.Remove(h.logPath + ".tmp")
+		return 0, err
+	}
+
+	return removed, os.Rename(h.logPath+".tmp", h.logPath)
+}
+
+// Calls fn for every change written to the log. The caller must hold h.mu.
+func (h *blockHistory) scan(fn func(c *BlockChange, raw []byte) error) error {
+	f, err := os.Open(h.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	raw := make([]byte, blockChangeSize)
+
+	for {
+		if _, err := io.ReadFull(r, raw); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil // A partly written change at the end is ignored
+		} else if err != nil {
+			return err
+		}
+
+		c := BlockChange{
+			X:    int16(binary.BigEndian.Uint16(raw[0:])),
+			Y:    int16(binary.BigEndian.Uint16(raw[2:])),
+			Z:    int16(binary.BigEndian.Uint16(raw[4:])),
+			Old:  raw[6],
+			New:  raw[7],
+			Time: time.Unix(int64(binary.BigEndian.Uint32(raw[10:])), 0),
+		}
+		if id := int(binary.BigEndian.Uint16(raw[8:])); id < len(h.names) {
+			c.Player = h.names[id]
+		}
+
+		if err := fn(&c, raw); err != nil {
+			return err
+		}
+	}
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Changes reverted at once beyond this are sent by resending the level instead of block by block
+const maxBlockUpdates = 1024
+
+// Returns the recorded changes to a block, oldest first.
+func (l *Level) BlockHistory(x, y, z int16) ([]BlockChange, error) {
+	if l.history == nil {
+		return nil, nil
+	}
+
+	return l.history.search(func(c *BlockChange) bool {
+		return c.X == x && c.Y == y && c.Z == z
+	})
+}
+
+// Reverts the changes made since a time, by one player or, if player is empty, by everyone.
+// A block changed by someone else after the player is left alone. The reverted blocks are
+// recorded in the history under revertedBy. Returns the number of blocks reverted.
+func (l *Level) RevertChanges(since time.Time, player string, revertedBy string) (int, error) {
+	if l.history == nil {
+		return 0, nil
+	}
+
+	changes, err := l.history.search(func(c *BlockChange) bool {
+		return !c.Time.Before(since)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	type revert struct {
+		old, new byte // Block before the first change, and after the player's last change
+		touched  bool // Set if someone else changed the block after the player
+	}
+
+	var order []util.Vector3i16
+	reverts := make(map[util.Vector3i16]*revert)
+
+	for _, c := range changes {
+		pos := util.Vector3i16{X: c.X, Y: c.Y, Z: c.Z}
+		byPlayer := player == "" || strings.EqualFold(c.Player, player)
+
+		r, found := reverts[pos]
+		if !found {
+			if !byPlayer {
+				continue
+			}
+
+			r = &revert{old: c.Old}
+			reverts[pos] = r
+			order = append(order, pos)
+		}
+
+		if byPlayer {
+			r.new, r.touched = c.New, false
+		} else {
+			r.touched = true
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var reverted []util.Vector3i16
+	for _, pos := range order {
+		r := reverts[pos]
+		if r.touched || l.block(pos.X, pos.Y, pos.Z) != r.new || r.old == r.new {
+			continue
+		}
+
+		l.setBlock(pos.X, pos.Y, pos.Z, r.old)
+		l.blockChanged(pos.X, pos.Y, pos.Z, r.new)
+		l.history.record(BlockChange{X: pos.X, Y: pos.Y, Z: pos.Z, Old: r.new, New: r.old, Player: revertedBy, Time: time.Now()})
+		reverted = append(reverted, pos)
+	}
+
+	if len(reverted) > maxBlockUpdates {
+		// Players the level is being sent to get the changes queued, or the level again if there are too many
+		for _, join := range l.joining {
+			for _, pos := range reverted {
+				join.queue(l.block(pos.X, pos.Y, pos.Z), pos)
+			}
+		}
+		l.resendToPlayers()
+	} else {
+		for _, pos := range reverted {
+			l.sendBlock(l.block(pos.X, pos.Y, pos.Z), pos.X, pos.Y, pos.Z)
+		}
+	}
+
+	return len(reverted), nil
+}
+
+// Sends the level again to everyone in it, keeping them where they are. Block changes made while it's
+// compressed are queued like they are for players entering the level. The caller must hold l.mu for
+// writing, which is released while the level is compressed and held again on return.
+func (l *Level) resendToPlayers() {
+	joins := make(map[*Player]*levelJoin, len(l.players))
+	for playerId, p := range l.players {
+		join := &levelJoin{playerId: playerId}
+		l.joining[p], joins[p] = join, join
+	}
+
+	l.sendCopy(joins)
+
+	for p, join := range joins {
+		if l.joining[p] != join {
+			continue // Left the level, or is being sent a newer copy
+		}
+		delete(l.joining, p)
+
+		pos := p.Position()
+		p.Cli.WritePacket_SpawnPlayer(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, -1, p.Username)
+	}
+}
+
+// Removes history older than the retention time from every loaded level.
+func (s *Server) pruneBlockHistory() {
+	if s.historyRetention <= 0 {
+		return
+	}
+
+	for _, l := range s.Levels() {
+		s.pruneLevelHistory(l)
+	}
+}
+
+func (s *Server) pruneLevelHistory(l *Level) {
+	if s.historyRetention <= 0 || l.history == nil {
+		return
+	}
+
+	removed, err := l.history.prune(time.Now().Add(-s.historyRetention))
+	if err != nil {
+		log.Printf("Could not prune the block history of level '%v': %v", l.Name, err)
+	} else if removed > 0 {
+		log.Printf("Pruned %v old block changes from level '%v'", removed, l.Name)
+	}
+}
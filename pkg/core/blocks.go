@@ -0,0 +1,155 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Block IDs of the original Classic 0.30 protocol
+const (
+	BlockAir byte = iota
+	BlockStone
+	BlockGrass
+	BlockDirt
+	BlockCobblestone
+	BlockWood
+	BlockSapling
+	BlockBedrock
+	BlockWater
+	BlockStillWater
+	BlockLava
+	BlockStillLava
+	BlockSand
+	BlockGravel
+	BlockGoldOre
+	BlockIronOre
+	BlockCoalOre
+	BlockLog
+	BlockLeaves
+	BlockSponge
+	BlockGlass
+	BlockRedWool
+	BlockOrangeWool
+	BlockYellowWool
+	BlockLimeWool
+	BlockGreenWool
+	BlockTealWool
+	BlockAquaWool
+	BlockCyanWool
+	BlockBlueWool
+	BlockIndigoWool
+	BlockVioletWool
+	BlockMagentaWool
+	BlockPinkWool
+	BlockBlackWool
+	BlockGrayWool
+	BlockWhiteWool
+	BlockDandelion
+	BlockRose
+	BlockBrownMushroom
+	BlockRedMushroom
+	BlockGold
+	BlockIron
+	BlockDoubleSlab
+	BlockSlab
+	BlockBrick
+	BlockTNT
+	BlockBookshelf
+	BlockMossyCobblestone
+	BlockObsidian
+)
+
+// Block IDs added by the CustomBlocks extension
+const (
+	BlockCobblestoneSlab byte = iota + 50
+	BlockRope
+	BlockSandstone
+	BlockSnow
+	BlockFire
+	BlockLightPinkWool
+	BlockForestGreenWool
+	BlockBrownWool
+	BlockDeepBlueWool
+	BlockTurquoiseWool
+	BlockIce
+	BlockCeramicTile
+	BlockMagma
+	BlockPillar
+	BlockCrate
+	BlockStoneBrick
+)
+
+const (
+	MaxClassicBlockId = BlockObsidian
+	MaxCPEBlockId     = BlockStoneBrick
+)
+
+// Replacement blocks sent to clients that don't support the CustomBlocks extension
+var cpeBlockFallbacks = map[byte]byte{
+	BlockCobblestoneSlab: BlockSlab,
+	BlockRope:            BlockBrownMushroom,
+	BlockSandstone:       BlockSand,
+	BlockSnow:            BlockAir,
+	BlockFire:            BlockLava,
+	BlockLightPinkWool:   BlockPinkWool,
+	BlockForestGreenWool: BlockGreenWool,
+	BlockBrownWool:       BlockDirt,
+	BlockDeepBlueWool:    BlockBlueWool,
+	BlockTurquoiseWool:   BlockCyanWool,
+	BlockIce:             BlockGlass,
+	BlockCeramicTile:     BlockIron,
+	BlockMagma:           BlockObsidian,
+	BlockPillar:          BlockWhiteWool,
+	BlockCrate:           BlockWood,
+	BlockStoneBrick:      BlockStone,
+}
+
+// Converts a block to one that a client supporting blocks up to maxBlockId can display.
+// Unknown blocks are replaced with stone.
+func FallbackBlock(block byte, maxBlockId byte) byte {
+	if block <= maxBlockId {
+		return block
+	}
+
+	if fallback, found := cpeBlockFallbacks[block]; found && fallback <= maxBlockId {
+		return fallback
+	}
+
+	return BlockStone
+}
+
+var blockNames = [...]string{
+	"Air", "Stone", "Grass", "Dirt", "Cobblestone", "Wood", "Sapling", "Bedrock", "Water", "Still Water",
+	"Lava", "Still Lava", "Sand", "Gravel", "Gold Ore", "Iron Ore", "Coal Ore", "Log", "Leaves", "Sponge",
+	"Glass", "Red Wool", "Orange Wool", "Yellow Wool", "Lime Wool", "Green Wool", "Teal Wool", "Aqua Wool", "Cyan Wool", "Blue Wool",
+	"Indigo Wool", "Violet Wool", "Magenta Wool", "Pink Wool", "Black Wool", "Gray Wool", "White Wool", "Dandelion", "Rose", "Brown Mushroom",
+	"Red Mushroom", "Gold", "Iron", "Double Slab", "Slab", "Brick", "TNT", "Bookshelf", "Mossy Cobblestone", "Obsidian",
+	"Cobblestone Slab", "Rope", "Sandstone", "Snow", "Fire", "Light Pink Wool", "Forest Green Wool", "Brown Wool", "Deep Blue Wool", "Turquoise Wool",
+	"Ice", "Ceramic Tile", "Magma", "Pillar", "Crate", "Stone Brick",
+}
+
+// Returns the name of a block, e.g. "Mossy Cobblestone", or its ID for unknown blocks.
+func BlockName(block byte) string {
+	if int(block) < len(blockNames) {
+		return blockNames[block]
+	}
+	return "Block " + strconv.Itoa(int(block))
+}
+
+// Returns the block with a name or ID, e.g. "mossy_cobblestone", "MossyCobblestone" or "48".
+func FindBlock(name string) (block byte, found bool) {
+	if id, err := strconv.ParseUint(name, 10, 8); err == nil {
+		return byte(id), int(id) < len(blockNames)
+	}
+
+	simplify := strings.NewReplacer(" ", "", "_", "", "-", "")
+	name = strings.ToLower(simplify.Replace(name))
+
+	for id, blockName := range blockNames {
+		if strings.ToLower(simplify.Replace(blockName)) == name {
+			return byte(id), true
+		}
+	}
+
+	return 0, false
+}
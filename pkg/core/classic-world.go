@@ -0,0 +1,166 @@
+package core
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"midnight/pkg/nbt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ClassicWorld (.cw) level format
+// Reference Page: https://wiki.vg/ClassicWorld_file_format
+
+const classicWorldVersion byte = 1
+
+// Loads a level from a ClassicWorld (.cw) file.
+func LoadLevel(path string) (*Level, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ReadClassicWorld(gz)
+}
+
+// Saves the level to a ClassicWorld (.cw) file.
+// The level is written to a temporary file first and then renamed over path, so a crash
+// during saving never leaves a half-written level behind.
+func (l *Level) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(file)
+	err = WriteClassicWorld(gz, l)
+
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// Reads an uncompressed ClassicWorld NBT structure into a new level.
+func ReadClassicWorld(r io.Reader) (*Level, error) {
+	rootName, root, err := nbt.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootName != "ClassicWorld" {
+		return nil, fmt.Errorf("not a ClassicWorld file (root tag '%v')", rootName)
+	}
+
+	if version, _ := root.Byte("FormatVersion"); version != classicWorldVersion {
+		return nil, fmt.Errorf("unsupported ClassicWorld format version [%v]", version)
+	}
+
+	name, _ := root.String("Name")
+	x, okX := root.Short("X")
+	y, okY := root.Short("Y")
+	z, okZ := root.Short("Z")
+
+	if !okX || !okY || !okZ || x <= 0 || y <= 0 || z <= 0 {
+		return nil, errors.New("ClassicWorld file has missing or invalid dimensions")
+	}
+
+	l := ConstructLevel(name, x, y, z)
+
+	l.Data, _ = root.ByteArray("BlockArray")
+	if int32(len(l.Data)) != l.BlocksTotal {
+		return nil, fmt.Errorf("ClassicWorld block array has %v blocks; Expected %v", len(l.Data), l.BlocksTotal)
+	}
+
+	if uuid, ok := root.ByteArray("UUID"); ok && len(uuid) == len(l.UUID) {
+		copy(l.UUID[:], uuid)
+	}
+
+	if spawn, ok := root.Compound("Spawn"); ok {
+		spawnX, _ := spawn.Short("X")
+		spawnY, _ := spawn.Short("Y")
+		spawnZ, _ := spawn.Short("Z")
+
+		l.SpawnPos[0] = float32(spawnX)
+		l.SpawnPos[1] = float32(spawnY)
+		l.SpawnPos[2] = float32(spawnZ)
+		l.SpawnYaw, _ = spawn.Byte("H")
+		l.SpawnPitch, _ = spawn.Byte("P")
+	}
+
+	if created, ok := root.Long("TimeCreated"); ok {
+		l.TimeCreated = time.Unix(created, 0)
+	}
+
+	// Metadata is kept as-is so that software-specific data (including the CPE compound) survives a save
+	if metadata, ok := root.Compound("Metadata"); ok {
+		l.Metadata = metadata
+	}
+
+	return l, nil
+}
+
+// Writes the level as an uncompressed ClassicWorld NBT structure.
+func WriteClassicWorld(w io.Writer, l *Level) error {
+	l.mu.RLock()
+	data := make([]byte, len(l.Data))
+	copy(data, l.Data)
+
+	metadata := nbt.Compound{"CPE": nbt.Compound{}}
+	for name, v := range l.Metadata {
+		metadata[name] = v
+	}
+	l.mu.RUnlock()
+
+	root := nbt.Compound{
+		"FormatVersion": classicWorldVersion,
+		"Name":          l.Name,
+		"UUID":          l.UUID[:],
+		"X":             l.Size.X,
+		"Y":             l.Size.Y,
+		"Z":             l.Size.Z,
+		"Spawn": nbt.Compound{
+			"X": int16(l.SpawnPos[0]),
+			"Y": int16(l.SpawnPos[1]),
+			"Z": int16(l.SpawnPos[2]),
+			"H": l.SpawnYaw,
+			"P": l.SpawnPitch,
+		},
+		"BlockArray":   data,
+		"TimeCreated":  l.TimeCreated.Unix(),
+		"LastModified": time.Now().Unix(),
+		"Metadata":     metadata,
+	}
+
+	return nbt.Write(w, "ClassicWorld", root)
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"log"
+	"midnight/pkg/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	sendQueueLength = 4096                  // Packets a client can have waiting before it's kicked for being too slow
+	flushInterval   = 50 * time.Millisecond // Queued packets are flushed once per tick
+	closeTimeout    = 5 * time.Second       // How long a closing client gets to receive its remaining packets
+)
+
+// Packets waiting to be written to a client. Queueing never blocks, so broadcasting to
+// a slow client doesn't hold up anyone else; Clients whose queue fills up are kicked instead.
+type sendQueue struct {
+	packets chan []byte
+	done    chan struct{} // Closed once the writer goroutine has closed the connection
+
+	// Guards the fields below; packets is only sent to or closed while it's held
+	mu       sync.Mutex
+	closed   bool
+	overflow bool
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{packets: make(chan []byte, sendQueueLength), done: make(chan struct{})}
+}
+
+// Queues a packet to be written by the writer goroutine.
+func (c Client) send(packet []byte) {
+	q := c.queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	select {
+	case q.packets <- packet:
+		metricPacketsOut.Inc(packet[0])
+	default:
+		q.closed = true
+		q.overflow = true
+		close(q.packets)
+
+		// Unblocks the writer if it's stuck on a client that stopped reading
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+}
+
+// Closes the connection once the packets queued so far have been written.
+// Packets queued after Close are dropped.
+func (c Client) Close() {
+	q := c.queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.closed = true
+	close(q.packets)
+
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+}
+
+// Waits until the connection has been closed, e.g. after Close has written the remaining packets.
+func (c Client) WaitClosed() {
+	<-c.queue.done
+}
+
+func (q *sendQueue) overflowed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.overflow
+}
+
+// Writes queued packets to the connection, flushing once per tick, until the queue is closed.
+func (c Client) writeLoop() {
+	defer close(c.queue.done)
+	defer c.Conn.Close()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet, ok := <-c.queue.packets:
+			if c.queue.overflowed() {
+				c.kickTooSlow()
+				return
+			}
+
+			if !ok {
+				c.Writer.Flush()
+				return
+			}
+
+			if _, err := c.Writer.Write(packet); err != nil {
+				c.Close()
+				return
+			}
+
+		case <-ticker.C:
+			if c.Writer.Buffered() == 0 {
+				continue
+			}
+
+			if err := c.Writer.Flush(); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Skips the rest of the queue and sends a disconnect message in its place.
+func (c Client) kickTooSlow() {
+	log.Printf("[%v] Send queue is full; Kicking client for being too slow", c.Conn.RemoteAddr().String())
+
+	protocol.Write(c.Writer, &protocol.DisconnectPlayer{Reason: "Your connection is too slow"})
+	c.Writer.Flush()
+}
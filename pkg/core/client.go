@@ -2,173 +2,82 @@ package core
 
 import (
 	"bufio"
-	"math"
+	"bytes"
+	"log"
 	"midnight/pkg/logging"
+	"midnight/pkg/protocol"
+	"midnight/pkg/util"
 	"net"
-	"strings"
+	"time"
 )
 
 type Client struct {
 	Conn   net.Conn
 	Reader *bufio.Reader
 	Writer *bufio.Writer
-}
 
-// Data-type read functions
+	// CPE is true if the client identified itself as supporting the Classic Protocol Extension
+	CPE bool
 
-func (c Client) ReadByte() (result byte, err error) {
-	single, err := c.Reader.ReadByte()
-	if err != nil {
-		return 0xAF, err
-	}
+	// Extensions the client listed in its ExtEntry packets, mapped to their versions
+	Extensions map[string]int32
 
-	return single, nil
+	// Packets waiting to be written by the client's writer goroutine
+	queue *sendQueue
 }
 
-func (c Client) ReadSByte() (result int8, err error) {
-	single, err := c.Reader.ReadByte()
-	if err != nil {
-		return -1, err
+// Creates a client for a new connection and starts its writer goroutine.
+func NewClient(conn net.Conn) Client {
+	c := Client{
+		Conn:       conn,
+		Reader:     bufio.NewReader(countingReader{conn}),
+		Writer:     bufio.NewWriter(countingWriter{conn}),
+		Extensions: make(map[string]int32),
+		queue:      newSendQueue(),
 	}
 
-	return int8(single), nil
+	go c.writeLoop()
+
+	return c
 }
 
-func (c Client) ReadShort() (result int16, err error) {
-	b0, err := c.Reader.ReadByte()
-	b1, err := c.Reader.ReadByte()
+// Returns true if both the client and the server support the given extension version.
+func (c Client) Supports(extName string, version int32) bool {
+	v, found := c.Extensions[extName]
+	return found && v == version && IsExtensionRegistered(extName, version)
+}
 
-	if err != nil {
-		return -1, err
+// Returns the highest block ID the client is able to display.
+func (c Client) MaxBlockId() byte {
+	if c.Supports("CustomBlocks", 1) {
+		return MaxCPEBlockId
 	}
-
-	return int16(b0)<<8 | int16(b1), nil
+	return MaxClassicBlockId
 }
 
-func (c Client) ReadInt() (result int32, err error) {
-	b0, err := c.Reader.ReadByte()
-	b1, err := c.Reader.ReadByte()
-	b2, err := c.Reader.ReadByte()
-	b3, err := c.Reader.ReadByte()
-
+// Reads the next packet sent by the client.
+func (c Client) ReadPacket() (protocol.Packet, error) {
+	packet, err := protocol.Read(c.Reader)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
+	metricPacketsIn.Inc(packet.Id())
 
-	return int32(b0)<<24 | int32(b1)<<16 | int32(b2)<<8 | int32(b3), nil
+	logging.Log_Debugf("[%v] [Read] {%v, %+v}", c.Conn.RemoteAddr(), packet.Id(), packet)
+	return packet, nil
 }
 
-func (c Client) ReadString(trim bool) (result string, err error) {
-	var raw [64]byte
-
-	for i := 0; i < 64; i++ {
-		raw[i], err = c.Reader.ReadByte()
-
-		if err != nil {
-			return "", err
-		}
-	}
-
-	if trim {
-		return strings.TrimSpace(string(raw[:])), nil
-	} else {
-		return string(raw[:]), nil
+// Queues a packet to be sent to the client.
+func (c Client) WritePacket(packet protocol.Packet) {
+	data, err := protocol.Marshal(packet)
+	if err != nil {
+		log.Printf("[%v] Could not encode packet: %v", c.Conn.RemoteAddr(), err)
+		return
 	}
-}
-
-// Packet read functions
-
-func (c Client) ReadPacket_PlayerIdentification() (packet byte, protocol byte, username string, verify string, ext byte, err error) {
-	packet, err = c.ReadByte()
-	protocol, err = c.ReadByte()
-	username, err = c.ReadString(true)
-	verify, err = c.ReadString(true)
-	ext, err = c.ReadByte()
-
-	logging.Log_Debugf("[%v] [Read] {%v, %v, %v, %v, %v}", c.Conn.RemoteAddr(), packet, protocol, username, verify, ext)
-
-	return packet, protocol, username, verify, ext, err
-}
-
-// 0x05 - Set Block
-func (c Client) ReadPacket_SetBlock() (x int16, y int16, z int16, mode byte, blockType byte, err error) {
-	x, err = c.ReadShort()
-	y, err = c.ReadShort()
-	z, err = c.ReadShort()
-	mode, err = c.ReadByte()
-	blockType, err = c.ReadByte()
-
-	logging.Log_Debugf("[%v] [Read] {%v, %v, %v, %v, %v, %v}", c.Conn.RemoteAddr(), 0x05, x, y, z, mode, blockType)
-	return x, y, z, mode, blockType, err
-}
-
-// 0x08 - Position and Orientation
-func (c Client) ReadPacket_PositionUpdate() (playerId int8, x float32, y float32, z float32, yaw byte, pitch byte, err error) {
-	playerId, err = c.ReadSByte()
-	_x, err := c.ReadShort()
-	_y, err := c.ReadShort()
-	_z, err := c.ReadShort()
-	yaw, err = c.ReadByte()
-	pitch, err = c.ReadByte()
-
-	x = float32(_x) / 32
-	y = float32(_y) / 32
-	z = float32(_z) / 32
-
-	//fmt.Printf("Test1: [%v, %v, %v]\n", float32(int16(x*32))/32, float32(int16(y*32))/32, float32(int16(z*32))/32)
-	//fmt.Printf("Test2: [%v, %v, %v]\n", x, y, z)
-
-	//logging.Log_Debugf("[%v] [Read] {%v, %v, %v, %v, %v, %v, %v}", c.Conn.RemoteAddr(), 0x08, playerId, x, y, z, yaw, pitch)
-	return playerId, x, y, z, yaw, pitch, err
-}
-
-func (c Client) ReadPacket_Message() (longMessage byte, message string, err error) {
-	longMessage, err = c.ReadByte() // Unused byte (0xFF)
-	message, err = c.ReadString(false)
-
-	return longMessage, message, err
-}
-
-func (c Client) ReadPacket_ExtInfo() (packet byte, appName string, extensionCount int16, err error) {
-	packet, err = c.ReadByte()
-	appName, err = c.ReadString(true)
-	extensionCount, err = c.ReadShort()
-
-	logging.Log_Debugf("[%v] [Read] {%v, %v, %v}", c.Conn.RemoteAddr(), packet, appName, extensionCount)
-
-	return packet, appName, extensionCount, err
-}
-
-func (c Client) ReadPacket_ExtEntry() (extName string, version int32, err error) {
-	packet, err := c.ReadByte()
-	extName, err = c.ReadString(true)
-	version, err = c.ReadInt()
-
-	logging.Log_Debugf("[%v] [Read] {%v, %v, %v}", c.Conn.RemoteAddr(), packet, extName, version)
-
-	return extName, version, err
-}
-
-func (c Client) ReadPacketEntry() (packet byte, err error) {
-	packet, err = c.ReadByte()
-
-	return packet, err
-}
-
-// Data-type write functions
 
-func (c Client) WriteShort(v int16) {
-	var b0, b1 uint8 = uint8(v >> 8), uint8(v & 0xFF)
-	c.Writer.WriteByte(b0)
-	c.Writer.WriteByte(b1)
-}
+	c.send(data)
 
-func (c Client) WriteInt(v int32) {
-	var b0, b1, b2, b3 uint8 = uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v & 0xFF)
-	c.Writer.WriteByte(b0)
-	c.Writer.WriteByte(b1)
-	c.Writer.WriteByte(b2)
-	c.Writer.WriteByte(b3)
+	logging.Log_Debugf("[%v] [Write] {%v, %+v}", c.Conn.RemoteAddr(), packet.Id(), packet)
 }
 
 // Packet write functions
@@ -179,172 +88,150 @@ func (c Client) WritePacket_ServerIdentification(server string, motd string, op
 		userType = 0x64
 	}
 
-	c.Writer.WriteByte(0x00)                          // Packet ID
-	c.Writer.WriteByte(0x07)                          // Protocol Version
-	c.Writer.Write(WritePacketUtil_PadString(server)) // Server name
-	c.Writer.Write(WritePacketUtil_PadString(motd))   // Server MOTD
-	c.Writer.WriteByte(userType)                      // User Type
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v, %v, %v}", c.Conn.RemoteAddr(), 0x00, 0x07, string(WritePacketUtil_PadString(server)), string(WritePacketUtil_PadString(motd)), userType)
+	c.WritePacket(&protocol.ServerIdentification{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Name:            server,
+		MOTD:            motd,
+		UserType:        userType,
+	})
 }
 
 func (c Client) WritePacket_LevelInit() {
-	c.Writer.WriteByte(0x02)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v}", c.Conn.RemoteAddr(), 0x02)
+	c.WritePacket(&protocol.LevelInitialize{})
 }
 
-func (c Client) WritePacket_LevelDataChunk(chunkLength int, data []byte, percentComplete byte) {
-	c.Writer.WriteByte(0x03)
-	c.WriteShort(int16(chunkLength))
-	c.Writer.Write(data)
-	c.Writer.WriteByte(percentComplete)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, <chunk data|%v>, %v}", c.Conn.RemoteAddr(), 0x03, chunkLength, len(data), percentComplete)
+func (c Client) WritePacket_LevelDataChunk(data []byte, percentComplete byte) {
+	c.WritePacket(&protocol.LevelDataChunk{Data: data, PercentComplete: percentComplete})
 }
 
 func (c Client) WritePacket_LevelFinalize(sizeX int16, sizeY int16, sizeZ int16) {
-	c.Writer.WriteByte(0x04)
-	c.WriteShort(sizeX)
-	c.WriteShort(sizeY)
-	c.WriteShort(sizeZ)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v, %v}", c.Conn.RemoteAddr(), 0x04, sizeX, sizeY, sizeZ)
+	c.WritePacket(&protocol.LevelFinalize{X: sizeX, Y: sizeY, Z: sizeZ})
 }
 
 func (c Client) WritePacket_SetBlock(block byte, x int16, y int16, z int16) {
-	c.Writer.WriteByte(0x06)
-	c.WriteShort(x)
-	c.WriteShort(y)
-	c.WriteShort(z)
-	c.Writer.WriteByte(block)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v, %v, %v}", c.Conn.RemoteAddr(), 0x06, x, y, z, block)
+	block = FallbackBlock(block, c.MaxBlockId())
+
+	c.WritePacket(&protocol.SetBlock{X: x, Y: y, Z: z, BlockType: block})
 }
 
 func (c Client) WritePacket_SpawnPlayer(posX, posY, posZ float32, yaw byte, pitch byte, playerId int8, playerName string) {
-	c.Writer.WriteByte(0x07)
-	c.Writer.WriteByte(byte(playerId))
-	c.Writer.Write(WritePacketUtil_PadString(playerName))
-	c.WriteShort(int16(posX * 32))
-	c.WriteShort(int16(posY * 32))
-	c.WriteShort(int16(posZ * 32))
-	c.Writer.WriteByte(yaw)
-	c.Writer.WriteByte(pitch)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v, %v, %v, %v, %v, %v}",
-		c.Conn.RemoteAddr(), 0x07, playerId, string(WritePacketUtil_PadString(playerName)), int16(posX*32), int16(posY*32), int16(posZ*32), yaw, pitch)
+	c.WritePacket(&protocol.SpawnPlayer{
+		PlayerId:   playerId,
+		PlayerName: playerName,
+		X:          int16(posX * 32),
+		Y:          int16(posY * 32),
+		Z:          int16(posZ * 32),
+		Yaw:        yaw,
+		Pitch:      pitch,
+	})
 }
 
 func (c Client) WritePacket_PlayerTeleport(posX, posY, posZ float32, yaw byte, pitch byte, playerId int8) {
-	c.Writer.WriteByte(0x08)
-	c.Writer.WriteByte(byte(playerId))
-	c.WriteShort(int16(posX * 32))
-	c.WriteShort(int16(posY * 32))
-	c.WriteShort(int16(posZ * 32))
-	c.Writer.WriteByte(yaw)
-	c.Writer.WriteByte(pitch)
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v, %v, %v, %v, %v}",
-		c.Conn.RemoteAddr(), 0x08, playerId, int16(posX*32), int16(posY*32), int16(posZ*32), yaw, pitch)
+	c.WritePacket(&protocol.PositionOrientation{
+		PlayerId: playerId,
+		X:        int16(posX * 32),
+		Y:        int16(posY * 32),
+		Z:        int16(posZ * 32),
+		Yaw:      yaw,
+		Pitch:    pitch,
+	})
 }
 
 func (c Client) WritePacket_DespawnPlayer(playerId int8) {
-	c.Writer.WriteByte(0x0C)
-	c.Writer.WriteByte(byte(playerId))
-	c.Writer.Flush()
+	c.WritePacket(&protocol.DespawnPlayer{PlayerId: playerId})
 }
 
 func (c Client) WritePacket_Message(playerId int8, message string) {
-	c.Writer.WriteByte(0x0D)
-	c.Writer.WriteByte(byte(playerId))
-	c.Writer.Write(WritePacketUtil_PadString(message))
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, msg[%v]}", c.Conn.RemoteAddr(), 0x0D, playerId, message)
+	c.WritePacket(&protocol.Message{PlayerId: playerId, Message: message})
 }
 
 func (c Client) WritePacket_DisconnectPlayer(message string) {
-	c.Writer.WriteByte(0x0E)
-	c.Writer.Write(WritePacketUtil_PadString(message))
-	c.Writer.Flush()
+	c.WritePacket(&protocol.DisconnectPlayer{Reason: message})
+}
 
-	logging.Log_Debugf("[%v] [Write] {%v, msg[%v]}", c.Conn.RemoteAddr(), 0x0E, string(WritePacketUtil_PadString(message)))
+func (c Client) WritePacket_UpdateUserType(op bool) {
+	var userType byte = 0x00
+	if op {
+		userType = 0x64
+	}
+
+	c.WritePacket(&protocol.UpdateUserType{UserType: userType})
 }
 
 func (c Client) WritePacket_ExtInfo(appName string, extensionCount int16) {
-	c.Writer.WriteByte(0x10)                           // Packet ID
-	c.Writer.Write(WritePacketUtil_PadString(appName)) // AppName
-	c.WriteShort(extensionCount)                       // Extension Count
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v}", c.Conn.RemoteAddr(), 0x10, string(WritePacketUtil_PadString(appName)), extensionCount)
+	c.WritePacket(&protocol.ExtInfo{AppName: appName, ExtensionCount: extensionCount})
 }
 
 func (c Client) WritePacket_ExtEntry(extName string, version int32) {
-	c.Writer.WriteByte(0x11)                           // Packet ID
-	c.Writer.Write(WritePacketUtil_PadString(extName)) // ExtName
-	c.WriteInt(version)                                // Version
-	c.Writer.Flush()
-
-	logging.Log_Debugf("[%v] [Write] {%v, %v, %v}", c.Conn.RemoteAddr(), 0x11, string(WritePacketUtil_PadString(extName)), version)
+	c.WritePacket(&protocol.ExtEntry{ExtName: extName, Version: version})
 }
 
 // Utils
 
-func WritePacketUtil_PadString(s string) []byte {
-	var raw [64]byte
-	copy(raw[:], s)
+// Sends many block changes, queued as a single entry so that they don't fill up the send queue.
+func (c Client) writeQueuedBlocks(blocks []queuedBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+
+	maxBlockId := c.MaxBlockId()
 
-	for i := len(s); i < 64; i++ {
-		raw[i] = 0x20 // ASCII space padding
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		packet := &protocol.SetBlock{X: b.pos.X, Y: b.pos.Y, Z: b.pos.Z, BlockType: FallbackBlock(b.block, maxBlockId)}
+		if err := protocol.Write(&buf, packet); err != nil {
+			log.Printf("[%v] Could not encode packet: %v", c.Conn.RemoteAddr(), err)
+			return
+		}
 	}
 
-	return raw[:]
+	c.send(buf.Bytes())
+	metricPacketsOut.Add(protocol.IdSetBlock, uint64(len(blocks)-1)) // send counted the first
+	logging.Log_Debugf("[%v] [Write] {%v, <%v blocks>}", c.Conn.RemoteAddr(), protocol.IdSetBlock, len(blocks))
 }
 
-func (c Client) WritePacketUtil_SendLevel(l *Level) error {
-	c.WritePacket_LevelInit()
-
-	data, err := l.Gzip()
+// Sends a level's blocks to the client. The blocks must not change while they're sent.
+func (c Client) WritePacketUtil_SendLevel(size util.Vector3i16, blocks []byte) error {
+	start := time.Now()
 
+	data, err := gzipBlocks(blocks, c.MaxBlockId())
 	if err != nil {
 		return err
 	}
 
-	totalChunks := int(math.Ceil(float64(len(data)) / float64(1024)))
+	if err := c.WritePacketUtil_SendGzippedLevel(size, data); err != nil {
+		return err
+	}
 
-	for i := 0; i < totalChunks; i++ {
-		chunk := make([]byte, 1024)
+	observeLevelSend(start, len(data))
+	return nil
+}
 
-		last := 0
+// Sends a level that gzipBlocks has compressed for the client's MaxBlockId.
+func (c Client) WritePacketUtil_SendGzippedLevel(size util.Vector3i16, data []byte) error {
+	c.WritePacket_LevelInit()
 
-		for z := 0; z < 1024; z++ {
-			zz := i*1024 + z
+	// The chunks are queued as a single entry so that large levels don't fill up the send queue
+	var chunks bytes.Buffer
+	totalChunks := (len(data) + 1023) / 1024
 
-			if zz >= len(data) { // For last chunk; Check for incomplete chunk to add padding
-				chunk[z] = 0x00
-				last++
-			} else {
-				chunk[z] = data[zz]
-			}
+	for i := 0; i < totalChunks; i++ {
+		chunk := data[i*1024:]
+		if len(chunk) > 1024 {
+			chunk = chunk[:1024]
 		}
 
-		if last != 0 {
-			c.WritePacket_LevelDataChunk(last, chunk, byte(((float32(i)+1.0)/float32(totalChunks))*100))
-		} else {
-			c.WritePacket_LevelDataChunk(1024, chunk, byte(((float32(i)+1.0)/float32(totalChunks))*100))
+		packet := &protocol.LevelDataChunk{Data: chunk, PercentComplete: byte((i + 1) * 100 / totalChunks)}
+		if err := protocol.Write(&chunks, packet); err != nil {
+			return err
 		}
 	}
 
-	c.WritePacket_LevelFinalize(l.Size.X, l.Size.Y, l.Size.Z)
+	c.send(chunks.Bytes())
+	metricPacketsOut.Add(protocol.IdLevelDataChunk, uint64(totalChunks-1)) // send counted the first
+	logging.Log_Debugf("[%v] [Write] {%v, <%v chunks|%v>}", c.Conn.RemoteAddr(), protocol.IdLevelDataChunk, totalChunks, len(data))
+
+	c.WritePacket_LevelFinalize(size.X, size.Y, size.Z)
 
-	return err
+	return nil
 }
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Something that can run commands: a player, or the console.
+type CommandSender interface {
+	Name() string
+	SendMessage(msg string)
+	HasPermission(permission string) bool
+}
+
+type Command struct {
+	Name        string
+	Aliases     []string
+	Usage       string // Arguments after the command name, e.g. "<level>"
+	Description string
+	Permission  string // Permission needed to use the command; Empty if everyone can use it
+	PlayerOnly  bool   // Set if the command can't be used from the console
+
+	// Runs the command. Returning ErrCommandUsage shows the sender the command's usage;
+	// Any other error is shown to them, capitalized.
+	Handler func(s *Server, sender CommandSender, args []string) error
+}
+
+// Returned by command handlers when the arguments they were given are invalid.
+var ErrCommandUsage = errors.New("invalid arguments")
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[string]*Command) // Commands by lowercase name and alias
+)
+
+// Registers a command under its name and aliases, replacing any command already using them.
+func RegisterCommand(cmd *Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		commands[strings.ToLower(name)] = cmd
+	}
+}
+
+// Removes a command's name and aliases, unless they've been taken over by another command.
+func UnregisterCommand(cmd *Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if commands[strings.ToLower(name)] == cmd {
+			delete(commands, strings.ToLower(name))
+		}
+	}
+}
+
+// Returns the command with the given name or alias, or nil if there is none.
+func FindCommand(name string) *Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+
+	return commands[strings.ToLower(name)]
+}
+
+// Returns every registered command once, sorted by name.
+func Commands() []*Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+
+	var cmds []*Command
+	for name, cmd := range commands {
+		if strings.EqualFold(name, cmd.Name) {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Returns true if the sender is allowed to use the command.
+func (cmd *Command) Allowed(sender CommandSender) bool {
+	if cmd.PlayerOnly {
+		if _, isPlayer := sender.(*Player); !isPlayer {
+			return false
+		}
+	}
+
+	return cmd.Permission == "" || sender.HasPermission(cmd.Permission)
+}
+
+// Returns how the command is used, e.g. "/goto <level>".
+func (cmd *Command) UsageString() string {
+	if cmd.Usage == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Usage
+}
+
+// Runs a command line such as "/goto main". The leading slash is optional.
+func (s *Server) ExecuteCommand(sender CommandSender, line string) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "/"))
+	if len(fields) == 0 {
+		return
+	}
+
+	name, args := fields[0], fields[1:]
+
+	cmd := FindCommand(name)
+	if cmd == nil {
+		msg := "&cUnknown command '/" + name + "'."
+		if suggestion := suggestCommand(sender, name); suggestion != "" {
+			msg += " Did you mean /" + suggestion + "?"
+		}
+
+		sender.SendMessage(msg)
+		sender.SendMessage("&cType /help for a list of commands.")
+		return
+	}
+
+	if _, isPlayer := sender.(*Player); cmd.PlayerOnly && !isPlayer {
+		sender.SendMessage("&c/" + cmd.Name + " can only be used by players.")
+		return
+	}
+	if !cmd.Allowed(sender) {
+		sender.SendMessage("&cYou don't have permission to use /" + cmd.Name + ".")
+		return
+	}
+
+	e := &CommandExecuteEvent{Sender: sender, Command: cmd, Args: args}
+	if FireEvent(e) {
+		return
+	}
+
+	log.Printf("[Command] %v: /%v", sender.Name(), strings.Join(fields, " "))
+
+	if err := cmd.Handler(s, sender, e.Args); err != nil {
+		if msg := err.Error(); errors.Is(err, ErrCommandUsage) || msg == "" {
+			sender.SendMessage("&cUsage: " + cmd.UsageString())
+		} else {
+			sender.SendMessage("&c" + strings.ToUpper(msg[:1]) + msg[1:])
+		}
+	}
+}
+
+// Returns the name of the command the sender most likely meant to type, or "" if nothing is close.
+func suggestCommand(sender CommandSender, typed string) string {
+	typed = strings.ToLower(typed)
+
+	best, bestDistance := "", 3 // More than two typos is too far off to guess
+	for _, cmd := range Commands() {
+		if !cmd.Allowed(sender) {
+			continue
+		}
+
+		for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+			name = strings.ToLower(name)
+
+			if strings.HasPrefix(name, typed) {
+				return cmd.Name
+			}
+
+			if d := editDistance(typed, name); d < bestDistance {
+				best, bestDistance = cmd.Name, d
+			}
+		}
+	}
+
+	return best
+}
+
+// Returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var colorCodeStripRegex *regexp.Regexp = regexp.MustCompile(`&[0-9a-fA-F]`)
+
+// Removes color codes from a message, e.g. before it's shown outside the game.
+func StripColorCodes(msg string) string {
+	return colorCodeStripRegex.ReplaceAllString(msg, "")
+}
+
+type consoleSender struct{}
+
+// The server console. It can use every command.
+var Console CommandSender = consoleSender{}
+
+func (consoleSender) Name() string { return "Console" }
+
+func (consoleSender) SendMessage(msg string) {
+	log.Printf("%v", StripColorCodes(msg))
+}
+
+func (consoleSender) HasPermission(permission string) bool { return true }
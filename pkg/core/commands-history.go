@@ -0,0 +1,198 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"midnight/pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "about",
+		Aliases:     []string{"b", "blockinfo"},
+		Usage:       "[x y z]",
+		Description: "Shows who changed a block. Without coordinates, shows the next block you click.",
+		Handler:     cmdAbout,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "undo",
+		Usage:       "<player> <time> [level]",
+		Description: "Reverts the blocks a player changed in the last <time>, e.g. /undo name 30m. Without a level, reverts them in every loaded level.",
+		Permission:  "command.undo",
+		Handler:     cmdUndo,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "rollback",
+		Aliases:     []string{"rb"},
+		Usage:       "<time> [level]",
+		Description: "Reverts every block changed in a level in the last <time>, e.g. /rollback 1h.",
+		Permission:  "command.rollback",
+		Handler:     cmdRollback,
+	})
+}
+
+func cmdAbout(s *Server, sender CommandSender, args []string) error {
+	if len(args) == 0 {
+		p, isPlayer := sender.(*Player)
+		if !isPlayer {
+			return ErrCommandUsage
+		}
+
+		p.aboutMode = true
+		p.SendMessage("&eClick a block to see its history.")
+		return nil
+	}
+
+	if len(args) != 3 {
+		return ErrCommandUsage
+	}
+
+	var coords [3]int16
+	for i, arg := range args {
+		n, err := strconv.ParseInt(arg, 10, 16)
+		if err != nil {
+			return ErrCommandUsage
+		}
+		coords[i] = int16(n)
+	}
+
+	l := s.mainLevel
+	if p, isPlayer := sender.(*Player); isPlayer {
+		if l = p.Level(); l == nil {
+			return nil // Between levels
+		}
+	}
+
+	pos := util.Vector3i16{X: coords[0], Y: coords[1], Z: coords[2]}
+	if !l.InBounds(pos.X, pos.Y, pos.Z) {
+		return fmt.Errorf("(%v, %v, %v) is outside of level '%v'", pos.X, pos.Y, pos.Z, l.Name)
+	}
+
+	showBlockHistory(sender, l, pos)
+	return nil
+}
+
+// Sends the history of a block, newest change last.
+func showBlockHistory(sender CommandSender, l *Level, pos util.Vector3i16) {
+	changes, err := l.BlockHistory(pos.X, pos.Y, pos.Z)
+	if err != nil {
+		log.Printf("Could not read the block history of level '%v': %v", l.Name, err)
+		sender.SendMessage("&cCould not read the block history.")
+		return
+	}
+
+	block := l.GetBlock(pos.X, pos.Y, pos.Z)
+
+	sender.SendMessage(fmt.Sprintf("&eBlock (%v, %v, %v) is %v.", pos.X, pos.Y, pos.Z, BlockName(block)))
+
+	if len(changes) == 0 {
+		sender.SendMessage("&eIt has never been changed.")
+		return
+	}
+
+	// Only the latest changes fit in chat
+	const maxShown = 8
+	if len(changes) > maxShown {
+		sender.SendMessage(fmt.Sprintf("&e%v older changes not shown.", len(changes)-maxShown))
+		changes = changes[len(changes)-maxShown:]
+	}
+
+	for _, c := range changes {
+		var action string
+		switch {
+		case c.New == BlockAir:
+			action = "broke " + BlockName(c.Old)
+		case c.Old == BlockAir:
+			action = "placed " + BlockName(c.New)
+		default:
+			action = "replaced " + BlockName(c.Old) + " with " + BlockName(c.New)
+		}
+
+		sender.SendMessage("&7" + formatDuration(time.Since(c.Time)) + " ago: &f" + c.Player + " " + action)
+	}
+}
+
+func cmdUndo(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrCommandUsage
+	}
+
+	username := args[0]
+	if p := s.Player(username); p != nil {
+		username = p.Username
+	}
+	if !strings.EqualFold(sender.Name(), username) {
+		if err := checkModerationTarget(s, sender, username); err != nil {
+			return err
+		}
+	}
+
+	duration, err := ParseDuration(args[1])
+	if err != nil {
+		return err
+	}
+
+	levels := s.Levels()
+	if len(args) == 3 {
+		l := s.Level(args[2])
+		if l == nil {
+			return fmt.Errorf("level '%v' is not loaded", args[2])
+		}
+		levels = []*Level{l}
+	}
+
+	since := time.Now().Add(-duration)
+
+	total := 0
+	for _, l := range levels {
+		n, err := l.RevertChanges(since, username, sender.Name())
+		if err != nil {
+			log.Printf("Could not undo the changes of %v in level '%v': %v", username, l.Name, err)
+			return fmt.Errorf("could not read the block history of level '%v'", l.Name)
+		}
+		total += n
+	}
+
+	sender.SendMessage(fmt.Sprintf("&eReverted %v blocks changed by %v in the last %v.", total, username, formatDuration(duration)))
+	log.Printf("%v undid %v blocks changed by %v in the last %v", sender.Name(), total, username, formatDuration(duration))
+	return nil
+}
+
+func cmdRollback(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrCommandUsage
+	}
+
+	duration, err := ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+
+	var l *Level
+	if len(args) == 2 {
+		if l = s.Level(args[1]); l == nil {
+			return fmt.Errorf("level '%v' is not loaded", args[1])
+		}
+	} else if p, isPlayer := sender.(*Player); isPlayer {
+		if l = p.Level(); l == nil {
+			return nil // Between levels
+		}
+	} else {
+		return ErrCommandUsage
+	}
+
+	n, err := l.RevertChanges(time.Now().Add(-duration), "", sender.Name())
+	if err != nil {
+		log.Printf("Could not roll back level '%v': %v", l.Name, err)
+		return fmt.Errorf("could not read the block history of level '%v'", l.Name)
+	}
+
+	sender.SendMessage(fmt.Sprintf("&eRolled back %v blocks changed in the last %v.", n, formatDuration(duration)))
+	log.Printf("%v rolled back %v blocks in level '%v' changed in the last %v", sender.Name(), n, l.Name, formatDuration(duration))
+	return nil
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Shortest prefixes that can be banned without the "banip.wide" permission
+const (
+	minIPv4BanPrefix = 16
+	minIPv6BanPrefix = 48
+)
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "kick",
+		Aliases:     []string{"k"},
+		Usage:       "<player> [reason]",
+		Description: "Disconnects a player.",
+		Permission:  "command.kick",
+		Handler:     cmdKick,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "ban",
+		Usage:       "<player> [reason]",
+		Description: "Bans a player permanently.",
+		Permission:  "command.ban",
+		Handler:     cmdBan,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "tempban",
+		Aliases:     []string{"tban"},
+		Usage:       "<player> <duration> [reason]",
+		Description: "Bans a player for a while, e.g. /tempban name 2d griefing.",
+		Permission:  "command.tempban",
+		Handler:     cmdTempban,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "banip",
+		Aliases:     []string{"ipban"},
+		Usage:       "<player|ip|range> [reason]",
+		Description: "Bans an IP address or CIDR range, or the address of an online player.",
+		Permission:  "command.banip",
+		Handler:     cmdBanIP,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "unban",
+		Usage:       "<player|ip|range>",
+		Description: "Removes a ban.",
+		Permission:  "command.unban",
+		Handler:     cmdUnban,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "whitelist",
+		Aliases:     []string{"wl"},
+		Usage:       "<on|off|list|add|remove> [player]",
+		Description: "Manages the whitelist. While it's on, only listed players can join.",
+		Permission:  "command.whitelist",
+		Handler:     cmdWhitelist,
+	})
+}
+
+func cmdKick(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 {
+		return ErrCommandUsage
+	}
+
+	p := s.Player(args[0])
+	if p == nil {
+		return fmt.Errorf("%v is not online", args[0])
+	}
+	if err := checkModerationTarget(s, sender, p.Username); err != nil {
+		return err
+	}
+
+	reason := strings.Join(args[1:], " ")
+	s.Kick(p, reason, sender.Name())
+
+	broadcastModeration(s, p.Username+" was kicked by "+sender.Name(), reason)
+	return nil
+}
+
+func cmdBan(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 {
+		return ErrCommandUsage
+	}
+
+	return banName(s, sender, args[0], 0, strings.Join(args[1:], " "))
+}
+
+func cmdTempban(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 2 {
+		return ErrCommandUsage
+	}
+
+	duration, err := ParseDuration(args[1])
+	if err != nil {
+		return err
+	}
+
+	return banName(s, sender, args[0], duration, strings.Join(args[2:], " "))
+}
+
+func banName(s *Server, sender CommandSender, username string, duration time.Duration, reason string) error {
+	if p := s.Player(username); p != nil {
+		username = p.Username
+	}
+	if err := checkModerationTarget(s, sender, username); err != nil {
+		return err
+	}
+
+	if _, err := s.BanName(username, reason, sender.Name(), duration); err != nil {
+		return err
+	}
+
+	msg := username + " was banned by " + sender.Name()
+	if duration > 0 {
+		msg += " for " + formatDuration(duration)
+	}
+
+	broadcastModeration(s, msg, reason)
+	log.Printf("%v banned %v (%v): %v", sender.Name(), username, banLength(duration), reason)
+	return nil
+}
+
+func cmdBanIP(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 {
+		return ErrCommandUsage
+	}
+
+	target := args[0]
+	if p := s.Player(target); p != nil {
+		if err := checkModerationTarget(s, sender, p.Username); err != nil {
+			return err
+		}
+
+		ip := remoteIP(p.IP)
+		if ip == nil {
+			return fmt.Errorf("could not find the IP address of %v", p.Username)
+		}
+		target = ip.String()
+	}
+
+	ipNet, err := parseIPRange(target)
+	if err != nil {
+		return err
+	}
+	if err := checkIPBanTarget(s, sender, ipNet); err != nil {
+		return err
+	}
+
+	reason := strings.Join(args[1:], " ")
+
+	b, err := s.BanIP(ipNet.String(), reason, sender.Name(), 0)
+	if err != nil {
+		return err
+	}
+
+	sender.SendMessage("&eBanned " + b.Target + ".")
+	log.Printf("%v banned %v: %v", sender.Name(), b.Target, reason)
+	return nil
+}
+
+func cmdUnban(s *Server, sender CommandSender, args []string) error {
+	if len(args) != 1 {
+		return ErrCommandUsage
+	}
+
+	found, err := s.Unban(args[0])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%v is not banned", args[0])
+	}
+
+	sender.SendMessage("&eUnbanned " + args[0] + ".")
+	log.Printf("%v unbanned %v", sender.Name(), args[0])
+	return nil
+}
+
+func cmdWhitelist(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 {
+		return ErrCommandUsage
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on", "off":
+		if len(args) != 1 {
+			return ErrCommandUsage
+		}
+
+		enabled := strings.EqualFold(args[0], "on")
+		if err := s.SetWhitelistEnabled(enabled); err != nil {
+			return err
+		}
+
+		sender.SendMessage("&eThe whitelist is now " + strings.ToLower(args[0]) + ".")
+		log.Printf("%v turned the whitelist %v", sender.Name(), strings.ToLower(args[0]))
+
+	case "list":
+		enabled, players := s.Whitelist()
+
+		state := "off"
+		if enabled {
+			state = "on"
+		}
+
+		if len(players) == 0 {
+			sender.SendMessage("&eThe whitelist is " + state + " and empty.")
+		} else {
+			sender.SendMessage("&eThe whitelist is " + state + ". Players: &f" + strings.Join(players, ", "))
+		}
+
+	case "add", "remove":
+		if len(args) != 2 {
+			return ErrCommandUsage
+		}
+
+		listed := strings.EqualFold(args[0], "add")
+		if err := s.SetWhitelisted(args[1], listed); err != nil {
+			return err
+		}
+
+		if listed {
+			sender.SendMessage("&eAdded " + args[1] + " to the whitelist.")
+			log.Printf("%v added %v to the whitelist", sender.Name(), args[1])
+		} else {
+			sender.SendMessage("&eRemoved " + args[1] + " from the whitelist.")
+			log.Printf("%v removed %v from the whitelist", sender.Name(), args[1])
+		}
+
+	default:
+		return ErrCommandUsage
+	}
+
+	return nil
+}
+
+// Players can only kick and ban players below their own rank.
+func checkModerationTarget(s *Server, sender CommandSender, username string) error {
+	p, isPlayer := sender.(*Player)
+	if !isPlayer {
+		return nil
+	}
+
+	if strings.EqualFold(p.Username, username) {
+		return fmt.Errorf("you can't do that to yourself")
+	}
+	if s.PlayerRank(username).Level >= p.Rank().Level {
+		return fmt.Errorf("you can't do that to %v", username)
+	}
+
+	return nil
+}
+
+// Returns an error if a player can't ban the range: if it contains their own address or that of
+// an online player they can't ban, or if it's wider than allowed without the "banip.wide" permission.
+func checkIPBanTarget(s *Server, sender CommandSender, ipNet *net.IPNet) error {
+	p, isPlayer := sender.(*Player)
+	if !isPlayer {
+		return nil
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	minPrefix := minIPv6BanPrefix
+	if bits == 32 {
+		minPrefix = minIPv4BanPrefix
+	}
+	if ones < minPrefix && !p.HasPermission("banip.wide") {
+		return fmt.Errorf("you can't ban ranges wider than /%v", minPrefix)
+	}
+
+	if ip := remoteIP(p.IP); ip != nil && ipNet.Contains(ip) {
+		return fmt.Errorf("%v contains your own address", ipNet)
+	}
+
+	for _, other := range s.Players() {
+		if ip := remoteIP(other.IP); ip == nil || !ipNet.Contains(ip) {
+			continue
+		}
+		if s.PlayerRank(other.Username).Level >= p.Rank().Level {
+			return fmt.Errorf("you can't ban %v, which contains the address of %v", ipNet, other.Username)
+		}
+	}
+
+	return nil
+}
+
+// Tells everyone online about a kick or ban.
+func broadcastModeration(s *Server, msg, reason string) {
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	for _, p := range s.Players() {
+		p.SendMessage("&e" + msg)
+	}
+}
+
+func banLength(duration time.Duration) string {
+	if duration == 0 {
+		return "permanent"
+	}
+	return formatDuration(duration)
+}
@@ -0,0 +1,390 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterCommand(&Command{
+		Name:        "help",
+		Aliases:     []string{"commands", "?"},
+		Usage:       "[command]",
+		Description: "Lists commands, or shows how to use a command.",
+		Handler:     cmdHelp,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "goto",
+		Aliases:     []string{"g", "join"},
+		Usage:       "<level>",
+		Description: "Takes you to a level, loading it if needed.",
+		PlayerOnly:  true,
+		Handler:     cmdGoto,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "newlvl",
+		Aliases:     []string{"newlevel"},
+		Usage:       "<name> <x> <y> <z> <generator> [seed]",
+		Description: "Creates a level. Options go after the generator's name, e.g. flat:stone*30,grass.",
+		Permission:  "command.newlvl",
+		Handler:     cmdNewLevel,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "physics",
+		Usage:       "[level] [off|normal|advanced]",
+		Description: "Shows or changes the physics of a level, or of the level you're in.",
+		Permission:  "command.physics",
+		Handler:     cmdPhysics,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "rank",
+		Aliases:     []string{"setrank"},
+		Usage:       "<player> [rank]",
+		Description: "Shows or changes the rank of a player.",
+		Permission:  "command.rank",
+		Handler:     cmdRank,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "ranks",
+		Description: "Lists the ranks.",
+		Handler:     cmdRanks,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "restart",
+		Usage:       "[delay|cancel] [reason]",
+		Description: "Restarts the server after a delay of up to a day in seconds, or e.g. 5m. Defaults to 10 seconds.",
+		Permission:  "command.restart",
+		Handler:     cmdRestart,
+	})
+
+	RegisterCommand(&Command{
+		Name:        "shutdown",
+		Aliases:     []string{"stop"},
+		Usage:       "[delay|cancel] [reason]",
+		Description: "Shuts down the server after a delay of up to a day in seconds, or e.g. 5m. Defaults to 10 seconds.",
+		Permission:  "command.shutdown",
+		Handler:     cmdShutdown,
+	})
+}
+
+func cmdHelp(s *Server, sender CommandSender, args []string) error {
+	if len(args) > 1 {
+		return ErrCommandUsage
+	}
+
+	if len(args) == 0 {
+		var names []string
+		for _, cmd := range Commands() {
+			if cmd.Allowed(sender) {
+				names = append(names, cmd.Name)
+			}
+		}
+
+		sender.SendMessage("&eCommands: &f" + strings.Join(names, ", "))
+		sender.SendMessage("&eType /help <command> to see how to use a command.")
+		return nil
+	}
+
+	name := strings.TrimPrefix(args[0], "/")
+
+	cmd := FindCommand(name)
+	if cmd == nil || cmd.Permission != "" && !sender.HasPermission(cmd.Permission) {
+		msg := "there is no command named '/" + name + "'."
+		if suggestion := suggestCommand(sender, name); suggestion != "" {
+			msg += " Did you mean /" + suggestion + "?"
+		}
+		return errors.New(msg)
+	}
+
+	sender.SendMessage("&eUsage: &f" + cmd.UsageString())
+	if cmd.Description != "" {
+		sender.SendMessage("&e" + cmd.Description)
+	}
+	if len(cmd.Aliases) > 0 {
+		sender.SendMessage("&eAliases: &f/" + strings.Join(cmd.Aliases, ", /"))
+	}
+	if _, isPlayer := sender.(*Player); cmd.PlayerOnly && !isPlayer {
+		sender.SendMessage("&eThis command can only be used by players.")
+	}
+
+	return nil
+}
+
+func cmdGoto(s *Server, sender CommandSender, args []string) error {
+	p := sender.(*Player)
+
+	if len(args) != 1 {
+		return ErrCommandUsage
+	}
+
+	l, err := s.OpenLevel(args[0])
+	if err != nil {
+		if os.IsNotExist(err) || !isValidLevelName(args[0]) {
+			return fmt.Errorf("there is no level named '%v'. Loaded levels: %v", args[0], strings.Join(levelNames(s.Levels()), ", "))
+		}
+
+		log.Printf("Could not load level '%v': %v", args[0], err)
+		return fmt.Errorf("could not load level '%v'", args[0])
+	}
+
+	if err := s.MovePlayer(p, l); err != nil {
+		return err
+	}
+
+	log.Printf("%v went to level '%v'", p.Username, l.Name)
+	return nil
+}
+
+// Levels are limited to 1024 blocks on each side, and to as many blocks as a 512x256x512 level
+const (
+	minLevelSize   = 16
+	maxLevelSize   = 1024
+	maxLevelVolume = 512 * 256 * 512
+)
+
+func cmdNewLevel(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 5 || len(args) > 6 {
+		return ErrCommandUsage
+	}
+
+	name := args[0]
+	if !isValidLevelName(name) {
+		return fmt.Errorf("level names can only contain letters, digits, '_' and '-'")
+	}
+	var size [3]int16
+	volume := 1
+	for i, arg := range args[1:4] {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return ErrCommandUsage
+		}
+		if n < minLevelSize || n > maxLevelSize {
+			return fmt.Errorf("levels must be %v to %v blocks on each side", minLevelSize, maxLevelSize)
+		}
+
+		size[i] = int16(n)
+		volume *= n
+	}
+	if volume > maxLevelVolume {
+		return fmt.Errorf("levels can have at most %v blocks; %v has %v", maxLevelVolume, strings.Join(args[1:4], "x"), volume)
+	}
+
+	seed := time.Now().UnixNano()
+	if len(args) == 6 {
+		seed = ParseSeed(args[5])
+	}
+
+	// Nobody else can load or create a level with the name until this one has been added
+	release, err := s.reserveLevelName(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := os.Stat(LevelPath(name)); err == nil {
+		return fmt.Errorf("level '%v' already exists", name)
+	}
+
+	sender.SendMessage("&eGenerating level '" + name + "'...")
+
+	l, err := GenerateLevel(name, size[0], size[1], size[2], args[4], seed)
+	if err != nil {
+		return err
+	}
+
+	if !s.SaveLevel(l) {
+		return fmt.Errorf("level '%v' could not be saved", name)
+	}
+	if err := s.addLevel(l); err != nil {
+		return err
+	}
+
+	sender.SendMessage(fmt.Sprintf("&eCreated level '%v' with seed %v. Type /goto %v to go there.", name, seed, name))
+	log.Printf("%v created level '%v' [%vx%vx%v, %v, seed %v]", sender.Name(), name, size[0], size[1], size[2], args[4], seed)
+	return nil
+}
+
+func cmdPhysics(s *Server, sender CommandSender, args []string) error {
+	if len(args) > 2 {
+		return ErrCommandUsage
+	}
+
+	var l *Level
+	if len(args) == 2 || len(args) == 1 && s.Level(args[0]) != nil {
+		l = s.Level(args[0])
+		if l == nil {
+			return fmt.Errorf("there is no loaded level named '%v'", args[0])
+		}
+		args = args[1:]
+	} else if p, isPlayer := sender.(*Player); isPlayer && p.Level() != nil {
+		l = p.Level()
+	} else {
+		return ErrCommandUsage
+	}
+
+	if len(args) == 0 {
+		sender.SendMessage(fmt.Sprintf("&ePhysics in level '%v' is %v.", l.Name, l.PhysicsMode()))
+		return nil
+	}
+
+	mode, found := ParsePhysicsMode(args[0])
+	if !found {
+		return ErrCommandUsage
+	}
+
+	l.SetPhysicsMode(mode)
+	sender.SendMessage(fmt.Sprintf("&ePhysics in level '%v' is now %v.", l.Name, mode))
+	for _, p := range l.Players() {
+		if p != sender {
+			p.SendMessage(fmt.Sprintf("&e%v set physics in this level to %v.", sender.Name(), mode))
+		}
+	}
+	log.Printf("%v set physics in level '%v' to %v", sender.Name(), l.Name, mode)
+	return nil
+}
+
+func cmdRank(s *Server, sender CommandSender, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrCommandUsage
+	}
+
+	username := args[0]
+	if p := s.Player(username); p != nil {
+		username = p.Username
+	}
+	current := s.PlayerRank(username)
+
+	if len(args) == 1 {
+		sender.SendMessage("&eThe rank of " + username + " is " + current.ColoredName() + "&e.")
+		return nil
+	}
+
+	r := s.Rank(args[1])
+	if r == nil {
+		return fmt.Errorf("there is no rank named '%v'. Ranks: %v", args[1], strings.Join(rankNames(s.Ranks()), ", "))
+	}
+
+	// Players can only manage players and ranks below their own rank
+	if p, isPlayer := sender.(*Player); isPlayer {
+		own := p.Rank()
+		if current.Level >= own.Level && !strings.EqualFold(p.Username, username) {
+			return fmt.Errorf("you can't change the rank of %v", username)
+		}
+		if r.Level >= own.Level {
+			return fmt.Errorf("you can only give ranks below your own")
+		}
+	}
+
+	if err := s.SetPlayerRank(username, r); err != nil {
+		return err
+	}
+
+	sender.SendMessage("&eThe rank of " + username + " is now " + r.ColoredName() + "&e.")
+	log.Printf("%v set the rank of %v to '%v'", sender.Name(), username, r.Name)
+	return nil
+}
+
+func cmdRanks(s *Server, sender CommandSender, args []string) error {
+	var names []string
+	for _, r := range s.Ranks() {
+		names = append(names, fmt.Sprintf("%v &f(%v)", r.ColoredName(), r.Level))
+	}
+
+	sender.SendMessage("&eRanks: " + strings.Join(names, "&f, "))
+	return nil
+}
+
+func rankNames(ranks []*Rank) []string {
+	names := make([]string, len(ranks))
+	for i, r := range ranks {
+		names[i] = r.Name
+	}
+	return names
+}
+
+func levelNames(levels []*Level) []string {
+	names := make([]string, len(levels))
+	for i, l := range levels {
+		names[i] = l.Name
+	}
+	return names
+}
+
+func cmdRestart(s *Server, sender CommandSender, args []string) error {
+	return scheduleShutdown(s, sender, args, true)
+}
+
+func cmdShutdown(s *Server, sender CommandSender, args []string) error {
+	return scheduleShutdown(s, sender, args, false)
+}
+
+func scheduleShutdown(s *Server, sender CommandSender, args []string, restart bool) error {
+	if len(args) == 1 && strings.EqualFold(args[0], "cancel") {
+		if !s.CancelShutdown() {
+			return errors.New("no shutdown or restart is scheduled")
+		}
+
+		s.SendAnnouncement("&aThe scheduled shutdown was cancelled.")
+		log.Printf("%v cancelled the scheduled shutdown", sender.Name())
+		return nil
+	}
+
+	// A reason can't start with a digit, so that a mistyped delay doesn't shut down the server right away
+	delay := 10 * time.Second
+	if len(args) > 0 && args[0] != "" && strings.ContainsRune("-0123456789", rune(args[0][0])) {
+		d, err := parseShutdownDelay(args[0])
+		if err != nil {
+			return ErrCommandUsage
+		}
+		delay, args = d, args[1:]
+	}
+
+	action, reason := "shutdown", strings.Join(args, " ")
+	if restart {
+		action = "restart"
+	}
+	if reason == "" {
+		reason = "Server " + action
+	}
+
+	if delay == 0 {
+		go s.Shutdown(reason, restart)
+		return nil
+	}
+
+	if err := s.ScheduleShutdown(delay, reason, restart); err != nil {
+		return err
+	}
+	log.Printf("%v scheduled a %v in %v", sender.Name(), action, formatDuration(delay))
+	return nil
+}
+
+// Parses a shutdown delay given in seconds, or as a duration like "5m".
+func parseShutdownDelay(str string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(str); err == nil {
+		if secs < 0 || secs > int(maxShutdownDelay/time.Second) {
+			return 0, fmt.Errorf("invalid delay '%v'", str)
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+
+	d, err := ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d > maxShutdownDelay {
+		return 0, fmt.Errorf("invalid delay '%v'", str)
+	}
+	return d, nil
+}
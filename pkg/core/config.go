@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"math"
+	"net/url"
 	"os"
 )
 
@@ -13,11 +14,55 @@ type Config struct {
 	ServerName  string  `json:"server_name"`
 	Motd        string  `json:"motd"`
 	Public      bool    `json:"public"`
+	Web         bool    `json:"web"` // Set if players can join from the web client
 	VerifyLogin bool    `json:"verify_login"`
 	MaxUsers    float64 `json:"max_users"`
 
+	// Lets players on the local network, e.g. 127.0.0.1 or 192.168.x.x, join without being verified by a server list
+	AllowUnverifiedLAN bool `json:"allow_unverified_lan"`
+
 	AnnouncePlayers bool `json:"announce_users"`
 
+	// Server lists that heartbeats are sent to while the server is public, e.g. ClassiCube's, a BetaCraft-style list or a self-hosted one
+	HeartbeatURLs []string `json:"heartbeat_urls"`
+
+	MainLevel          string `json:"main_level"`           // Level that players join when connecting
+	MainLevelGenerator string `json:"main_level_generator"` // Generator for the main level if it doesn't exist, e.g. "terrain" or "flat:stone*30,grass"
+	MainLevelSeed      string `json:"main_level_seed"`      // Seed for generating the main level; Empty picks a random seed
+
+	AutosaveInterval float64 `json:"autosave_interval"`  // Seconds between level autosaves; 0 disables autosaving
+	LevelUnloadDelay float64 `json:"level_unload_delay"` // Seconds before an empty level is unloaded; 0 keeps levels loaded
+	BlockHistoryDays float64 `json:"block_history_days"` // Days that block changes are kept for /about and /undo; 0 keeps them forever
+
+	Physics       string  `json:"physics"`        // Physics mode of levels that haven't been given one: off, normal or advanced
+	PhysicsBudget float64 `json:"physics_budget"` // Most block updates per level per physics tick
+
+	// Names of protocol extensions a client must support to join
+	RequiredExtensions []string `json:"required_extensions"`
+
+	// Remote console; See pkg/rcon. It's only started if enabled and a password is set.
+	RCON struct {
+		Enabled  bool    `json:"enabled"`
+		IP       string  `json:"ip"`
+		Port     float64 `json:"port"`
+		Password string  `json:"password"`
+	} `json:"rcon"`
+
+	// HTTP admin API; See pkg/httpapi. It's only started if enabled and a token is set.
+	HTTPAPI struct {
+		Enabled bool    `json:"enabled"`
+		IP      string  `json:"ip"`
+		Port    float64 `json:"port"`
+		Token   string  `json:"token"` // Sent by clients as "Authorization: Bearer <token>"
+	} `json:"http_api"`
+
+	// Prometheus metrics, served at /metrics; See pkg/metrics
+	Metrics struct {
+		Enabled bool    `json:"enabled"`
+		IP      string  `json:"ip"`
+		Port    float64 `json:"port"`
+	} `json:"metrics"`
+
 	Debug struct {
 		OverrideSalt bool   `json:"override_salt"`
 		Salt         string `json:"salt"`
@@ -33,8 +78,32 @@ func LoadConfig_Default() *Config {
 		Public:      true,
 		VerifyLogin: true,
 		MaxUsers:    15,
+
+		HeartbeatURLs: []string{DefaultHeartbeatURL},
+
+		MainLevel:          "main",
+		MainLevelGenerator: "flat",
+		AutosaveInterval:   300,
+		LevelUnloadDelay:   600,
+		BlockHistoryDays:   30,
+		Physics:            "normal",
+		PhysicsBudget:      1000,
 	}
 
+	c.RCON.Enabled = false
+	c.RCON.IP = "127.0.0.1"
+	c.RCON.Port = 25575
+	c.RCON.Password = ""
+
+	c.HTTPAPI.Enabled = false
+	c.HTTPAPI.IP = "127.0.0.1"
+	c.HTTPAPI.Port = 25580
+	c.HTTPAPI.Token = ""
+
+	c.Metrics.Enabled = false
+	c.Metrics.IP = "127.0.0.1"
+	c.Metrics.Port = 25590
+
 	c.Debug.OverrideSalt = false
 	c.Debug.Salt = ""
 
@@ -66,6 +135,76 @@ func LoadConfig_File() (*Config, error) {
 		config.MaxUsers = 15
 	}
 
+	if config.AutosaveInterval < 0 || math.Trunc(config.AutosaveInterval) != config.AutosaveInterval {
+		log.Printf("[server.json] Invalid 'autosave_interval' [%v]; Setting to default [300]", config.AutosaveInterval)
+		config.AutosaveInterval = 300
+	}
+
+	if config.LevelUnloadDelay < 0 || math.Trunc(config.LevelUnloadDelay) != config.LevelUnloadDelay {
+		log.Printf("[server.json] Invalid 'level_unload_delay' [%v]; Setting to default [600]", config.LevelUnloadDelay)
+		config.LevelUnloadDelay = 600
+	}
+
+	if config.BlockHistoryDays < 0 {
+		log.Printf("[server.json] Invalid 'block_history_days' [%v]; Setting to default [30]", config.BlockHistoryDays)
+		config.BlockHistoryDays = 30
+	}
+
+	if _, found := ParsePhysicsMode(config.Physics); !found {
+		log.Printf("[server.json] Invalid 'physics' [%v]; Setting to default [normal]", config.Physics)
+		config.Physics = "normal"
+	}
+
+	if config.PhysicsBudget < 1 || math.Trunc(config.PhysicsBudget) != config.PhysicsBudget {
+		log.Printf("[server.json] Invalid 'physics_budget' [%v]; Setting to default [1000]", config.PhysicsBudget)
+		config.PhysicsBudget = 1000
+	}
+
+	var heartbeatURLs []string
+	for _, u := range config.HeartbeatURLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			log.Printf("[server.json] Invalid URL in 'heartbeat_urls' [%v]; Skipping it", u)
+			continue
+		}
+		heartbeatURLs = append(heartbeatURLs, u)
+	}
+	config.HeartbeatURLs = heartbeatURLs
+
+	if !isValidLevelName(config.MainLevel) {
+		log.Printf("[server.json] Invalid 'main_level' [%v]; Setting to default [main]", config.MainLevel)
+		config.MainLevel = "main"
+	}
+
+	if genName, _ := splitGeneratorSpec(config.MainLevelGenerator); FindGenerator(genName) == nil {
+		log.Printf("[server.json] Invalid 'main_level_generator' [%v]; Setting to default [flat]", config.MainLevelGenerator)
+		config.MainLevelGenerator = "flat"
+	}
+
+	if config.RCON.Port < 1 || config.RCON.Port > 65535 || math.Trunc(config.RCON.Port) != config.RCON.Port {
+		log.Printf("[server.json] Invalid 'rcon.port' [%v]; Setting to default [25575]", config.RCON.Port)
+		config.RCON.Port = 25575
+	}
+
+	if config.RCON.Enabled && config.RCON.Password == "" {
+		log.Printf("[server.json] 'rcon.password' is empty; RCON will not be started")
+		config.RCON.Enabled = false
+	}
+
+	if config.HTTPAPI.Port < 1 || config.HTTPAPI.Port > 65535 || math.Trunc(config.HTTPAPI.Port) != config.HTTPAPI.Port {
+		log.Printf("[server.json] Invalid 'http_api.port' [%v]; Setting to default [25580]", config.HTTPAPI.Port)
+		config.HTTPAPI.Port = 25580
+	}
+
+	if config.HTTPAPI.Enabled && config.HTTPAPI.Token == "" {
+		log.Printf("[server.json] 'http_api.token' is empty; The HTTP API will not be started")
+		config.HTTPAPI.Enabled = false
+	}
+
+	if config.Metrics.Port < 1 || config.Metrics.Port > 65535 || math.Trunc(config.Metrics.Port) != config.Metrics.Port {
+		log.Printf("[server.json] Invalid 'metrics.port' [%v]; Setting to default [25590]", config.Metrics.Port)
+		config.Metrics.Port = 25590
+	}
+
 	if len(config.ServerName) > 64 {
 		log.Printf("[server.json] Invalid 'server_name': too long [%v]; Truncating to 64 characters [%v]", config.ServerName, config.ServerName[:64])
 		config.ServerName = config.ServerName[:64]
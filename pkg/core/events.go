@@ -0,0 +1,217 @@
+package core
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+type EventType string
+
+const (
+	EventPlayerPreLogin EventType = "PlayerPreLogin"
+	EventPlayerJoin     EventType = "PlayerJoin"
+	EventPlayerQuit     EventType = "PlayerQuit"
+	EventPlayerChat     EventType = "PlayerChat"
+	EventPlayerMove     EventType = "PlayerMove"
+	EventBlockPlace     EventType = "BlockPlace"
+	EventBlockBreak     EventType = "BlockBreak"
+	EventLevelLoad      EventType = "LevelLoad"
+	EventCommandExecute EventType = "CommandExecute"
+)
+
+// Handlers run from the lowest priority to the highest, so higher priorities get the final say.
+// Monitor handlers run last and see the outcome; Cancelling an event there has no effect.
+type EventPriority int
+
+const (
+	PriorityLowest EventPriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+	PriorityHighest
+	PriorityMonitor
+)
+
+type Event interface {
+	Type() EventType
+}
+
+// An event that can be cancelled, stopping what caused it from happening.
+type Cancellable interface {
+	Event
+	Cancelled() bool
+	SetCancelled(cancelled bool)
+}
+
+type cancellable struct {
+	cancelled bool
+}
+
+func (c *cancellable) Cancelled() bool             { return c.cancelled }
+func (c *cancellable) SetCancelled(cancelled bool) { c.cancelled = cancelled }
+
+// Fired when a player has identified and passed the login checks, before they join.
+// Reason is shown to the player if the event is cancelled. The event starts out cancelled
+// when the player is banned or not whitelisted; Uncancelling it lets them in anyway.
+type PlayerPreLoginEvent struct {
+	cancellable
+	Username string
+	Addr     string
+	Reason   string
+}
+
+// Fired when a player joins, before they're sent to Level.
+type PlayerJoinEvent struct {
+	Player *Player
+	Level  *Level
+}
+
+// Fired when a player disconnects. Reason is empty if they left by themselves.
+type PlayerQuitEvent struct {
+	Player *Player
+	Reason string
+}
+
+// Fired when a player sends a chat message that isn't a command.
+type PlayerChatEvent struct {
+	cancellable
+	Player     *Player
+	Message    string
+	Recipients []*Player
+}
+
+// Fired when a player moves or turns. Cancelling the event sends the player back to From;
+// Changing To moves them there.
+type PlayerMoveEvent struct {
+	cancellable
+	Player   *Player
+	From, To Position
+}
+
+// Fired when a player places a block. Changing Block places that block instead.
+type BlockPlaceEvent struct {
+	cancellable
+	Player *Player
+	Level  *Level
+	X      int16
+	Y      int16
+	Z      int16
+	Block  byte
+	Old    byte // Block being replaced
+}
+
+// Fired when a player breaks a block.
+type BlockBreakEvent struct {
+	cancellable
+	Player *Player
+	Level  *Level
+	X      int16
+	Y      int16
+	Z      int16
+	Block  byte // Block being broken
+}
+
+// Fired when a level is loaded or created.
+type LevelLoadEvent struct {
+	Level *Level
+}
+
+// Fired when a command is about to run, after the sender's permission has been checked.
+// Changing Args runs the command with those arguments instead.
+type CommandExecuteEvent struct {
+	cancellable
+	Sender  CommandSender
+	Command *Command
+	Args    []string
+}
+
+func (*PlayerPreLoginEvent) Type() EventType { return EventPlayerPreLogin }
+func (*PlayerJoinEvent) Type() EventType     { return EventPlayerJoin }
+func (*PlayerQuitEvent) Type() EventType     { return EventPlayerQuit }
+func (*PlayerChatEvent) Type() EventType     { return EventPlayerChat }
+func (*PlayerMoveEvent) Type() EventType     { return EventPlayerMove }
+func (*BlockPlaceEvent) Type() EventType     { return EventBlockPlace }
+func (*BlockBreakEvent) Type() EventType     { return EventBlockBreak }
+func (*LevelLoadEvent) Type() EventType      { return EventLevelLoad }
+func (*CommandExecuteEvent) Type() EventType { return EventCommandExecute }
+
+type EventHandler struct {
+	Event           EventType
+	Priority        EventPriority
+	IgnoreCancelled bool // Set to skip events that an earlier handler has cancelled
+
+	// Handles the event, which is a pointer to the struct for the event type, e.g. *PlayerChatEvent.
+	// Handlers run on the goroutine that fired the event, e.g. the player's connection goroutine.
+	Handle func(e Event)
+}
+
+var (
+	eventHandlersMu sync.RWMutex
+	eventHandlers   = make(map[EventType][]*EventHandler) // Handlers by event type, sorted by priority
+)
+
+// Registers an event handler. Handlers with the same priority run in the order they were registered.
+func RegisterEventHandler(h *EventHandler) {
+	eventHandlersMu.Lock()
+	defer eventHandlersMu.Unlock()
+
+	// The slice is copied so that events being fired keep the handlers they started with
+	handlers := append([]*EventHandler{}, eventHandlers[h.Event]...)
+	handlers = append(handlers, h)
+	sort.SliceStable(handlers, func(i, j int) bool { return handlers[i].Priority < handlers[j].Priority })
+
+	eventHandlers[h.Event] = handlers
+}
+
+func UnregisterEventHandler(h *EventHandler) {
+	eventHandlersMu.Lock()
+	defer eventHandlersMu.Unlock()
+
+	var handlers []*EventHandler
+	for _, other := range eventHandlers[h.Event] {
+		if other != h {
+			handlers = append(handlers, other)
+		}
+	}
+
+	eventHandlers[h.Event] = handlers
+}
+
+// Runs the handlers for an event. Returns true if the event was cancelled.
+func FireEvent(e Event) (cancelled bool) {
+	eventHandlersMu.RLock()
+	handlers := eventHandlers[e.Type()]
+	eventHandlersMu.RUnlock()
+
+	c, isCancellable := e.(Cancellable)
+
+	for _, h := range handlers {
+		if isCancellable && h.Priority == PriorityMonitor {
+			cancelled = c.Cancelled()
+		}
+		if isCancellable && h.IgnoreCancelled && c.Cancelled() {
+			continue
+		}
+
+		runEventHandler(h, e)
+
+		if isCancellable && h.Priority == PriorityMonitor {
+			c.SetCancelled(cancelled)
+		}
+	}
+
+	return isCancellable && c.Cancelled()
+}
+
+// Runs an event handler, logging it if it panics so that one broken handler can't take down the server.
+func runEventHandler(h *EventHandler, e Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("%v event handler panicked: %v\n%s", e.Type(), err, debug.Stack())
+		}
+	}()
+
+	h.Handle(e)
+}
@@ -0,0 +1,64 @@
+package core
+
+// Reference Page: https://wiki.vg/Classic_Protocol_Extension
+
+type Extension struct {
+	Name    string
+	Version int32
+}
+
+var registeredExtensions []Extension
+
+func init() {
+	RegisterExtension("EmoteFix", 1)
+	RegisterExtension("LongerMessages", 1)
+}
+
+// Registers a protocol extension to be advertised to CPE clients during the handshake.
+// Registering an extension that already exists replaces its version.
+func RegisterExtension(name string, version int32) {
+	for i, ext := range registeredExtensions {
+		if ext.Name == name {
+			registeredExtensions[i].Version = version
+			return
+		}
+	}
+
+	registeredExtensions = append(registeredExtensions, Extension{Name: name, Version: version})
+}
+
+// Returns every extension the server advertises, in registration order.
+func RegisteredExtensions() []Extension {
+	exts := make([]Extension, len(registeredExtensions))
+	copy(exts, registeredExtensions)
+
+	return exts
+}
+
+// Returns true if the server advertises the given extension at the given version.
+func IsExtensionRegistered(name string, version int32) bool {
+	v, found := registeredVersion(name)
+	return found && v == version
+}
+
+func registeredVersion(name string) (version int32, found bool) {
+	for _, ext := range registeredExtensions {
+		if ext.Name == name {
+			return ext.Version, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the names of the required extensions that the client did not negotiate.
+func MissingExtensions(c Client, required []string) []string {
+	var missing []string
+
+	for _, name := range required {
+		if !c.Supports(name, c.Extensions[name]) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
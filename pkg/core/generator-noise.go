@@ -0,0 +1,94 @@
+package core
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Improved Perlin noise (Ken Perlin, 2002) with a permutation table shuffled by a seed.
+type perlinNoise struct {
+	perm [512]int
+}
+
+func newPerlinNoise(rng *rand.Rand) *perlinNoise {
+	n := new(perlinNoise)
+
+	for i, v := range rng.Perm(256) {
+		n.perm[i] = v
+		n.perm[i+256] = v
+	}
+
+	return n
+}
+
+// Returns noise at a point, roughly between -1 and 1.
+func (n *perlinNoise) noise3(x, y, z float64) float64 {
+	fx, fy, fz := math.Floor(x), math.Floor(y), math.Floor(z)
+	xi, yi, zi := int(fx)&255, int(fy)&255, int(fz)&255
+	x, y, z = x-fx, y-fy, z-fz
+
+	u, v, w := fade(x), fade(y), fade(z)
+	p := &n.perm
+
+	a := p[xi] + yi
+	aa, ab := p[a]+zi, p[a+1]+zi
+	b := p[xi+1] + yi
+	ba, bb := p[b]+zi, p[b+1]+zi
+
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(p[aa], x, y, z), grad(p[ba], x-1, y, z)),
+			lerp(u, grad(p[ab], x, y-1, z), grad(p[bb], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(p[aa+1], x, y, z-1), grad(p[ba+1], x-1, y, z-1)),
+			lerp(u, grad(p[ab+1], x, y-1, z-1), grad(p[bb+1], x-1, y-1, z-1))))
+}
+
+// Returns fractal noise: several octaves of noise, each at twice the frequency and
+// persistence times the amplitude of the one before. The result is roughly between -1 and 1.
+func (n *perlinNoise) octaves(x, y, z float64, octaves int, persistence float64) float64 {
+	total, amplitude, max := 0.0, 1.0, 0.0
+
+	for i := 0; i < octaves; i++ {
+		total += n.noise3(x, y, z) * amplitude
+		max += amplitude
+
+		x, y, z = x*2, y*2, z*2
+		amplitude *= persistence
+	}
+
+	return total / max
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(t, a, b float64) float64 {
+	return a + t*(b-a)
+}
+
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+
+	u := y
+	if h < 8 {
+		u = x
+	}
+
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+
+	return u + v
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"midnight/pkg/nbt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fills a new level with blocks. The same seed and parameters always give the same level.
+type Generator interface {
+	// Fills l.Data, which starts out as all air. Params are generator-specific options,
+	// e.g. the layers of a flat level; An empty string uses the defaults.
+	Generate(l *Level, seed int64, params string) error
+}
+
+// Lets an ordinary function be used as a Generator.
+type GeneratorFunc func(l *Level, seed int64, params string) error
+
+func (f GeneratorFunc) Generate(l *Level, seed int64, params string) error {
+	return f(l, seed, params)
+}
+
+var (
+	generatorsMu sync.RWMutex
+	generators   = make(map[string]Generator) // Generators by lowercase name
+)
+
+// Registers a generator under a name, replacing any generator already using it.
+func RegisterGenerator(name string, g Generator) {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+
+	generators[strings.ToLower(name)] = g
+}
+
+// Returns the generator with the given name, or nil if there is none.
+func FindGenerator(name string) Generator {
+	generatorsMu.RLock()
+	defer generatorsMu.RUnlock()
+
+	return generators[strings.ToLower(name)]
+}
+
+// Returns the names of the registered generators, sorted.
+func GeneratorNames() []string {
+	generatorsMu.RLock()
+	defer generatorsMu.RUnlock()
+
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Generators are chosen as "name" or "name:params", e.g. "flat:stone*30,dirt*3,grass".
+func splitGeneratorSpec(spec string) (name string, params string) {
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// Creates a level with a generator, given as "name" or "name:params". The spawn point is
+// put on the ground in the middle of the level.
+func GenerateLevel(name string, x, y, z int16, spec string, seed int64) (*Level, error) {
+	if x <= 0 || y <= 0 || z <= 0 {
+		return nil, errors.New("level dimensions must be positive")
+	}
+
+	genName, params := splitGeneratorSpec(spec)
+
+	g := FindGenerator(genName)
+	if g == nil {
+		return nil, fmt.Errorf("there is no generator named '%v'. Generators: %v", genName, strings.Join(GeneratorNames(), ", "))
+	}
+
+	l := ConstructLevel(name, x, y, z)
+	l.Data = make([]byte, l.BlocksTotal)
+
+	if err := g.Generate(l, seed, params); err != nil {
+		return nil, err
+	}
+
+	l.spawnOnGround()
+	l.Metadata = nbt.Compound{
+		"Midnight": nbt.Compound{
+			"Generator": strings.ToLower(genName),
+			"Params":    params,
+			"Seed":      seed,
+		},
+	}
+
+	return l, nil
+}
+
+// Parses a seed. Seeds that aren't numbers are hashed, so words can be used as seeds.
+func ParseSeed(str string) int64 {
+	if seed, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return seed
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(str))
+	return int64(h.Sum64())
+}
+
+// Moves the spawn point to just above the highest block in the middle of the level.
+// Levels with nothing in the middle keep their spawn point.
+func (l *Level) spawnOnGround() {
+	x, z := l.Size.X/2, l.Size.Z/2
+
+	for y := l.Size.Y - 1; y >= 0; y-- {
+		if b := l.Data[l.Index(x, y, z)]; b != BlockAir && b != BlockLeaves {
+			l.SpawnPos[0] = float32(x) + 0.5
+			l.SpawnPos[1] = float32(y) + 2
+			l.SpawnPos[2] = float32(z) + 0.5
+			return
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterGenerator("flat", GeneratorFunc(generateFlat))
+	RegisterGenerator("void", GeneratorFunc(generateVoid))
+	RegisterGenerator("terrain", GeneratorFunc(generateTerrain))
+	RegisterGenerator("islands", GeneratorFunc(generateIslands))
+}
+
+// Fills the level with layers of blocks. Params lists the layers from the bottom up, each a block
+// optionally followed by "*" and its thickness, e.g. "bedrock,stone*30,dirt*3,grass".
+// Without params, the bottom half of the level is stone with dirt and grass on top.
+func generateFlat(l *Level, seed int64, params string) error {
+	var layers []byte
+
+	if params == "" {
+		half := int(l.Size.Y) / 2
+		for y := 0; y <= half; y++ {
+			switch {
+			case y == half:
+				layers = append(layers, BlockGrass)
+			case y >= half-3:
+				layers = append(layers, BlockDirt)
+			default:
+				layers = append(layers, BlockStone)
+			}
+		}
+	}
+
+	for _, layer := range strings.Split(params, ",") {
+		if layer == "" {
+			continue
+		}
+
+		name, count := layer, 1
+		if i := strings.IndexByte(layer, '*'); i >= 0 {
+			n, err := strconv.Atoi(layer[i+1:])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid layer thickness in '%v'", layer)
+			}
+			name, count = layer[:i], n
+		}
+
+		block, found := FindBlock(name)
+		if !found {
+			return fmt.Errorf("unknown block '%v'", name)
+		}
+
+		for i := 0; i < count && len(layers) < int(l.Size.Y); i++ {
+			layers = append(layers, block)
+		}
+	}
+
+	layerSize := int(l.Size.X) * int(l.Size.Z)
+	for y, block := range layers {
+		if y >= int(l.Size.Y) {
+			break
+		}
+
+		for i := y * layerSize; i < (y+1)*layerSize; i++ {
+			l.Data[i] = block
+		}
+	}
+
+	return nil
+}
+
+// Leaves the level empty.
+func generateVoid(l *Level, seed int64, params string) error {
+	if params != "" {
+		return fmt.Errorf("the void generator has no options")
+	}
+
+	return nil
+}
+
+// Generates rolling hills with beaches, lakes and seas, trees and ore veins.
+// Params are options given as "name=value", e.g. "water=20,trees=2": "water" is the height of the
+// sea, half the level's height by default, and "trees" and "ores" scale how many trees and ore veins there are.
+func generateTerrain(l *Level, seed int64, params string) error {
+	sizeX, sizeY, sizeZ := int(l.Size.X), int(l.Size.Y), int(l.Size.Z)
+
+	water, trees, ores := float64(sizeY/2), 1.0, 1.0
+	err := parseGeneratorOptions("terrain", params, map[string]generatorOption{
+		"water": {value: &water, min: 0, max: float64(sizeY - 1), integer: true},
+		"trees": {value: &trees, min: 0, max: 25},
+		"ores":  {value: &ores, min: 0, max: 10},
+	})
+	if err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	heightNoise := newPerlinNoise(rng)
+	roughNoise := newPerlinNoise(rng)
+	beachNoise := newPerlinNoise(rng)
+	forestNoise := newPerlinNoise(rng)
+
+	ground, waterLevel := sizeY/2, int(water)
+
+	var treeSpots [][3]int16
+
+	for x := 0; x < sizeX; x++ {
+		for z := 0; z < sizeZ; z++ {
+			fx, fz := float64(x)/64, float64(z)/64
+
+			// Hills are steeper where the ground is rough
+			rough := (roughNoise.octaves(fx/2, 0.5, fz/2, 2, 0.5) + 1) / 2
+			height := ground + int((heightNoise.octaves(fx, 0.5, fz, 6, 0.5)+0.15)*float64(sizeY)/2*(0.4+rough))
+			height = clampInt(height, 1, sizeY-1)
+
+			beach := height <= waterLevel+1 && beachNoise.octaves(fx*2, 0.5, fz*2, 3, 0.5) > -0.2
+
+			for y := 0; y <= height; y++ {
+				block := BlockStone
+				switch {
+				case y == 0:
+					block = BlockBedrock
+				case y < height-3:
+					block = BlockStone
+				case beach:
+					block = BlockSand
+				case y < height:
+					block = BlockDirt
+				case height < waterLevel:
+					block = BlockGravel
+				default:
+					block = BlockGrass
+				}
+
+				l.Data[l.Index(int16(x), int16(y), int16(z))] = block
+			}
+
+			for y := height + 1; y <= waterLevel; y++ {
+				l.Data[l.Index(int16(x), int16(y), int16(z))] = BlockStillWater
+			}
+
+			// Forests are where the forest noise is high; Elsewhere trees are rare
+			if !beach && height > waterLevel {
+				chance := 0.003
+				if forestNoise.octaves(fx*2, 0.5, fz*2, 2, 0.5) > 0.2 {
+					chance = 0.04
+				}
+
+				if rng.Float64() < chance*trees {
+					treeSpots = append(treeSpots, [3]int16{int16(x), int16(height), int16(z)})
+				}
+			}
+		}
+	}
+
+	placeOreVeins(l, rng, ores)
+
+	for _, spot := range treeSpots {
+		placeTree(l, rng, spot[0], spot[1], spot[2], l.setGenerated)
+	}
+
+	return nil
+}
+
+// Generates islands of grass, dirt and stone floating in the sky, with trees on them.
+// Params are options given as "name=value", e.g. "size=2,amount=0.5": "amount" and "size" scale how much
+// of the sky islands fill and how large they are, "height" is the height they're centered on, half the
+// level's height by default, and "trees" scales how many trees there are.
+func generateIslands(l *Level, seed int64, params string) error {
+	sizeX, sizeY, sizeZ := int(l.Size.X), int(l.Size.Y), int(l.Size.Z)
+
+	amount, size, height, trees := 1.0, 1.0, float64(sizeY)/2, 1.0
+	err := parseGeneratorOptions("islands", params, map[string]generatorOption{
+		"amount": {value: &amount, min: 0, max: 3},
+		"size":   {value: &size, min: 0.25, max: 4},
+		"height": {value: &height, min: 0, max: float64(sizeY - 1), integer: true},
+		"trees":  {value: &trees, min: 0, max: 25},
+	})
+	if err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	noise := newPerlinNoise(rng)
+
+	// More islands fill the sky as the noise needed for stone drops
+	threshold := 0.12 + (1-amount)*0.1
+
+	for y := 0; y < sizeY; y++ {
+		// Islands thin out above and below the height they're centered on
+		falloff := math.Abs(float64(y)-height) / float64(sizeY) * 2.2
+		falloff *= falloff
+
+		for z := 0; z < sizeZ; z++ {
+			for x := 0; x < sizeX; x++ {
+				density := noise.octaves(float64(x)/(48*size), float64(y)/(24*size), float64(z)/(48*size), 4, 0.5)
+
+				if density-falloff*0.6 > threshold {
+					l.Data[l.Index(int16(x), int16(y), int16(z))] = BlockStone
+				}
+			}
+		}
+	}
+
+	// Covers the top of each island with grass and dirt
+	var treeSpots [][3]int16
+	for x := 0; x < sizeX; x++ {
+		for z := 0; z < sizeZ; z++ {
+			depth := 0
+
+			for y := sizeY - 1; y >= 0; y-- {
+				i := l.Index(int16(x), int16(y), int16(z))
+				if l.Data[i] == BlockAir {
+					depth = 0
+					continue
+				}
+
+				switch depth {
+				case 0:
+					l.Data[i] = BlockGrass
+					if rng.Float64() < 0.02*trees {
+						treeSpots = append(treeSpots, [3]int16{int16(x), int16(y), int16(z)})
+					}
+				case 1, 2, 3:
+					l.Data[i] = BlockDirt
+				}
+				depth++
+			}
+		}
+	}
+
+	placeOreVeins(l, rng, 1)
+
+	for _, spot := range treeSpots {
+		placeTree(l, rng, spot[0], spot[1], spot[2], l.setGenerated)
+	}
+
+	return nil
+}
+
+// A number a generator's params can set, as "name=value".
+type generatorOption struct {
+	value    *float64
+	min, max float64
+	integer  bool
+}
+
+// Sets options from comma-separated "name=value" params. Options that aren't given keep their value.
+func parseGeneratorOptions(generator, params string, options map[string]generatorOption) error {
+	for _, option := range strings.Split(params, ",") {
+		if option == "" {
+			continue
+		}
+
+		i := strings.IndexByte(option, '=')
+		if i < 0 {
+			return fmt.Errorf("invalid option '%v'; Options are given as name=value", option)
+		}
+
+		name := strings.ToLower(option[:i])
+		opt, found := options[name]
+		if !found {
+			names := make([]string, 0, len(options))
+			for name := range options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			return fmt.Errorf("the %v generator has no option '%v'. Options: %v", generator, name, strings.Join(names, ", "))
+		}
+
+		v, err := strconv.ParseFloat(option[i+1:], 64)
+		if err != nil || !(v >= opt.min && v <= opt.max) || opt.integer && v != math.Trunc(v) {
+			kind := "a number"
+			if opt.integer {
+				kind = "a whole number"
+			}
+			return fmt.Errorf("'%v' must be %v from %v to %v", name, kind, opt.min, opt.max)
+		}
+
+		*opt.value = v
+	}
+
+	return nil
+}
+
+// Ores, how many veins of each there are per block of the level, and how long the veins are.
+var oreVeins = []struct {
+	block   byte
+	density float64
+	length  int
+}{
+	{BlockCoalOre, 1.0 / 2048, 12},
+	{BlockIronOre, 1.0 / 4096, 8},
+	{BlockGoldOre, 1.0 / 12288, 6},
+}
+
+// Replaces stone with wandering veins of ore. Frequency scales the number of veins.
+func placeOreVeins(l *Level, rng *rand.Rand, frequency float64) {
+	for _, ore := range oreVeins {
+		veins := int(float64(l.BlocksTotal) * ore.density * frequency)
+
+		for i := 0; i < veins; i++ {
+			x := int16(rng.Intn(int(l.Size.X)))
+			y := int16(rng.Intn(int(l.Size.Y)))
+			z := int16(rng.Intn(int(l.Size.Z)))
+
+			for step := 0; step < ore.length; step++ {
+				if l.InBounds(x, y, z) && l.Data[l.Index(x, y, z)] == BlockStone {
+					l.Data[l.Index(x, y, z)] = ore.block
+				}
+
+				x += int16(rng.Intn(3) - 1)
+				y += int16(rng.Intn(3) - 1)
+				z += int16(rng.Intn(3) - 1)
+			}
+		}
+	}
+}
+
+// Sets a block in a level that's being generated.
+func (l *Level) setGenerated(x, y, z int16, block byte) {
+	l.Data[l.Index(x, y, z)] = block
+}
+
+// Grows a tree on the ground block at x, y, z, changing blocks with set. Trees only replace air.
+func placeTree(l *Level, rng *rand.Rand, x, y, z int16, set func(x, y, z int16, block byte)) {
+	height := int16(4 + rng.Intn(3))
+	top := y + height
+
+	if !l.InBounds(x, top+1, z) {
+		return
+	}
+
+	set(x, y, z, BlockDirt)
+
+	// Wide layers of leaves around the top of the trunk, and narrow ones above it
+	for ly := top - 3; ly <= top+1; ly++ {
+		radius := int16(2)
+		if ly >= top {
+			radius = 1
+		}
+
+		for lx := x - radius; lx <= x+radius; lx++ {
+			for lz := z - radius; lz <= z+radius; lz++ {
+				corner := (lx-x == radius || x-lx == radius) && (lz-z == radius || z-lz == radius)
+				if corner && (ly == top+1 || rng.Intn(2) == 0) {
+					continue
+				}
+
+				if l.InBounds(lx, ly, lz) && l.Data[l.Index(lx, ly, lz)] == BlockAir {
+					set(lx, ly, lz, BlockLeaves)
+				}
+			}
+		}
+	}
+
+	for ty := y + 1; ty <= top; ty++ {
+		if b := l.Data[l.Index(x, ty, z)]; b == BlockAir || b == BlockLeaves {
+			set(x, ty, z, BlockLog)
+		}
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -1,48 +1,196 @@
 package core
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func BeginHeartbeatLoop(srv *Server) {
-	log.Printf("Starting ClassiCube.net Heartbeat...")
-	firstSent := false
+const DefaultHeartbeatURL = "http://www.classicube.net/server/heartbeat/"
+
+const heartbeatTimeout = 15 * time.Second
+
+// Variables rather than constants so that tests can change them
+var (
+	heartbeatInterval = 45 * time.Second
+
+	// Failed heartbeats are retried after heartbeatRetryMin, doubling each time they fail again up to heartbeatRetryMax
+	heartbeatRetryMin = 5 * time.Second
+	heartbeatRetryMax = 5 * time.Minute
+
+	// Waits between heartbeats; Tests replace it so that they don't have to wait
+	heartbeatAfter = time.After
+)
+
+var heartbeatClient = &http.Client{Timeout: heartbeatTimeout}
+
+// What the server knows about one of the server lists it sends heartbeats to.
+type HeartbeatStatus struct {
+	URL         string     `json:"url"`
+	ServerURL   string     `json:"server_url,omitempty"` // Where players can find the server on the list, returned by the list
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"` // Error of the last heartbeat, if it failed
+	Failures    int        `json:"failures"`             // Heartbeats that have failed in a row
+}
+
+type heartbeat struct {
+	url  string
+	salt string // Salt the list uses to make mppasses for players joining through it
+
+	mu     sync.Mutex // Guards status
+	status HeartbeatStatus
+}
+
+// Starts sending heartbeats to each server list, each in its own goroutine, until the server shuts down.
+func (s *Server) startHeartbeats(urls []string) {
+	for _, u := range urls {
+		hb := &heartbeat{url: u, salt: s.salts[u], status: HeartbeatStatus{URL: u}}
+		s.heartbeats = append(s.heartbeats, hb)
+
+		go s.heartbeatLoop(hb)
+	}
+}
+
+// Returns the status of every server list the server sends heartbeats to.
+func (s *Server) Heartbeats() []HeartbeatStatus {
+	statuses := make([]HeartbeatStatus, len(s.heartbeats))
+	for i, hb := range s.heartbeats {
+		hb.mu.Lock()
+		statuses[i] = hb.status
+		hb.mu.Unlock()
+	}
+	return statuses
+}
+
+func (s *Server) heartbeatLoop(hb *heartbeat) {
+	log.Printf("Sending heartbeats to %v", hb.url)
+	retry := heartbeatRetryMin
+
 	for {
-		v := url.Values{}
-		v.Set("name", srv.name)
-		v.Set("port", srv.port)
-		v.Set("users", strconv.Itoa(len(srv.players)))
-		v.Set("max", strconv.Itoa(int(srv.maxUsers)))
-		v.Set("public", strconv.FormatBool(srv.public))
-		v.Set("salt", srv.Salt)
-		v.Set("software", "Midnight")
-		v.Set("web", "false")
-
-		res, err := http.PostForm("http://www.classicube.net/server/heartbeat/", v)
+		delay := heartbeatInterval
+
+		serverURL, err := s.sendHeartbeat(hb)
 
+		hb.mu.Lock()
+		failures := hb.status.Failures
 		if err != nil {
-			log.Printf("Heartbeat failed: %v", err)
-			break
+			hb.status.LastError = err.Error()
+			hb.status.Failures++
+		} else {
+			now := time.Now()
+			hb.status.LastSuccess = &now
+			hb.status.LastError = ""
+			hb.status.Failures = 0
 		}
-
-		data, err := ioutil.ReadAll(res.Body)
-		res.Body.Close()
+		urlChanged := err == nil && serverURL != "" && serverURL != hb.status.ServerURL
+		if urlChanged {
+			hb.status.ServerURL = serverURL
+		}
+		hb.mu.Unlock()
 
 		if err != nil {
-			log.Printf("Heartbeat failed: %v", err)
-			break
+			metricHeartbeats.With("failure").Inc()
+
+			delay = retry
+			if retry *= 2; retry > heartbeatRetryMax {
+				retry = heartbeatRetryMax
+			}
+
+			log.Printf("Heartbeat to %v failed: %v; Retrying in %v", hb.url, err, delay)
+		} else {
+			metricHeartbeats.With("success").Inc()
+			retry = heartbeatRetryMin
+
+			if failures > 0 {
+				log.Printf("Heartbeat to %v succeeded after %v failures", hb.url, failures)
+			}
+			if urlChanged {
+				log.Printf("Server URL: %v", serverURL)
+			}
+		}
+
+		select {
+		case <-s.quit:
+			return
+		case <-heartbeatAfter(delay):
+		}
+	}
+}
+
+// Sends a heartbeat to a server list. Returns the server's URL on the list, if the list gave one.
+func (s *Server) sendHeartbeat(hb *heartbeat) (serverURL string, err error) {
+	v := url.Values{}
+	v.Set("name", s.name)
+	v.Set("port", s.port)
+	v.Set("users", strconv.Itoa(s.PlayerCount()))
+	v.Set("max", strconv.Itoa(int(s.maxUsers)))
+	v.Set("public", strconv.FormatBool(s.public))
+	v.Set("salt", hb.salt)
+	v.Set("version", "7") // Protocol version, which BetaCraft-style lists ask for
+	v.Set("software", "Midnight")
+	v.Set("web", strconv.FormatBool(s.web))
+
+	res, err := heartbeatClient.PostForm(hb.url, v)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return parseHeartbeatResponse(res.StatusCode, body)
+}
+
+// Server lists answer with the server's URL as plain text, or with JSON such as
+// {"errors": [["Invalid salt"]], "response": "", "status": "fail"}.
+func parseHeartbeatResponse(status int, body []byte) (serverURL string, err error) {
+	text := strings.TrimSpace(string(body))
+
+	if strings.HasPrefix(text, "{") {
+		var res struct {
+			Errors   [][]string `json:"errors"`
+			Response string     `json:"response"`
+			Status   string     `json:"status"`
+		}
+		if err := json.Unmarshal([]byte(text), &res); err != nil {
+			return "", fmt.Errorf("invalid response: %v", err)
+		}
+
+		var msgs []string
+		for _, e := range res.Errors {
+			msgs = append(msgs, strings.Join(e, " "))
+		}
+
+		if res.Status == "fail" || len(msgs) > 0 {
+			if len(msgs) == 0 {
+				msgs = append(msgs, "heartbeat was rejected")
+			}
+			return "", errors.New(strings.Join(msgs, "; "))
 		}
 
-		if !firstSent {
-			log.Printf("Heartbeat sent: %s", data)
-			firstSent = true
+		text = strings.TrimSpace(res.Response)
+	}
+
+	if status < 200 || status > 299 {
+		if text == "" || len(text) > 200 {
+			text = http.StatusText(status)
 		}
+		return "", fmt.Errorf("%v [%v]", text, status)
+	}
 
-		time.Sleep(time.Minute)
+	if strings.HasPrefix(text, "http://") || strings.HasPrefix(text, "https://") {
+		return text, nil
 	}
+	return "", nil
 }
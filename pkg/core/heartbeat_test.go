@@ -0,0 +1,233 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A server list that answers every heartbeat with the response it's been given.
+type testServerList struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	body   string
+	forms  []map[string]string // Values of each heartbeat received
+}
+
+func newTestServerList(t *testing.T) *testServerList {
+	list := &testServerList{status: http.StatusOK}
+
+	list.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		list.mu.Lock()
+		defer list.mu.Unlock()
+
+		form := make(map[string]string)
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		list.forms = append(list.forms, form)
+
+		w.WriteHeader(list.status)
+		w.Write([]byte(list.body))
+	}))
+	t.Cleanup(list.Close)
+
+	return list
+}
+
+func (list *testServerList) respond(status int, body string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.status, list.body = status, body
+}
+
+// Runs a server's heartbeat loop for a list, one heartbeat at a time.
+type testHeartbeats struct {
+	s  *Server
+	hb *heartbeat
+
+	delays chan time.Duration // Receives the delay before the next heartbeat once each heartbeat is done
+	next   chan time.Time     // Lets the loop send the next heartbeat
+}
+
+func startTestHeartbeats(t *testing.T, list *testServerList) *testHeartbeats {
+	h := &testHeartbeats{
+		s:      newTestServer(t),
+		delays: make(chan time.Duration),
+		next:   make(chan time.Time),
+	}
+	h.s.port = "25565"
+	h.hb = &heartbeat{url: list.URL, salt: "0123456789abcdef", status: HeartbeatStatus{URL: list.URL}}
+	h.s.heartbeats = []*heartbeat{h.hb}
+
+	interval, retryMin, retryMax, after := heartbeatInterval, heartbeatRetryMin, heartbeatRetryMax, heartbeatAfter
+	heartbeatInterval, heartbeatRetryMin, heartbeatRetryMax = time.Minute, time.Second, 10*time.Second
+	heartbeatAfter = func(d time.Duration) <-chan time.Time {
+		select {
+		case h.delays <- d:
+		case <-h.s.quit:
+		}
+		return h.next
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.s.heartbeatLoop(h.hb)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		close(h.s.quit)
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("the heartbeat loop didn't stop")
+		}
+
+		heartbeatInterval, heartbeatRetryMin, heartbeatRetryMax, heartbeatAfter = interval, retryMin, retryMax, after
+	})
+
+	return h
+}
+
+// Waits for a heartbeat to be sent, returning the list's status afterwards and the delay before the next one.
+func (h *testHeartbeats) wait(t *testing.T) (HeartbeatStatus, time.Duration) {
+	t.Helper()
+
+	select {
+	case delay := <-h.delays:
+		return h.s.Heartbeats()[0], delay
+	case <-time.After(testTimeout):
+		t.Fatal("no heartbeat was sent")
+		return HeartbeatStatus{}, 0
+	}
+}
+
+// Sends the next heartbeat and waits for it.
+func (h *testHeartbeats) step(t *testing.T) (HeartbeatStatus, time.Duration) {
+	t.Helper()
+
+	h.next <- time.Now()
+	return h.wait(t)
+}
+
+func TestHeartbeatServerURL(t *testing.T) {
+	list := newTestServerList(t)
+	list.respond(http.StatusOK, "http://www.classicube.net/server/play/abc123/\n")
+
+	h := startTestHeartbeats(t, list)
+	status, delay := h.wait(t)
+
+	if status.ServerURL != "http://www.classicube.net/server/play/abc123/" {
+		t.Errorf("server URL is '%v'", status.ServerURL)
+	}
+	if status.LastError != "" || status.Failures != 0 || status.LastSuccess == nil {
+		t.Errorf("heartbeat should have succeeded: %+v", status)
+	}
+	if delay != heartbeatInterval {
+		t.Errorf("next heartbeat is in %v; Expected %v", delay, heartbeatInterval)
+	}
+
+	list.mu.Lock()
+	form := list.forms[0]
+	list.mu.Unlock()
+
+	expected := map[string]string{"name": "Test", "port": "25565", "users": "0", "max": "128", "salt": "0123456789abcdef", "software": "Midnight"}
+	for k, v := range expected {
+		if form[k] != v {
+			t.Errorf("heartbeat sent %v '%v'; Expected '%v'", k, form[k], v)
+		}
+	}
+
+	// A response without a URL keeps the one the list gave before
+	list.respond(http.StatusOK, "")
+	if status, _ := h.step(t); status.ServerURL != "http://www.classicube.net/server/play/abc123/" {
+		t.Errorf("server URL changed to '%v'", status.ServerURL)
+	}
+}
+
+func TestHeartbeatRejected(t *testing.T) {
+	list := newTestServerList(t)
+	list.respond(http.StatusOK, `{"errors":[["Invalid salt"]],"status":"fail"}`)
+
+	h := startTestHeartbeats(t, list)
+
+	for failures := 1; failures <= 3; failures++ {
+		var status HeartbeatStatus
+		if failures == 1 {
+			status, _ = h.wait(t)
+		} else {
+			status, _ = h.step(t)
+		}
+
+		if status.LastError != "Invalid salt" {
+			t.Errorf("last error is '%v'; Expected 'Invalid salt'", status.LastError)
+		}
+		if status.Failures != failures {
+			t.Errorf("%v failures; Expected %v", status.Failures, failures)
+		}
+		if status.LastSuccess != nil || status.ServerURL != "" {
+			t.Errorf("heartbeat should have failed: %+v", status)
+		}
+	}
+}
+
+func TestHeartbeatErrorStatus(t *testing.T) {
+	list := newTestServerList(t)
+	list.respond(http.StatusServiceUnavailable, "")
+
+	h := startTestHeartbeats(t, list)
+	status, _ := h.wait(t)
+
+	if status.LastError != "Service Unavailable [503]" {
+		t.Errorf("last error is '%v'; Expected 'Service Unavailable [503]'", status.LastError)
+	}
+	if status.Failures != 1 {
+		t.Errorf("%v failures; Expected 1", status.Failures)
+	}
+
+	// The body is used as the error if it's short
+	list.respond(http.StatusForbidden, "Server is banned")
+	if status, _ := h.step(t); status.LastError != "Server is banned [403]" || status.Failures != 2 {
+		t.Errorf("last error is '%v' after %v failures; Expected 'Server is banned [403]' after 2", status.LastError, status.Failures)
+	}
+}
+
+// Failed heartbeats are retried sooner than usual, waiting twice as long each time up to a limit.
+// A heartbeat that succeeds brings back the usual interval and resets the retry delay.
+func TestHeartbeatBackoff(t *testing.T) {
+	list := newTestServerList(t)
+	list.respond(http.StatusInternalServerError, "")
+
+	h := startTestHeartbeats(t, list)
+	_, delay := h.wait(t)
+
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if i > 0 {
+			_, delay = h.step(t)
+		}
+		if delay != d {
+			t.Errorf("failure %v: retrying in %v; Expected %v", i+1, delay, d)
+		}
+	}
+
+	list.respond(http.StatusOK, "http://example.com/server")
+	status, delay := h.step(t)
+	if delay != heartbeatInterval || status.Failures != 0 || status.LastError != "" {
+		t.Errorf("after succeeding: next heartbeat in %v with %v failures and error '%v'; Expected %v, 0 and none",
+			delay, status.Failures, status.LastError, heartbeatInterval)
+	}
+
+	list.respond(http.StatusInternalServerError, "")
+	if _, delay := h.step(t); delay != heartbeatRetryMin {
+		t.Errorf("failing again: retrying in %v; Expected %v", delay, heartbeatRetryMin)
+	}
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Reads a level stored in a format other than ClassicWorld.
+// Warnings describe data in the file that could not be imported.
+type LevelImporter func(path string, name string) (l *Level, warnings []string, err error)
+
+var levelImporters = make(map[string]LevelImporter)
+
+// Registers an importer for level files with the given extension (e.g. ".lvl").
+func RegisterLevelImporter(ext string, importer LevelImporter) {
+	levelImporters[strings.ToLower(ext)] = importer
+}
+
+// Imports a level file using the importer registered for its extension.
+func ImportLevel(path string) (*Level, []string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	importer, found := levelImporters[ext]
+	if !found {
+		return nil, nil, fmt.Errorf("no importer for '%v' files", ext)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return importer(path, name)
+}
+
+// Loads a level by name from the levels folder.
+// If there is no ClassicWorld file for the level but a file in an importable format exists,
+// it is imported and saved as ClassicWorld. The original file is left untouched.
+func FindLevel(name string) (*Level, error) {
+	path := LevelPath(name)
+
+	if _, err := os.Stat(path); err == nil || len(levelImporters) == 0 {
+		return LoadLevel(path)
+	}
+
+	exts := make([]string, 0, len(levelImporters))
+	for ext := range levelImporters {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		importPath := strings.TrimSuffix(path, ".cw") + ext
+		if _, err := os.Stat(importPath); err != nil {
+			continue
+		}
+
+		l, warnings, err := ImportLevel(importPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not import '%v': %v", importPath, err)
+		}
+
+		for _, warning := range warnings {
+			log.Printf("[Import] %v: %v", importPath, warning)
+		}
+
+		l.Name = name
+		if err := l.Save(path); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Imported level '%v' from '%v'", name, importPath)
+		return l, nil
+	}
+
+	return LoadLevel(path)
+}
@@ -0,0 +1,328 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns the loaded level with the given name, or nil if it isn't loaded.
+func (s *Server) Level(name string) *Level {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.levels[strings.ToLower(name)]
+}
+
+// Returns every loaded level, sorted by name.
+func (s *Server) Levels() []*Level {
+	s.mu.RLock()
+	levels := make([]*Level, 0, len(s.levels))
+	for _, l := range s.levels {
+		levels = append(levels, l)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Name < levels[j].Name })
+	return levels
+}
+
+// Returns the level with the given name, loading it from the levels folder if it isn't loaded yet.
+func (s *Server) OpenLevel(name string) (*Level, error) {
+	l, loaded, err := s.loadLevel(name)
+	if loaded {
+		FireEvent(&LevelLoadEvent{Level: l})
+	}
+	return l, err
+}
+
+// Loads a level unless it's already loaded. Returns true if it was loaded by this call.
+func (s *Server) loadLevel(name string) (l *Level, loaded bool, err error) {
+	if !isValidLevelName(name) {
+		return nil, false, fmt.Errorf("invalid level name '%v'", name)
+	}
+
+	key := strings.ToLower(name)
+
+	// Only one call loads a level; Others wait for it to finish, without holding up the rest of the server
+	var done chan struct{}
+	for done == nil {
+		s.mu.Lock()
+		if l, found := s.levels[key]; found {
+			s.mu.Unlock()
+			return l, false, nil
+		}
+
+		wait, loading := s.loading[key]
+		if !loading {
+			done = make(chan struct{})
+			s.loading[key] = done
+		}
+		s.mu.Unlock()
+
+		if loading {
+			<-wait
+		}
+	}
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.loading, key)
+		s.mu.Unlock()
+
+		close(done)
+	}()
+
+	l, err = FindLevel(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	l.Name = name
+	l.emptySince = time.Now()
+	s.openHistory(l)
+	l.initPhysics(s.defaultPhysics)
+
+	s.mu.Lock()
+	s.levels[key] = l
+	s.mu.Unlock()
+
+	log.Printf("Loaded level '%v'", l.Name)
+	return l, true, nil
+}
+
+// Reserves the name of a level that doesn't exist yet, so that it can't be loaded or created by anyone
+// else while it's being created. Waits for a level with the same name that's being loaded or created.
+// Returns a function that releases the name.
+func (s *Server) reserveLevelName(name string) (release func(), err error) {
+	key := strings.ToLower(name)
+
+	var done chan struct{}
+	for done == nil {
+		s.mu.Lock()
+		if s.levels[key] != nil {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("level '%v' already exists", name)
+		}
+
+		wait, loading := s.loading[key]
+		if !loading {
+			done = make(chan struct{})
+			s.loading[key] = done
+		}
+		s.mu.Unlock()
+
+		if loading {
+			<-wait
+		}
+	}
+
+	return func() {
+		s.mu.Lock()
+		delete(s.loading, key)
+		s.mu.Unlock()
+
+		close(done)
+	}, nil
+}
+
+// Adds a new level to the server. Fails if a level with the same name is loaded.
+func (s *Server) addLevel(l *Level) error {
+	l.mu.Lock()
+	l.emptySince = time.Now()
+	l.mu.Unlock()
+
+	s.openHistory(l)
+	l.initPhysics(s.defaultPhysics)
+
+	key := strings.ToLower(l.Name)
+
+	s.mu.Lock()
+	if s.levels[key] != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("level '%v' is already loaded", l.Name)
+	}
+	s.levels[key] = l
+	s.mu.Unlock()
+
+	FireEvent(&LevelLoadEvent{Level: l})
+	return nil
+}
+
+// Opens the block history of a level that's being added, pruning it. The level keeps working without
+// a history if it can't be opened.
+func (s *Server) openHistory(l *Level) {
+	h, err := openBlockHistory(l.Name)
+	if err != nil {
+		log.Printf("Could not open the block history of level '%v': %v", l.Name, err)
+		return
+	}
+
+	l.history = h
+	s.pruneLevelHistory(l)
+}
+
+// Unloads a level, saving it first if it has changed. The main level and levels
+// with players in them can't be unloaded.
+func (s *Server) UnloadLevel(l *Level) error {
+	if l == s.mainLevel {
+		return errors.New("the main level can't be unloaded")
+	}
+
+	// Marking the level as unloaded keeps players from entering it while it's being saved
+	l.mu.Lock()
+	if len(l.players) > 0 || len(l.joining) > 0 {
+		l.mu.Unlock()
+		return fmt.Errorf("level '%v' still has players in it", l.Name)
+	}
+	l.unloaded = true
+	changed := l.changed
+	l.mu.Unlock()
+
+	if changed && !s.SaveLevel(l) {
+		l.mu.Lock()
+		l.unloaded = false
+		l.mu.Unlock()
+
+		return fmt.Errorf("level '%v' could not be saved", l.Name)
+	}
+
+	if l.history != nil {
+		if err := l.history.flush(); err != nil {
+			log.Printf("Could not write the block history of level '%v': %v", l.Name, err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.levels[strings.ToLower(l.Name)] == l {
+		delete(s.levels, strings.ToLower(l.Name))
+	}
+	s.mu.Unlock()
+
+	log.Printf("Unloaded level '%v'", l.Name)
+	return nil
+}
+
+// Moves a player into a level: despawns them from their current level, sends them the
+// new level and spawns them at its spawn point.
+// The player stays in their current level if the new one is full or not loaded.
+func (s *Server) MovePlayer(p *Player, l *Level) error {
+	old := p.Level()
+	if old == l {
+		return fmt.Errorf("already in level '%v'", l.Name)
+	}
+
+	// Keep a place in the level while it's sent, and note the block changes the copy being sent misses
+	l.mu.Lock()
+	if l.unloaded {
+		l.mu.Unlock()
+		return fmt.Errorf("level '%v' is not loaded", l.Name)
+	}
+
+	playerId, found := l.nextPlayerId()
+	if !found {
+		l.mu.Unlock()
+		return fmt.Errorf("level '%v' is full", l.Name)
+	}
+
+	join := &levelJoin{playerId: playerId}
+	l.joining[p] = join
+	l.mu.Unlock()
+
+	if old != nil {
+		// The player's client keeps entities across level changes, so remove the ones from the old level
+		for _, otherP := range old.Players() {
+			if otherP != p {
+				p.Cli.WritePacket_DespawnPlayer(otherP.PlayerId())
+			}
+		}
+
+		s.removeFromLevel(p)
+	}
+
+	// Send level
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sendCopy(map[*Player]*levelJoin{p: join})
+	delete(l.joining, p)
+
+	pos := Position{X: l.SpawnPos[0], Y: l.SpawnPos[1], Z: l.SpawnPos[2], Yaw: l.SpawnYaw, Pitch: l.SpawnPitch}
+	if !p.enterLevel(l, playerId, pos) {
+		return errors.New("disconnected")
+	}
+	l.players[playerId] = p
+
+	p.Cli.WritePacket_SpawnPlayer(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, -1, p.Username)
+
+	// Send spawn packet for this user to all other players
+	for _, otherP := range l.players {
+		if otherP == p {
+			continue // No need to send to self
+		}
+
+		otherP.Cli.WritePacket_SpawnPlayer(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, playerId, p.Username)
+
+		// Now the other way around! Send spawn packets for all existing users to this player
+		otherPos := otherP.Position()
+		p.Cli.WritePacket_SpawnPlayer(otherPos.X, otherPos.Y, otherPos.Z, otherPos.Yaw, otherPos.Pitch, otherP.PlayerId(), otherP.Username)
+	}
+
+	return nil
+}
+
+// Removes a player from their level and despawns them for everyone else in it.
+func (s *Server) removeFromLevel(p *Player) {
+	l, playerId := p.leaveLevel()
+	if l == nil {
+		return // Not in a level
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.players, playerId)
+	delete(l.joining, p) // In case the level was being sent to them again
+	if len(l.players) == 0 {
+		l.emptySince = time.Now()
+	}
+
+	for _, otherP := range l.players {
+		otherP.Cli.WritePacket_DespawnPlayer(playerId)
+	}
+}
+
+// Unloads levels that have been empty for longer than the unload delay.
+func (s *Server) unloadIdleLevels(delay time.Duration) {
+	for _, l := range s.Levels() {
+		l.mu.RLock()
+		idle := len(l.players) == 0 && time.Since(l.emptySince) >= delay
+		l.mu.RUnlock()
+
+		if l == s.mainLevel || !idle {
+			continue
+		}
+
+		if err := s.UnloadLevel(l); err != nil {
+			log.Printf("Could not unload idle level '%v': %v", l.Name, err)
+		}
+	}
+}
+
+// Level names are used as file names, so they're limited to a safe set of characters.
+func isValidLevelName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
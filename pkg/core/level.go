@@ -3,16 +3,48 @@ package core
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"log"
+	"midnight/pkg/nbt"
 	"midnight/pkg/util"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Level struct {
+	blockChanges uint64 // Blocks changed since the level was loaded; Accessed atomically, and first so that it's 64-bit aligned
+
 	Name        string
 	Size        util.Vector3i16
 	SpawnPos    []float32
+	SpawnYaw    byte
+	SpawnPitch  byte
 	BlocksTotal int32
-	Data        []byte
-	Players     map[int8]Player
+
+	UUID        [16]byte
+	TimeCreated time.Time
+
+	history *blockHistory // Set when the level is added to a server; Nil for levels without a history
+	saving  sync.Mutex    // Held while the level is being saved, so that saves from different tasks don't overlap
+
+	// Guards the fields below once the level has been added to a server.
+	// Lock order: Server.mu, then Level.mu, then Player.mu.
+	mu         sync.RWMutex
+	Data       []byte
+	Metadata   nbt.Compound // ClassicWorld metadata, including the CPE compound
+	players    map[int8]*Player
+	joining    map[*Player]*levelJoin // Players the level is being sent to, including players in it who are being sent it again
+	changed    bool                   // Set when blocks have changed since the level was last saved
+	emptySince time.Time              // When the last player left the level
+	unloaded   bool                   // Set once the level has been unloaded; Players can no longer join it
+	physics    levelPhysics
+}
+
+// Returns the path of a level's ClassicWorld file in the levels folder.
+func LevelPath(name string) string {
+	return filepath.Join("levels", name+".cw")
 }
 
 func ConstructLevel(name string, x int16, y int16, z int16) *Level {
@@ -21,67 +53,285 @@ func ConstructLevel(name string, x int16, y int16, z int16) *Level {
 	l.Size.X = x
 	l.Size.Y = y
 	l.Size.Z = z
-	l.Players = make(map[int8]Player)
+	l.players = make(map[int8]*Player)
+	l.joining = make(map[*Player]*levelJoin)
+	l.TimeCreated = time.Now()
+
+	// Random (version 4) UUID
+	rand.Read(l.UUID[:])
+	l.UUID[6] = (l.UUID[6] & 0x0F) | 0x40
+	l.UUID[8] = (l.UUID[8] & 0x3F) | 0x80
 
 	l.BlocksTotal = int32(l.Size.X) * int32(l.Size.Y) * int32(l.Size.Z)
 
 	l.SpawnPos = make([]float32, 3)
 	l.SpawnPos[0] = float32(x) / 2
-	l.SpawnPos[1] = (float32(z) / 2) + 5
-	l.SpawnPos[2] = float32(y) / 2
+	l.SpawnPos[1] = (float32(y) / 2) + 5
+	l.SpawnPos[2] = float32(z) / 2
 
 	return l
 }
 
-func (l *Level) GenerateFlat() {
-	l.Data = make([]byte, l.BlocksTotal)
+// Blocks are stored in Data by layer, then row: X changes fastest, then Z, then Y.
+
+// Returns the index of a position in Data. The position must be inside the level.
+func (l *Level) Index(x, y, z int16) int {
+	return int(x) + int(l.Size.X)*(int(z)+int(l.Size.Z)*int(y))
+}
+
+// Returns the position of an index in Data.
+func (l *Level) FromIndex(i int) (x, y, z int16) {
+	sizeX, sizeZ := int(l.Size.X), int(l.Size.Z)
+	return int16(i % sizeX), int16(i / (sizeX * sizeZ)), int16((i / sizeX) % sizeZ)
+}
+
+// Returns true if a position is inside the level.
+func (l *Level) InBounds(x, y, z int16) bool {
+	return x >= 0 && y >= 0 && z >= 0 && x < l.Size.X && y < l.Size.Y && z < l.Size.Z
+}
+
+// Returns the block at a position, or air if it's outside the level.
+func (l *Level) GetBlock(x, y, z int16) byte {
+	if !l.InBounds(x, y, z) {
+		return BlockAir
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.Data[l.Index(x, y, z)]
+}
+
+// Sets a block without sending it to anyone or recording it in the block history.
+// Returns false if the position is outside the level.
+func (l *Level) SetBlock(x, y, z int16, block byte) bool {
+	if !l.InBounds(x, y, z) {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.setBlock(x, y, z, block)
+	return true
+}
+
+// Changes a block and sends the change to the players in the level. The change is recorded in
+// the level's block history under changedBy, unless changedBy is empty.
+// Positions outside the level are ignored.
+func (l *Level) ChangeBlock(block byte, pos util.Vector3i16, changedBy string) {
+	if !l.InBounds(pos.X, pos.Y, pos.Z) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old := l.setBlock(pos.X, pos.Y, pos.Z, block)
+	if changedBy != "" && l.history != nil && old != block {
+		l.history.record(BlockChange{X: pos.X, Y: pos.Y, Z: pos.Z, Old: old, New: block, Player: changedBy, Time: time.Now()})
+	}
+	l.blockChanged(pos.X, pos.Y, pos.Z, old)
+	l.sendBlock(block, pos.X, pos.Y, pos.Z)
+}
+
+// Times a level is compressed again from a new copy for a player when too many blocks changed to queue
+// while it was compressed. After that, every change is queued, so that a level that keeps changing can't
+// keep the player waiting.
+const maxLevelResends = 3
+
+// A player the level is being sent to, with the entity ID kept for them.
+type levelJoin struct {
+	playerId int8
+	changes  []queuedBlock // Block changes made since the copy of the level being sent was taken
+	resend   bool          // Set if there were too many changes to queue; The level is sent again instead
+	final    bool          // Set on the last try, when changes are queued however many there are
+}
+
+type queuedBlock struct {
+	pos   util.Vector3i16
+	block byte
+}
+
+// Sends a block change to the players in the level, and queues it for the players the level is
+// being sent to, including players in it who are being sent it again. The caller must hold l.mu for writing.
+func (l *Level) sendBlock(block byte, x, y, z int16) {
+	for _, p := range l.players {
+		if _, resending := l.joining[p]; !resending {
+			p.Cli.WritePacket_SetBlock(block, x, y, z)
+		}
+	}
+
+	for _, join := range l.joining {
+		join.queue(block, util.Vector3i16{X: x, Y: y, Z: z})
+	}
+}
+
+// Queues a block change to send once the level has been sent. The caller must hold l.mu for writing.
+func (join *levelJoin) queue(block byte, pos util.Vector3i16) {
+	if join.resend {
+		return
+	}
+	if len(join.changes) >= maxBlockUpdates && !join.final {
+		join.resend, join.changes = true, nil
+		return
+	}
+
+	join.changes = append(join.changes, queuedBlock{pos, block})
+}
+
+// Sends a copy of the level to players registered in l.joining, followed by the block changes made
+// since it was taken. The copy is compressed once for each MaxBlockId without holding l.mu, so that
+// physics and block changes don't wait for it. Players whose entry in l.joining has been replaced or
+// removed meanwhile are skipped. The caller must hold l.mu for writing, which is held again on return.
+func (l *Level) sendCopy(joins map[*Player]*levelJoin) {
+	for tries := 0; len(joins) > 0; tries++ {
+		for _, join := range joins {
+			join.resend, join.changes = false, nil
+			join.final = tries == maxLevelResends
+		}
+
+		start := time.Now()
+		data := l.snapshot()
+		l.mu.Unlock()
+
+		compressed := make(map[byte][]byte)
+		for p := range joins {
+			maxBlockId := p.Cli.MaxBlockId()
+			if _, found := compressed[maxBlockId]; found {
+				continue
+			}
 
-	sizeX, sizeY, sizeZ := int(l.Size.X), int(l.Size.Y), int(l.Size.Z)
+			gz, err := gzipBlocks(data, maxBlockId)
+			if err != nil {
+				log.Printf("Could not compress level '%v': %v", l.Name, err)
+			}
+			compressed[maxBlockId] = gz
+		}
 
-	for x := 0; x < sizeX; x++ {
-		for z := 0; z < sizeZ; z++ {
-			for y := 0; y < sizeY; y++ {
-				var b byte
+		l.mu.Lock()
 
-				if y > sizeY/2 {
-					b = 0
-				} else {
-					b = 1
-				}
+		retry := make(map[*Player]*levelJoin)
+		for p, join := range joins {
+			if l.joining[p] != join {
+				continue
+			}
+			if join.resend {
+				retry[p] = join
+				continue
+			}
 
-				//l.Data[x+sizeX*(z+sizeZ*y)] = b
-				l.Data[x+sizeX*(z+sizeZ*y)] = b
+			gz := compressed[p.Cli.MaxBlockId()]
+			if gz == nil {
+				continue
 			}
+
+			p.Cli.WritePacketUtil_SendGzippedLevel(l.Size, gz)
+			observeLevelSend(start, len(gz))
+
+			p.Cli.writeQueuedBlocks(join.changes)
+			join.changes = nil
 		}
+		joins = retry
+	}
+}
+
+// Returns a copy of the level's blocks, for sending without holding l.mu. The caller must hold l.mu.
+func (l *Level) snapshot() []byte {
+	data := make([]byte, len(l.Data))
+	copy(data, l.Data)
+	return data
+}
+
+// Returns the block at a position inside the level. The caller must hold l.mu.
+func (l *Level) block(x, y, z int16) byte {
+	return l.Data[l.Index(x, y, z)]
+}
+
+// Sets the block at a position inside the level without sending it to anyone, returning the
+// block it replaced. The caller must hold l.mu for writing.
+func (l *Level) setBlock(x, y, z int16, block byte) (old byte) {
+	i := l.Index(x, y, z)
+
+	old = l.Data[i]
+	l.Data[i] = block
+	l.changed = true
+	atomic.AddUint64(&l.blockChanges, 1)
+
+	return old
+}
+
+// Returns true if blocks have changed since the level was last saved.
+func (l *Level) HasChanged() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.changed
+}
+
+// Returns the players in the level.
+func (l *Level) Players() []*Player {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	players := make([]*Player, 0, len(l.players))
+	for _, p := range l.players {
+		players = append(players, p)
 	}
+
+	return players
+}
+
+func (l *Level) PlayerCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.players)
 }
 
-func (l *Level) ChangeBlock(block byte, pos util.Vector3i16) {
-	sizeX, sizeZ := int(l.Size.X), int(l.Size.Y)
-	x, y, z := int(pos.X), int(pos.Y), int(pos.Z)
-	l.Data[x+sizeX*(z+sizeZ*y)] = block
+// Returns the lowest entity ID not used by a player in the level. The caller must hold l.mu.
+// IDs 0-126 are available; -1 (255) refers to the receiving player themselves.
+func (l *Level) nextPlayerId() (playerId int8, found bool) {
+	used := make(map[int8]bool, len(l.joining))
+	for _, join := range l.joining {
+		used[join.playerId] = true
+	}
 
-	for i := 0; i < len(l.Players); i++ {
-		for _, p := range l.Players {
-			p.Cli.WritePacket_SetBlock(block, pos.X, pos.Y, pos.Z)
+	for i := int8(0); i < 127; i++ {
+		if _, inLevel := l.players[i]; !inLevel && !used[i] {
+			return i, true
 		}
 	}
+	return -1, false
 }
 
 // Level Utils
 
-func (l Level) Gzip() (data []byte, err error) {
+// Compresses the level for sending to a client, replacing blocks above maxBlockId with their fallbacks.
+// The caller must hold l.mu.
+func (l *Level) Gzip(maxBlockId byte) (data []byte, err error) {
+	return gzipBlocks(l.Data, maxBlockId)
+}
+
+// Compresses a level's blocks for sending to a client, prefixed with their count.
+func gzipBlocks(blocks []byte, maxBlockId byte) (data []byte, err error) {
 	var buf bytes.Buffer
 	gz := gzip.NewWriter(&buf)
 
-	blocks := []byte{
-		byte(l.BlocksTotal >> 24),
-		byte(l.BlocksTotal >> 16),
-		byte(l.BlocksTotal >> 8),
-		byte(l.BlocksTotal & 0xFF),
+	total := len(blocks)
+	header := []byte{
+		byte(total >> 24),
+		byte(total >> 16),
+		byte(total >> 8),
+		byte(total & 0xFF),
+	}
+
+	converted := make([]byte, len(blocks))
+	for i, b := range blocks {
+		converted[i] = FallbackBlock(b, maxBlockId)
 	}
 
-	_, err = gz.Write(append(blocks, l.Data...))
+	_, err = gz.Write(append(header, converted...))
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"fmt"
+	"midnight/pkg/util"
+	"testing"
+)
+
+// A level that's longer along Z than along Y, and along Y than along X, so that mixed up axes show up
+func nonCubicLevel() *Level {
+	l := ConstructLevel("test", 64, 128, 512)
+	l.Data = make([]byte, l.BlocksTotal)
+	return l
+}
+
+// Returns the eight corners of a level.
+func levelCorners(l *Level) []util.Vector3i16 {
+	var corners []util.Vector3i16
+	for _, x := range []int16{0, l.Size.X - 1} {
+		for _, y := range []int16{0, l.Size.Y - 1} {
+			for _, z := range []int16{0, l.Size.Z - 1} {
+				corners = append(corners, util.Vector3i16{X: x, Y: y, Z: z})
+			}
+		}
+	}
+	return corners
+}
+
+func TestIndex(t *testing.T) {
+	l := nonCubicLevel()
+
+	positions := append(levelCorners(l), util.Vector3i16{X: 1, Y: 0, Z: 0}, util.Vector3i16{X: 0, Y: 1, Z: 0},
+		util.Vector3i16{X: 0, Y: 0, Z: 1}, util.Vector3i16{X: 31, Y: 100, Z: 300})
+
+	indexes := make(map[int]util.Vector3i16)
+	for _, pos := range positions {
+		i := l.Index(pos.X, pos.Y, pos.Z)
+		if i < 0 || i >= int(l.BlocksTotal) {
+			t.Errorf("%v: index %v is outside the level's %v blocks", pos, i, l.BlocksTotal)
+			continue
+		}
+		if other, found := indexes[i]; found {
+			t.Errorf("%v and %v have the same index %v", pos, other, i)
+		}
+		indexes[i] = pos
+
+		if x, y, z := l.FromIndex(i); x != pos.X || y != pos.Y || z != pos.Z {
+			t.Errorf("%v: index %v is position (%v, %v, %v)", pos, i, x, y, z)
+		}
+	}
+
+	// X changes fastest, then Z, then Y
+	if i := l.Index(l.Size.X-1, l.Size.Y-1, l.Size.Z-1); i != int(l.BlocksTotal)-1 {
+		t.Errorf("the last corner has index %v; Expected %v", i, l.BlocksTotal-1)
+	}
+	if i := l.Index(0, 0, 1); i != int(l.Size.X) {
+		t.Errorf("(0, 0, 1) has index %v; Expected %v", i, l.Size.X)
+	}
+	if i := l.Index(0, 1, 0); i != int(l.Size.X)*int(l.Size.Z) {
+		t.Errorf("(0, 1, 0) has index %v; Expected %v", i, int(l.Size.X)*int(l.Size.Z))
+	}
+}
+
+func TestInBounds(t *testing.T) {
+	l := nonCubicLevel()
+
+	for _, pos := range levelCorners(l) {
+		if !l.InBounds(pos.X, pos.Y, pos.Z) {
+			t.Errorf("%v should be inside the level", pos)
+		}
+	}
+
+	outside := []util.Vector3i16{
+		{X: -1, Y: 0, Z: 0}, {X: 0, Y: -1, Z: 0}, {X: 0, Y: 0, Z: -1},
+		{X: l.Size.X, Y: 0, Z: 0}, {X: 0, Y: l.Size.Y, Z: 0}, {X: 0, Y: 0, Z: l.Size.Z},
+		{X: l.Size.X - 1, Y: l.Size.Y - 1, Z: l.Size.Z}, {X: -32768, Y: 32767, Z: 0},
+	}
+	for _, pos := range outside {
+		if l.InBounds(pos.X, pos.Y, pos.Z) {
+			t.Errorf("%v should be outside the level", pos)
+		}
+		if l.SetBlock(pos.X, pos.Y, pos.Z, BlockStone) {
+			t.Errorf("%v: a block outside the level was set", pos)
+		}
+		if b := l.GetBlock(pos.X, pos.Y, pos.Z); b != BlockAir {
+			t.Errorf("%v: the block outside the level is %v; Expected air", pos, b)
+		}
+	}
+}
+
+func TestGetSetBlock(t *testing.T) {
+	l := nonCubicLevel()
+
+	for i, pos := range levelCorners(l) {
+		block := byte(i + 1)
+		if !l.SetBlock(pos.X, pos.Y, pos.Z, block) {
+			t.Errorf("%v: could not set block", pos)
+			continue
+		}
+		if b := l.GetBlock(pos.X, pos.Y, pos.Z); b != block {
+			t.Errorf("%v: the block is %v; Expected %v", pos, b, block)
+		}
+		if b := l.Data[l.Index(pos.X, pos.Y, pos.Z)]; b != block {
+			t.Errorf("%v: Data holds %v; Expected %v", pos, b, block)
+		}
+	}
+
+	changed := 0
+	for _, b := range l.Data {
+		if b != BlockAir {
+			changed++
+		}
+	}
+	if changed != 8 {
+		t.Errorf("%v blocks were changed; Expected 8", changed)
+	}
+}
+
+// Every player in the level is sent a changed block once, and players in other levels aren't sent it.
+func TestChangeBlockSendsOnce(t *testing.T) {
+	s := newTestServer(t)
+
+	var clients []*testClient
+	for i := 0; i < 5; i++ {
+		c := joinTestClient(s, fmt.Sprintf("player%v", i), fmt.Sprintf("127.0.0.%v:50000", i+1))
+		if _, ok := c.waitSpawn(t); !ok {
+			return
+		}
+		clients = append(clients, c)
+	}
+
+	elsewhere := clients[0]
+	elsewhere.chat(t, "/goto other")
+	if _, ok := elsewhere.waitSpawn(t); !ok {
+		return
+	}
+
+	s.mainLevel.ChangeBlock(BlockGold, util.Vector3i16{X: 1, Y: 2, Z: 3}, "Console")
+
+	// Announcements are sent after the block change that came before them
+	s.SendAnnouncement("changed")
+	for i, c := range clients {
+		if !c.waitMessages(t, "changed", 1) {
+			continue
+		}
+
+		c.mu.Lock()
+		expected := 1
+		if c == elsewhere {
+			expected = 0
+		}
+		if c.setBlocks != expected {
+			t.Errorf("player%v was sent %v block changes; Expected %v", i, c.setBlocks, expected)
+		}
+		c.mu.Unlock()
+	}
+
+	for _, c := range clients {
+		c.conn.Close()
+		<-c.done
+	}
+}
+
+// Changes made while a level is sent are queued until there are too many, except on the last try.
+func TestLevelJoinQueue(t *testing.T) {
+	for _, final := range []bool{false, true} {
+		join := &levelJoin{final: final}
+		for i := 0; i < 2*maxBlockUpdates; i++ {
+			join.queue(BlockStone, util.Vector3i16{X: int16(i)})
+		}
+
+		if final && (join.resend || len(join.changes) != 2*maxBlockUpdates) {
+			t.Errorf("last try: %v changes queued with resend %v; Expected %v without resend", len(join.changes), join.resend, 2*maxBlockUpdates)
+		}
+		if !final && (!join.resend || len(join.changes) != 0) {
+			t.Errorf("%v changes queued with resend %v; Expected none with resend", len(join.changes), join.resend)
+		}
+	}
+}
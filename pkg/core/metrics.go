@@ -0,0 +1,96 @@
+package core
+
+import (
+	"io"
+	"midnight/pkg/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a connection was rejected, used in midnight_connections_rejected_total
+const (
+	RejectBadProtocol       = "bad_protocol"
+	RejectBadUsername       = "bad_username"
+	RejectBadMppass         = "bad_mppass"
+	RejectMissingExtensions = "missing_extensions"
+	RejectBanned            = "banned"
+	RejectNotWhitelisted    = "not_whitelisted"
+	RejectDenied            = "denied" // By a PlayerPreLogin event handler
+)
+
+var (
+	metricConnectionsAccepted = metrics.NewCounter("midnight_connections_accepted_total", "Connections that joined the server.")
+	metricConnectionsRejected = metrics.NewCounterVec("midnight_connections_rejected_total", "Connections turned away before joining, by reason.", "reason")
+
+	metricPacketsIn  = metrics.NewByteCounter("midnight_packets_received_total", "Packets received from clients, by packet ID.", "id")
+	metricPacketsOut = metrics.NewByteCounter("midnight_packets_sent_total", "Packets queued for clients, by packet ID.", "id")
+	metricBytesIn    = metrics.NewCounter("midnight_received_bytes_total", "Bytes received from clients.")
+	metricBytesOut   = metrics.NewCounter("midnight_sent_bytes_total", "Bytes sent to clients.")
+
+	metricLevelSendDuration = metrics.NewHistogram("midnight_level_send_duration_seconds", "Time spent compressing and queueing a level for a client.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+	metricLevelSendSize = metrics.NewHistogram("midnight_level_send_bytes", "Compressed size of levels sent to clients.",
+		[]float64{16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20})
+
+	metricTickDuration = metrics.NewHistogram("midnight_tick_duration_seconds", "Time spent running tasks each tick.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1})
+
+	metricHeartbeats = metrics.NewCounterVec("midnight_heartbeats_total", "Heartbeats sent to server lists, by result.", "result")
+)
+
+// Counts a connection that was turned away before joining. Exported for use in main.go
+func CountRejectedConnection(reason string) {
+	metricConnectionsRejected.With(reason).Inc()
+}
+
+// Registers the metrics that are read from the server when they're scraped.
+func (s *Server) registerMetrics() {
+	metrics.NewGaugeFunc("midnight_players", "Players online.", func() float64 {
+		return float64(s.PlayerCount())
+	})
+
+	metrics.NewGaugeFunc("midnight_tps", "Average ticks per second.", func() float64 {
+		return s.sch.TPS()
+	})
+
+	metrics.NewGaugeFunc("midnight_tick_lag_seconds", "How much longer than scheduled the average tick takes to come around.", func() float64 {
+		if lag := s.sch.tickInterval() - TickInterval; lag > 0 {
+			return lag.Seconds()
+		}
+		return 0
+	})
+
+	metrics.NewCollector("midnight_level_block_changes_total", "Blocks changed in each loaded level, including by physics.", "counter", []string{"level"},
+		func(emit func(value float64, labelValues ...string)) {
+			for _, l := range s.Levels() {
+				emit(float64(atomic.LoadUint64(&l.blockChanges)), l.Name)
+			}
+		})
+}
+
+// Counts the bytes read from a connection.
+type countingReader struct {
+	r io.Reader
+}
+
+func (cr countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	metricBytesIn.Add(uint64(n))
+	return n, err
+}
+
+// Counts the bytes written to a connection.
+type countingWriter struct {
+	w io.Writer
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	metricBytesOut.Add(uint64(n))
+	return n, err
+}
+
+func observeLevelSend(start time.Time, size int) {
+	metricLevelSendDuration.ObserveDuration(time.Since(start))
+	metricLevelSendSize.Observe(float64(size))
+}
@@ -0,0 +1,528 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BansFile      = "bans.json"
+	WhitelistFile = "whitelist.json"
+)
+
+type Ban struct {
+	Target  string     `json:"target"` // Lowercase username for name bans; IP address or CIDR range for IP bans
+	Reason  string     `json:"reason"`
+	Issuer  string     `json:"issuer"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"` // Nil for permanent bans
+
+	ipNet *net.IPNet // Range covered by an IP ban
+}
+
+func (b *Ban) Expired() bool {
+	return b.Expires != nil && time.Now().After(*b.Expires)
+}
+
+// Returns the message shown to a banned player, e.g. "Banned: griefing (2d 3h left)".
+func (b *Ban) DisconnectMessage() string {
+	msg := "Banned"
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+
+	if b.Expires != nil {
+		msg += " (" + formatDuration(time.Until(*b.Expires)) + " left)"
+	}
+
+	return msg
+}
+
+type banList struct {
+	mu    sync.RWMutex
+	Names map[string]*Ban `json:"names"` // Name bans by lowercase username
+	IPs   []*Ban          `json:"ips"`
+}
+
+type whitelist struct {
+	mu      sync.RWMutex
+	Enabled bool            `json:"enabled"`
+	Players map[string]bool `json:"-"` // Lowercase usernames
+}
+
+// Loads the ban list and the whitelist. Missing files are treated as empty.
+func loadModeration() (*banList, *whitelist, error) {
+	bans := &banList{Names: make(map[string]*Ban)}
+
+	if data, err := ioutil.ReadFile(BansFile); err == nil {
+		if err := json.Unmarshal(data, bans); err != nil {
+			return nil, nil, fmt.Errorf("%v: %v", BansFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	if bans.Names == nil {
+		bans.Names = make(map[string]*Ban)
+	}
+
+	// Check for invalid values
+	ips := bans.IPs[:0]
+	for _, b := range bans.IPs {
+		if b == nil {
+			continue
+		}
+
+		ipNet, err := parseIPRange(b.Target)
+		if err != nil {
+			log.Printf("[%v] Invalid IP ban target [%v]; Skipping ban", BansFile, b.Target)
+			continue
+		}
+
+		b.ipNet = ipNet
+		ips = append(ips, b)
+	}
+	bans.IPs = ips
+
+	wl := &whitelist{Players: make(map[string]bool)}
+
+	if data, err := ioutil.ReadFile(WhitelistFile); err == nil {
+		var file struct {
+			Enabled bool     `json:"enabled"`
+			Players []string `json:"players"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, nil, fmt.Errorf("%v: %v", WhitelistFile, err)
+		}
+
+		wl.Enabled = file.Enabled
+		for _, name := range file.Players {
+			wl.Players[strings.ToLower(name)] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	return bans, wl, nil
+}
+
+// Saves the ban list, leaving out bans that have expired. The caller must hold bl.mu.
+func (bl *banList) save() error {
+	for name, b := range bl.Names {
+		if b.Expired() {
+			delete(bl.Names, name)
+		}
+	}
+
+	ips := bl.IPs[:0]
+	for _, b := range bl.IPs {
+		if !b.Expired() {
+			ips = append(ips, b)
+		}
+	}
+	bl.IPs = ips
+
+	data, err := marshalIndent(bl)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(BansFile, data)
+}
+
+// Saves the whitelist. The caller must hold wl.mu.
+func (wl *whitelist) save() error {
+	file := struct {
+		Enabled bool     `json:"enabled"`
+		Players []string `json:"players"`
+	}{Enabled: wl.Enabled, Players: []string{}}
+
+	for name := range wl.Players {
+		file.Players = append(file.Players, name)
+	}
+	sort.Strings(file.Players)
+
+	data, err := marshalIndent(file)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(WhitelistFile, data)
+}
+
+// Parses an IP address or a CIDR range. A single address is a range of one address.
+func parseIPRange(target string) (*net.IPNet, error) {
+	if strings.Contains(target, "/") {
+		_, ipNet, err := net.ParseCIDR(target)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address '%v'", target)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Returns the IP address of a "host:port" remote address.
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// Checks whether a player may join, firing PlayerPreLoginEvent. If they may not, the returned message says why.
+// Exported for use in main.go
+func (s *Server) CheckLogin(username string, addr string) (allowed bool, disconnectMsg string) {
+	rejectReason, disconnectMsg := s.checkLogin(username, addr)
+
+	e := &PlayerPreLoginEvent{Username: username, Addr: addr, Reason: disconnectMsg}
+	e.SetCancelled(rejectReason != "")
+	if FireEvent(e) {
+		if e.Reason == "" {
+			e.Reason = "You can't join this server"
+		}
+		if rejectReason == "" {
+			rejectReason = RejectDenied
+		}
+
+		CountRejectedConnection(rejectReason)
+		return false, e.Reason
+	}
+
+	return true, ""
+}
+
+// Returns why a player may not join, as one of the Reject constants, and the message that tells them.
+// Returns "" if they may join.
+func (s *Server) checkLogin(username string, addr string) (rejectReason string, disconnectMsg string) {
+	if b := s.NameBan(username); b != nil {
+		return RejectBanned, b.DisconnectMessage()
+	}
+
+	if ip := remoteIP(addr); ip != nil {
+		if b := s.IPBan(ip); b != nil {
+			return RejectBanned, b.DisconnectMessage()
+		}
+	}
+
+	s.whitelist.mu.RLock()
+	listed := !s.whitelist.Enabled || s.whitelist.Players[strings.ToLower(username)]
+	s.whitelist.mu.RUnlock()
+
+	if !listed && !s.PlayerRank(username).HasPermission("whitelist.bypass") {
+		return RejectNotWhitelisted, "You are not whitelisted on this server"
+	}
+
+	return "", ""
+}
+
+// Returns the ban on a username, or nil if it isn't banned.
+func (s *Server) NameBan(username string) *Ban {
+	s.bans.mu.RLock()
+	defer s.bans.mu.RUnlock()
+
+	if b := s.bans.Names[strings.ToLower(username)]; b != nil && !b.Expired() {
+		return b
+	}
+	return nil
+}
+
+// Returns a ban covering an IP address, or nil if it isn't banned.
+func (s *Server) IPBan(ip net.IP) *Ban {
+	s.bans.mu.RLock()
+	defer s.bans.mu.RUnlock()
+
+	for _, b := range s.bans.IPs {
+		if !b.Expired() && b.ipNet.Contains(ip) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Bans a username, replacing any existing ban on it. A duration of 0 bans permanently.
+// If the player is online, they're kicked.
+func (s *Server) BanName(username, reason, issuer string, duration time.Duration) (*Ban, error) {
+	b := newBan(strings.ToLower(username), reason, issuer, duration)
+
+	s.bans.mu.Lock()
+	old := s.bans.Names[b.Target]
+	s.bans.Names[b.Target] = b
+
+	err := s.bans.save()
+	if err != nil {
+		if old != nil {
+			s.bans.Names[b.Target] = old
+		} else {
+			delete(s.bans.Names, b.Target)
+		}
+	}
+	s.bans.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Could not save %v: %v", BansFile, err)
+		return nil, fmt.Errorf("could not save the ban")
+	}
+
+	if p := s.Player(username); p != nil {
+		s.disconnectPlayer(p, b.DisconnectMessage())
+	}
+
+	return b, nil
+}
+
+// Bans an IP address or CIDR range. A duration of 0 bans permanently.
+// Players connected from a banned address are kicked.
+func (s *Server) BanIP(target, reason, issuer string, duration time.Duration) (*Ban, error) {
+	ipNet, err := parseIPRange(target)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBan(ipNet.String(), reason, issuer, duration)
+	b.ipNet = ipNet
+
+	s.bans.mu.Lock()
+	old := s.bans.IPs
+	s.bans.IPs = append(removeIPBan(append([]*Ban(nil), old...), b.Target), b)
+
+	err = s.bans.save()
+	if err != nil {
+		s.bans.IPs = old
+	}
+	s.bans.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Could not save %v: %v", BansFile, err)
+		return nil, fmt.Errorf("could not save the ban")
+	}
+
+	for _, p := range s.Players() {
+		if ip := remoteIP(p.IP); ip != nil && ipNet.Contains(ip) {
+			s.disconnectPlayer(p, b.DisconnectMessage())
+		}
+	}
+
+	return b, nil
+}
+
+// Removes the ban on a username, IP address or CIDR range. Returns false if there was none.
+func (s *Server) Unban(target string) (bool, error) {
+	s.bans.mu.Lock()
+	defer s.bans.mu.Unlock()
+
+	name := strings.ToLower(target)
+	oldName, nameBanned := s.bans.Names[name]
+	oldIPs := s.bans.IPs
+
+	delete(s.bans.Names, name)
+	if ipNet, err := parseIPRange(target); err == nil {
+		s.bans.IPs = removeIPBan(append([]*Ban(nil), oldIPs...), ipNet.String())
+	}
+
+	if !nameBanned && len(s.bans.IPs) == len(oldIPs) {
+		return false, nil
+	}
+
+	if err := s.bans.save(); err != nil {
+		// Keep the saved and the used bans the same
+		if nameBanned {
+			s.bans.Names[name] = oldName
+		}
+		s.bans.IPs = oldIPs
+
+		log.Printf("Could not save %v: %v", BansFile, err)
+		return false, fmt.Errorf("could not save the ban list")
+	}
+
+	return true, nil
+}
+
+func removeIPBan(bans []*Ban, target string) []*Ban {
+	kept := bans[:0]
+	for _, b := range bans {
+		if b.Target != target {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+func newBan(target, reason, issuer string, duration time.Duration) *Ban {
+	b := &Ban{Target: target, Reason: reason, Issuer: issuer, Created: time.Now()}
+
+	if duration > 0 {
+		expires := b.Created.Add(duration)
+		b.Expires = &expires
+	}
+
+	return b
+}
+
+// Disconnects a player, telling them and everyone else why.
+func (s *Server) Kick(p *Player, reason, issuer string) {
+	msg := "Kicked"
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	s.disconnectPlayer(p, msg)
+	log.Printf("%v kicked %v: %v", issuer, p.Username, reason)
+}
+
+// Turns the whitelist on or off.
+func (s *Server) SetWhitelistEnabled(enabled bool) error {
+	s.whitelist.mu.Lock()
+	defer s.whitelist.mu.Unlock()
+
+	old := s.whitelist.Enabled
+	s.whitelist.Enabled = enabled
+
+	if err := s.whitelist.save(); err != nil {
+		s.whitelist.Enabled = old
+
+		log.Printf("Could not save %v: %v", WhitelistFile, err)
+		return fmt.Errorf("could not save the whitelist")
+	}
+
+	return nil
+}
+
+// Adds a player to the whitelist, or removes them from it.
+func (s *Server) SetWhitelisted(username string, listed bool) error {
+	s.whitelist.mu.Lock()
+	defer s.whitelist.mu.Unlock()
+
+	name := strings.ToLower(username)
+	old := s.whitelist.Players[name]
+
+	if listed {
+		s.whitelist.Players[name] = true
+	} else {
+		delete(s.whitelist.Players, name)
+	}
+
+	if err := s.whitelist.save(); err != nil {
+		if old {
+			s.whitelist.Players[name] = true
+		} else {
+			delete(s.whitelist.Players, name)
+		}
+
+		log.Printf("Could not save %v: %v", WhitelistFile, err)
+		return fmt.Errorf("could not save the whitelist")
+	}
+
+	return nil
+}
+
+// Returns whether the whitelist is on, and the whitelisted players.
+func (s *Server) Whitelist() (enabled bool, players []string) {
+	s.whitelist.mu.RLock()
+	defer s.whitelist.mu.RUnlock()
+
+	for name := range s.whitelist.Players {
+		players = append(players, name)
+	}
+	sort.Strings(players)
+
+	return s.whitelist.Enabled, players
+}
+
+// Longest duration ParseDuration accepts
+const maxDuration = 100 * 365 * 24 * time.Hour
+
+// Parses durations like "30m", "12h" or "1w2d". Units are w, d, h, m and s.
+func ParseDuration(str string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'w': 7 * 24 * time.Hour,
+		'd': 24 * time.Hour,
+		'h': time.Hour,
+		'm': time.Minute,
+		's': time.Second,
+	}
+
+	var total time.Duration
+	number := ""
+
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+
+		unit, found := units[c]
+		if !found || number == "" {
+			return 0, fmt.Errorf("invalid duration '%v'; Use e.g. 30m, 12h or 1w2d", str)
+		}
+
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%v'", str)
+		}
+
+		if time.Duration(n) > (maxDuration-total)/unit {
+			return 0, fmt.Errorf("duration '%v' is longer than %v years", str, int(maxDuration/(365*24*time.Hour)))
+		}
+
+		total += time.Duration(n) * unit
+		number = ""
+	}
+
+	if number != "" || total <= 0 {
+		return 0, fmt.Errorf("invalid duration '%v'; Use e.g. 30m, 12h or 1w2d", str)
+	}
+
+	return total, nil
+}
+
+// Formats a duration with its two largest units, e.g. "2d 3h" or "5m 10s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+
+	parts := []struct {
+		unit   time.Duration
+		suffix string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+
+	var out []string
+	for _, part := range parts {
+		if n := d / part.unit; n > 0 || len(out) > 0 {
+			if n > 0 {
+				out = append(out, strconv.FormatInt(int64(n), 10)+part.suffix)
+			}
+			d -= n * part.unit
+
+			if len(out) == 2 || len(out) > 0 && n == 0 {
+				break
+			}
+		}
+	}
+
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"midnight/pkg/protocol"
+	"midnight/pkg/util"
+	"strings"
+)
+
+// Handles a packet received from a player who has joined. Returning an error kicks the player,
+// with the error as the reason.
+type packetHandler func(s *Server, p *Player, packet protocol.Packet) error
+
+// Handlers for packets received from joined players, by packet ID. Other packets are ignored.
+var packetHandlers = map[byte]packetHandler{
+	protocol.IdSetBlockClient:      handleSetBlock,
+	protocol.IdPositionOrientation: handlePositionOrientation,
+	protocol.IdMessage:             handleMessage,
+}
+
+func handleSetBlock(s *Server, p *Player, packet protocol.Packet) error {
+	pk, ok := packet.(*protocol.SetBlockClient)
+	if !ok {
+		return fmt.Errorf("unexpected packet %T", packet)
+	}
+
+	l := p.Level()
+	if l == nil {
+		return nil // Between levels
+	}
+
+	pos := util.Vector3i16{X: pk.X, Y: pk.Y, Z: pk.Z}
+	if !l.InBounds(pos.X, pos.Y, pos.Z) {
+		return nil // Nothing there to change back
+	}
+	if pk.Mode != 0x00 && pk.Mode != 0x01 {
+		return fmt.Errorf("invalid set block mode %v", pk.Mode)
+	}
+
+	current := l.GetBlock(pos.X, pos.Y, pos.Z)
+
+	if p.aboutMode {
+		p.aboutMode = false
+
+		// The client has already changed the block, so change it back
+		p.Cli.WritePacket_SetBlock(current, pos.X, pos.Y, pos.Z)
+
+		showBlockHistory(p, l, pos)
+		return nil
+	}
+
+	block := BlockAir
+	if pk.Mode == 0x01 { // Create
+		block = pk.BlockType
+	}
+
+	if msg := checkBlockChange(p, pos, current, block); msg != "" {
+		p.Cli.WritePacket_SetBlock(current, pos.X, pos.Y, pos.Z)
+		p.SendMessage("&c" + msg)
+		return nil
+	}
+
+	var cancelled bool
+	if block == BlockAir {
+		cancelled = FireEvent(&BlockBreakEvent{Player: p, Level: l, X: pos.X, Y: pos.Y, Z: pos.Z, Block: current})
+	} else {
+		e := &BlockPlaceEvent{Player: p, Level: l, X: pos.X, Y: pos.Y, Z: pos.Z, Block: block, Old: current}
+		cancelled = FireEvent(e)
+		block = e.Block
+	}
+
+	if cancelled {
+		p.Cli.WritePacket_SetBlock(current, pos.X, pos.Y, pos.Z)
+		return nil
+	}
+
+	l.ChangeBlock(block, pos, p.Username)
+	return nil
+}
+
+// Blocks that can only be placed or broken with a permission
+var restrictedBlocks = map[byte]string{
+	BlockBedrock:    "build.bedrock",
+	BlockWater:      "build.water",
+	BlockStillWater: "build.water",
+	BlockLava:       "build.lava",
+	BlockStillLava:  "build.lava",
+}
+
+// How far from a block a player can be to change it. Clients reach 5 blocks; The rest
+// allows for the position the server knows lagging behind.
+const maxReachDistance = 7
+
+// Checks whether a player may replace the current block at a position with another.
+// Returns the reason if they may not, or "" if they may.
+func checkBlockChange(p *Player, pos util.Vector3i16, current byte, block byte) string {
+	if !p.HasPermission("build") {
+		return "You don't have permission to build."
+	}
+
+	if block > p.Cli.MaxBlockId() {
+		return "Unknown block."
+	}
+
+	if perm, restricted := restrictedBlocks[block]; restricted && !p.HasPermission(perm) {
+		return "You can't place " + BlockName(block) + "."
+	}
+	if perm, restricted := restrictedBlocks[current]; restricted && !p.HasPermission(perm) {
+		return "You can't break " + BlockName(current) + "."
+	}
+
+	// Distance from the player to the center of the block
+	playerPos := p.Position()
+	dx := float64(playerPos.X) - (float64(pos.X) + 0.5)
+	dy := float64(playerPos.Y) - (float64(pos.Y) + 0.5)
+	dz := float64(playerPos.Z) - (float64(pos.Z) + 0.5)
+	if dx*dx+dy*dy+dz*dz > maxReachDistance*maxReachDistance {
+		return "That block is too far away."
+	}
+
+	return ""
+}
+
+func handlePositionOrientation(s *Server, p *Player, packet protocol.Packet) error {
+	pk, ok := packet.(*protocol.PositionOrientation)
+	if !ok {
+		return fmt.Errorf("unexpected packet %T", packet)
+	}
+
+	l := p.Level()
+	if l == nil {
+		return nil // Between levels
+	}
+
+	pos := Position{
+		X:     float32(pk.X) / 32,
+		Y:     float32(pk.Y) / 32,
+		Z:     float32(pk.Z) / 32,
+		Yaw:   pk.Yaw,
+		Pitch: pk.Pitch,
+	}
+	from := p.Position()
+	if from == pos {
+		return nil
+	}
+
+	e := &PlayerMoveEvent{Player: p, From: from, To: pos}
+	if FireEvent(e) {
+		p.Cli.WritePacket_PlayerTeleport(from.X, from.Y, from.Z, from.Yaw, from.Pitch, -1)
+		return nil
+	}
+	if e.To != pos {
+		pos = e.To
+		p.Cli.WritePacket_PlayerTeleport(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, -1)
+	}
+
+	p.setPosition(pos)
+
+	// Update position to all players in level
+	playerId := p.PlayerId()
+	for _, otherP := range l.Players() {
+		if otherP == p {
+			continue // No need to send to self
+		}
+
+		otherP.Cli.WritePacket_PlayerTeleport(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, playerId)
+	}
+
+	return nil
+}
+
+// Longest message a player can send in parts with LongerMessages
+const maxMessageLength = 2048
+
+func handleMessage(s *Server, p *Player, packet protocol.Packet) error {
+	pk, ok := packet.(*protocol.Message)
+	if !ok {
+		return fmt.Errorf("unexpected packet %T", packet)
+	}
+
+	// With LongerMessages, a non-zero first byte means more parts of this message follow
+	if p.Supports("LongerMessages", 1) && pk.PlayerId != 0x00 {
+		if len(p.partialMessage)+len(pk.Message) > maxMessageLength {
+			return fmt.Errorf("message longer than %v characters", maxMessageLength)
+		}
+
+		p.partialMessage += pk.Message
+		return nil
+	}
+
+	msg := strings.TrimRight(p.partialMessage+pk.Message, " ")
+	p.partialMessage = ""
+
+	s.handleIncomingMessage(p, msg)
+	return nil
+}
@@ -0,0 +1,368 @@
+package core
+
+import (
+	"math/rand"
+	"midnight/pkg/nbt"
+	"strings"
+	"time"
+)
+
+type PhysicsMode byte
+
+const (
+	PhysicsOff      PhysicsMode = iota
+	PhysicsNormal               // Flowing water and lava, falling sand and gravel, sponges
+	PhysicsAdvanced             // Also grass spreading and dying, and saplings growing
+)
+
+var physicsModeNames = []string{"off", "normal", "advanced"}
+
+func (m PhysicsMode) String() string {
+	if int(m) < len(physicsModeNames) {
+		return physicsModeNames[m]
+	}
+	return "unknown"
+}
+
+// Returns the physics mode with the given name.
+func ParsePhysicsMode(name string) (PhysicsMode, bool) {
+	for i, modeName := range physicsModeNames {
+		if strings.EqualFold(name, modeName) {
+			return PhysicsMode(i), true
+		}
+	}
+	return PhysicsOff, false
+}
+
+const (
+	physicsInterval = 100 // Milliseconds between physics ticks
+	lavaDelay       = 4   // Physics ticks before lava flows; Everything else updates on the next tick
+	spongeRadius    = 2   // Sponges soak up water this many blocks away
+)
+
+// Block updates waiting to happen in a level. Guarded by the level's mu.
+type levelPhysics struct {
+	mode PhysicsMode
+	tick uint64
+
+	// Indexes of blocks to update, by the tick they're due modulo the number of buckets
+	buckets   [lavaDelay + 1][]int
+	scheduled map[int]bool
+	rng       *rand.Rand
+}
+
+// Sets up physics for a level that's being added to a server, using the mode saved with the level
+// or the default mode.
+func (l *Level) initPhysics(defaultMode PhysicsMode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.physics.mode = defaultMode
+	if midnight, ok := l.Metadata.Compound("Midnight"); ok {
+		if mode, ok := midnight.Byte("Physics"); ok && int(mode) < len(physicsModeNames) {
+			l.physics.mode = PhysicsMode(mode)
+		}
+	}
+
+	l.physics.scheduled = make(map[int]bool)
+	l.physics.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// Returns the level's physics mode.
+func (l *Level) PhysicsMode() PhysicsMode {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.physics.mode
+}
+
+// Changes the level's physics mode. The mode is saved with the level.
+func (l *Level) SetPhysicsMode(mode PhysicsMode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.physics.mode = mode
+	if mode == PhysicsOff {
+		l.physics.buckets = [lavaDelay + 1][]int{}
+		l.physics.scheduled = make(map[int]bool)
+	}
+
+	if l.Metadata == nil {
+		l.Metadata = nbt.Compound{}
+	}
+	midnight, ok := l.Metadata.Compound("Midnight")
+	if !ok {
+		midnight = nbt.Compound{}
+		l.Metadata["Midnight"] = midnight
+	}
+	midnight["Physics"] = byte(mode)
+
+	l.changed = true
+}
+
+// Queues a block to be updated after delay ticks. The caller must hold l.mu for writing.
+func (l *Level) schedule(x, y, z int16, delay int) {
+	ph := &l.physics
+	if ph.mode == PhysicsOff || !l.InBounds(x, y, z) {
+		return
+	}
+
+	i := l.Index(x, y, z)
+	if ph.scheduled[i] {
+		return
+	}
+
+	ph.scheduled[i] = true
+	bucket := (ph.tick + uint64(delay)) % uint64(len(ph.buckets))
+	ph.buckets[bucket] = append(ph.buckets[bucket], i)
+}
+
+// Queues updates for a block that changed and its neighbours. The caller must hold l.mu for writing.
+func (l *Level) blockChanged(x, y, z int16, old byte) {
+	if l.physics.mode == PhysicsOff {
+		return
+	}
+
+	delay := 1
+	if b := l.block(x, y, z); b == BlockLava {
+		delay = lavaDelay
+	}
+	l.schedule(x, y, z, delay)
+
+	for _, n := range neighbours {
+		l.schedule(x+n[0], y+n[1], z+n[2], 1)
+	}
+
+	// Water flows back into the space a removed sponge kept dry
+	if old == BlockSponge {
+		r := int16(spongeRadius + 1)
+		for dx := -r; dx <= r; dx++ {
+			for dy := -r; dy <= r; dy++ {
+				for dz := -r; dz <= r; dz++ {
+					if b := l.blockOrAir(x+dx, y+dy, z+dz); b == BlockWater || b == BlockStillWater {
+						l.schedule(x+dx, y+dy, z+dz, 1)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Changes a block as part of physics: the change is sent to the players in the level and the
+// block's neighbours are updated, but it isn't recorded in the block history.
+// The caller must hold l.mu for writing.
+func (l *Level) physicsSet(x, y, z int16, block byte) {
+	if !l.InBounds(x, y, z) {
+		return
+	}
+
+	old := l.setBlock(x, y, z, block)
+	l.sendBlock(block, x, y, z)
+
+	l.blockChanged(x, y, z, old)
+}
+
+// Runs one physics tick, doing at most budget block updates. Updates over the budget wait for the next tick.
+func (l *Level) tickPhysics(budget int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ph := &l.physics
+	if ph.mode == PhysicsOff || l.unloaded {
+		return
+	}
+
+	ph.tick++
+	n := uint64(len(ph.buckets))
+
+	queue := ph.buckets[ph.tick%n]
+	ph.buckets[ph.tick%n] = nil
+
+	for done, i := range queue {
+		if done >= budget {
+			next := (ph.tick + 1) % n
+			ph.buckets[next] = append(ph.buckets[next], queue[done:]...)
+			break
+		}
+
+		delete(ph.scheduled, i)
+		l.updateBlock(l.FromIndex(i))
+	}
+
+	if ph.mode == PhysicsAdvanced {
+		l.randomTicks()
+	}
+}
+
+// The six blocks touching a block
+var neighbours = [6][3]int16{{0, -1, 0}, {0, 1, 0}, {-1, 0, 0}, {1, 0, 0}, {0, 0, -1}, {0, 0, 1}}
+
+// Applies physics to one block. The caller must hold l.mu for writing.
+func (l *Level) updateBlock(x, y, z int16) {
+	switch block := l.block(x, y, z); block {
+	case BlockWater:
+		l.flow(x, y, z, BlockWater)
+
+	case BlockLava:
+		l.flow(x, y, z, BlockLava)
+
+	case BlockSand, BlockGravel:
+		if below := l.blockOrStone(x, y-1, z); below == BlockAir || isFluid(below) {
+			l.physicsSet(x, y, z, BlockAir)
+			l.physicsSet(x, y-1, z, block)
+		}
+
+	case BlockSponge:
+		r := int16(spongeRadius)
+		for dx := -r; dx <= r; dx++ {
+			for dy := -r; dy <= r; dy++ {
+				for dz := -r; dz <= r; dz++ {
+					if b := l.blockOrAir(x+dx, y+dy, z+dz); b == BlockWater || b == BlockStillWater {
+						l.physicsSet(x+dx, y+dy, z+dz, BlockAir)
+					}
+				}
+			}
+		}
+
+	case BlockGrass:
+		if l.physics.mode == PhysicsAdvanced && !letsLightThrough(l.blockOrAir(x, y+1, z)) {
+			l.physicsSet(x, y, z, BlockDirt)
+		}
+
+	case BlockSapling:
+		if below := l.blockOrStone(x, y-1, z); below != BlockDirt && below != BlockGrass {
+			l.physicsSet(x, y, z, BlockAir)
+		}
+	}
+}
+
+// Spreads water or lava down and sideways into air. Lava touching water turns to stone.
+func (l *Level) flow(x, y, z int16, fluid byte) {
+	for _, n := range neighbours {
+		b := l.blockOrAir(x+n[0], y+n[1], z+n[2])
+
+		if fluid == BlockWater && (b == BlockLava || b == BlockStillLava) {
+			l.physicsSet(x+n[0], y+n[1], z+n[2], BlockStone)
+		} else if fluid == BlockLava && (b == BlockWater || b == BlockStillWater) {
+			l.physicsSet(x, y, z, BlockStone)
+			return
+		}
+	}
+
+	for _, n := range neighbours {
+		if n[1] > 0 {
+			continue // Fluids don't flow up
+		}
+
+		nx, ny, nz := x+n[0], y+n[1], z+n[2]
+		if !l.InBounds(nx, ny, nz) || l.block(nx, ny, nz) != BlockAir {
+			continue
+		}
+		if fluid == BlockWater && l.nearSponge(nx, ny, nz) {
+			continue
+		}
+
+		l.physicsSet(nx, ny, nz, fluid)
+	}
+}
+
+// Returns true if there's a sponge close enough to keep a block dry. The caller must hold l.mu.
+func (l *Level) nearSponge(x, y, z int16) bool {
+	r := int16(spongeRadius)
+	for dx := -r; dx <= r; dx++ {
+		for dy := -r; dy <= r; dy++ {
+			for dz := -r; dz <= r; dz++ {
+				if l.blockOrAir(x+dx, y+dy, z+dz) == BlockSponge {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Updates random blocks, like Minecraft's random ticks: grass spreads to lit dirt and dies in the
+// dark, and saplings grow into trees. The caller must hold l.mu for writing.
+func (l *Level) randomTicks() {
+	rng := l.physics.rng
+
+	for n := int(l.BlocksTotal)/4096 + 1; n > 0; n-- {
+		x, y, z := l.FromIndex(rng.Intn(int(l.BlocksTotal)))
+		lit := letsLightThrough(l.blockOrAir(x, y+1, z))
+
+		switch l.block(x, y, z) {
+		case BlockGrass:
+			if !lit {
+				l.physicsSet(x, y, z, BlockDirt)
+			}
+
+		case BlockDirt:
+			if lit && l.grassNearby(x, y, z) {
+				l.physicsSet(x, y, z, BlockGrass)
+			}
+
+		case BlockSapling:
+			if below := l.blockOrStone(x, y-1, z); below == BlockDirt || below == BlockGrass {
+				l.physicsSet(x, y, z, BlockAir)
+				placeTree(l, rng, x, y-1, z, l.physicsSet)
+			}
+		}
+	}
+}
+
+// Returns true if there's grass next to a block, or one block above or below that.
+func (l *Level) grassNearby(x, y, z int16) bool {
+	for dx := int16(-1); dx <= 1; dx++ {
+		for dy := int16(-1); dy <= 1; dy++ {
+			for dz := int16(-1); dz <= 1; dz++ {
+				if l.blockOrAir(x+dx, y+dy, z+dz) == BlockGrass {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Returns the block at a position, or air outside the level. The caller must hold l.mu.
+func (l *Level) blockOrAir(x, y, z int16) byte {
+	if !l.InBounds(x, y, z) {
+		return BlockAir
+	}
+	return l.block(x, y, z)
+}
+
+// Returns the block at a position, or stone outside the level, so nothing falls out of it.
+// The caller must hold l.mu.
+func (l *Level) blockOrStone(x, y, z int16) byte {
+	if !l.InBounds(x, y, z) {
+		return BlockStone
+	}
+	return l.block(x, y, z)
+}
+
+func isFluid(block byte) bool {
+	return block == BlockWater || block == BlockStillWater || block == BlockLava || block == BlockStillLava
+}
+
+// Returns true for blocks that grass can grow under.
+func letsLightThrough(block byte) bool {
+	switch block {
+	case BlockAir, BlockGlass, BlockLeaves, BlockSapling, BlockDandelion, BlockRose, BlockBrownMushroom, BlockRedMushroom, BlockRope, BlockFire:
+		return true
+	}
+	return false
+}
+
+// Starts the task that runs physics in every loaded level.
+func (s *Server) createPhysicsTask(budget int) {
+	s.sch.AddTask(Task{
+		Id:        "physics",
+		ExecDelay: physicsInterval,
+		TaskFunc: func() {
+			for _, l := range s.Levels() {
+				l.tickPhysics(budget)
+			}
+		},
+	})
+}
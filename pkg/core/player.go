@@ -1,12 +1,190 @@
 package core
 
+import (
+	"regexp"
+	"sync"
+)
+
+// Usernames allowed by classicube.net
+var usernameRegex *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_.]{1,16}$`)
+
+// Returns true if the name can be a player's username. Exported for use in main.go
+func ValidUsername(name string) bool {
+	return usernameRegex.MatchString(name)
+}
+
 type Player struct {
 	Cli             Client
 	Username        string
 	IP              string
 	Client_Software string
-	PlayerId        int8
 
-	PosX, PosY, PosZ float32
-	Pitch, Yaw       byte
+	// Message parts received so far from clients using LongerMessages.
+	// Only used by the player's own connection goroutine.
+	partialMessage string
+
+	// Set by /about; The next block the player clicks is inspected instead of changed.
+	// Only used by the player's own connection goroutine.
+	aboutMode bool
+
+	// Guards the fields below. The player's own connection goroutine writes them while
+	// other goroutines read them, so they're only accessed through the methods below.
+	mu           sync.RWMutex
+	playerId     int8 // Entity ID of the player in their current level
+	level        *Level
+	pos          Position
+	rank         *Rank
+	disconnected bool
+}
+
+type Position struct {
+	X, Y, Z    float32
+	Yaw, Pitch byte
+}
+
+func (p *Player) Supports(extName string, version int32) bool {
+	return p.Cli.Supports(extName, version)
+}
+
+// Returns the entity ID of the player in their current level.
+func (p *Player) PlayerId() int8 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.playerId
+}
+
+// Returns the level the player is in, or nil if they're not in one (e.g. while disconnecting).
+func (p *Player) Level() *Level {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.level
+}
+
+func (p *Player) Position() Position {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.pos
+}
+
+func (p *Player) setPosition(pos Position) {
+	p.mu.Lock()
+	p.pos = pos
+	p.mu.Unlock()
+}
+
+// Moves the player to a position in their level, showing the move to everyone in it.
+func (p *Player) Teleport(pos Position) {
+	p.setPosition(pos)
+	p.Cli.WritePacket_PlayerTeleport(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, -1)
+
+	l := p.Level()
+	if l == nil {
+		return
+	}
+
+	playerId := p.PlayerId()
+	for _, otherP := range l.Players() {
+		if otherP != p {
+			otherP.Cli.WritePacket_PlayerTeleport(pos.X, pos.Y, pos.Z, pos.Yaw, pos.Pitch, playerId)
+		}
+	}
+}
+
+// Places the player in a level. Returns false if they have disconnected.
+// The caller must hold the level's lock.
+func (p *Player) enterLevel(l *Level, playerId int8, pos Position) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.disconnected {
+		return false
+	}
+
+	p.level = l
+	p.playerId = playerId
+	p.pos = pos
+	return true
+}
+
+// Clears the player's level, returning the level they were in.
+// Only one caller gets the level back, so a player is never removed from a level twice.
+func (p *Player) leaveLevel() (l *Level, playerId int8) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, playerId = p.level, p.playerId
+	p.level = nil
+
+	return l, playerId
+}
+
+// Marks the player as disconnected. Returns false if they already were.
+func (p *Player) markDisconnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.disconnected {
+		return false
+	}
+
+	p.disconnected = true
+	return true
+}
+
+// Returns the player's name, for use as a CommandSender.
+func (p *Player) Name() string {
+	return p.Username
+}
+
+// Sends a chat message to the player. Messages longer than a line are wrapped.
+func (p *Player) SendMessage(msg string) {
+	// Change color codes from % to &. E.g. %e becomes &e
+	msg = colorCodeRegex.ReplaceAllString(msg, "&${1}")
+
+	if !p.Cli.CPE {
+		msg = sanitizeClassicMessage(msg)
+	}
+
+	for _, line := range wrapMessage(msg) {
+		p.Cli.WritePacket_Message(-1, line)
+	}
+}
+
+// Returns true if the player's rank grants the permission.
+func (p *Player) HasPermission(permission string) bool {
+	r := p.Rank()
+	if r == nil {
+		return permission == ""
+	}
+	return r.HasPermission(permission)
+}
+
+// Returns the player's rank, or nil if they haven't joined yet.
+func (p *Player) Rank() *Rank {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.rank
+}
+
+// Changes the player's rank, returning their old one.
+func (p *Player) setRank(r *Rank) *Rank {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.rank
+	p.rank = r
+	return old
+}
+
+// Returns the player's name as shown in chat, with their rank's prefix and color.
+func (p *Player) DisplayName() string {
+	r := p.Rank()
+	if r == nil {
+		return p.Username
+	}
+	return r.Prefix + r.Color + p.Username
 }
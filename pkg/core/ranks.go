@@ -0,0 +1,290 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	RanksFile       = "ranks.json"
+	PlayerRanksFile = "player-ranks.json"
+)
+
+// A rank has the permissions listed for it, as well as those of every rank with a lower level.
+//
+// Permission nodes are dot-separated, e.g. "command.rank". "*" grants every permission and
+// a node ending in ".*" grants every node below it. The "op" node makes the client treat the
+// player as an operator, which lets them break bedrock. The "build" node lets players change
+// blocks, and "build.bedrock", "build.water" and "build.lava" let them place and break those.
+// "banip.wide" lets players ban IP ranges wider than /16 (/48 for IPv6).
+type Rank struct {
+	Name        string   `json:"name"`
+	Level       int      `json:"level"`
+	Color       string   `json:"color"`  // Color code for the player's name, e.g. "&a"
+	Prefix      string   `json:"prefix"` // Shown before the player's name in chat
+	Permissions []string `json:"permissions"`
+
+	permissions map[string]bool // Including those of lower ranks
+}
+
+type ranksConfig struct {
+	DefaultRank string  `json:"default_rank"` // Rank of players who haven't been given one
+	Ranks       []*Rank `json:"ranks"`
+}
+
+func defaultRanksConfig() *ranksConfig {
+	return &ranksConfig{
+		DefaultRank: "guest",
+		Ranks: []*Rank{
+			{Name: "guest", Level: 0, Color: "&7", Permissions: []string{"build"}},
+			{Name: "builder", Level: 30, Color: "&a", Permissions: []string{}},
+			{Name: "op", Level: 80, Color: "&9", Prefix: "&9[Op] ", Permissions: []string{"op", "build.*", "command.*"}},
+			{Name: "admin", Level: 100, Color: "&c", Prefix: "&c[Admin] ", Permissions: []string{"*"}},
+		},
+	}
+}
+
+var rankColorRegex *regexp.Regexp = regexp.MustCompile(`^&[0-9a-f]$`)
+
+// Returns true if the rank grants the permission.
+func (r *Rank) HasPermission(permission string) bool {
+	if permission == "" || r.permissions["*"] || r.permissions[permission] {
+		return true
+	}
+
+	for i := strings.LastIndexByte(permission, '.'); i > 0; i = strings.LastIndexByte(permission[:i], '.') {
+		if r.permissions[permission[:i]+".*"] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if clients of players with this rank are told that they're an operator.
+func (r *Rank) IsOp() bool {
+	return r.HasPermission("op")
+}
+
+// Returns the rank's name in its color.
+func (r *Rank) ColoredName() string {
+	return r.Color + r.Name
+}
+
+// Ranks, and the ranks given to players.
+type rankList struct {
+	mu          sync.RWMutex
+	ranks       []*Rank // Sorted by level
+	defaultRank *Rank
+	players     map[string]string // Rank names by lowercase username
+}
+
+// Loads the ranks file, creating it with the default ranks if it doesn't exist, and the player ranks file.
+func loadRanks() (*rankList, error) {
+	conf := defaultRanksConfig()
+
+	data, err := ioutil.ReadFile(RanksFile)
+	if os.IsNotExist(err) {
+		log.Printf("Could not load %v. Creating it with the default ranks.", RanksFile)
+
+		if data, err = marshalIndent(conf); err == nil {
+			err = writeFileAtomic(RanksFile, data)
+		}
+		if err != nil {
+			log.Printf("Could not save %v: %v", RanksFile, err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		conf = new(ranksConfig)
+		if err := json.Unmarshal(data, conf); err != nil {
+			return nil, fmt.Errorf("%v: %v", RanksFile, err)
+		}
+	}
+
+	rl := &rankList{players: make(map[string]string)}
+
+	// Check for invalid values
+	names := make(map[string]bool)
+	for _, r := range conf.Ranks {
+		if r == nil {
+			continue
+		}
+
+		if !isValidRankName(r.Name) || names[strings.ToLower(r.Name)] {
+			log.Printf("[%v] Invalid or duplicate rank name [%v]; Skipping rank", RanksFile, r.Name)
+			continue
+		}
+		names[strings.ToLower(r.Name)] = true
+
+		if !rankColorRegex.MatchString(r.Color) {
+			log.Printf("[%v] Invalid 'color' for rank '%v' [%v]; Setting to default [&f]", RanksFile, r.Name, r.Color)
+			r.Color = "&f"
+		}
+
+		rl.ranks = append(rl.ranks, r)
+	}
+
+	if len(rl.ranks) == 0 {
+		log.Printf("[%v] No valid ranks; Using the default ranks", RanksFile)
+		rl.ranks = defaultRanksConfig().Ranks
+	}
+
+	sort.SliceStable(rl.ranks, func(i, j int) bool { return rl.ranks[i].Level < rl.ranks[j].Level })
+
+	// Ranks inherit the permissions of every rank below them
+	inherited := make(map[string]bool)
+	for _, r := range rl.ranks {
+		for _, permission := range r.Permissions {
+			inherited[permission] = true
+		}
+
+		r.permissions = make(map[string]bool, len(inherited))
+		for permission := range inherited {
+			r.permissions[permission] = true
+		}
+	}
+
+	rl.defaultRank = rl.find(conf.DefaultRank)
+	if rl.defaultRank == nil {
+		log.Printf("[%v] Invalid 'default_rank' [%v]; Setting to the lowest rank [%v]", RanksFile, conf.DefaultRank, rl.ranks[0].Name)
+		rl.defaultRank = rl.ranks[0]
+	}
+
+	data, err = ioutil.ReadFile(PlayerRanksFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &rl.players); err != nil {
+			return nil, fmt.Errorf("%v: %v", PlayerRanksFile, err)
+		}
+	}
+
+	return rl, nil
+}
+
+// Returns the rank with the given name, or nil. The caller must hold rl.mu, or not need it.
+func (rl *rankList) find(name string) *Rank {
+	for _, r := range rl.ranks {
+		if strings.EqualFold(r.Name, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rl *rankList) savePlayers() error {
+	data, err := marshalIndent(rl.players)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(PlayerRanksFile, data)
+}
+
+// Rank names are used in commands, so they're limited to letters, digits and underscores.
+func isValidRankName(name string) bool {
+	if name == "" || len(name) > 16 {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the rank with the given name, or nil if there is none.
+func (s *Server) Rank(name string) *Rank {
+	return s.ranks.find(name)
+}
+
+// Returns every rank, from the lowest level to the highest.
+func (s *Server) Ranks() []*Rank {
+	return append([]*Rank(nil), s.ranks.ranks...)
+}
+
+// Returns the rank of a player, online or not.
+func (s *Server) PlayerRank(username string) *Rank {
+	s.ranks.mu.RLock()
+	defer s.ranks.mu.RUnlock()
+
+	if r := s.ranks.find(s.ranks.players[strings.ToLower(username)]); r != nil {
+		return r
+	}
+	return s.ranks.defaultRank
+}
+
+// Gives a player a rank and saves it. If the player is online, their client is updated.
+func (s *Server) SetPlayerRank(username string, r *Rank) error {
+	s.ranks.mu.Lock()
+	old, found := s.ranks.players[strings.ToLower(username)]
+
+	if r == s.ranks.defaultRank {
+		delete(s.ranks.players, strings.ToLower(username))
+	} else {
+		s.ranks.players[strings.ToLower(username)] = r.Name
+	}
+
+	err := s.ranks.savePlayers()
+	if err != nil {
+		// Keep the saved and the used ranks the same
+		if found {
+			s.ranks.players[strings.ToLower(username)] = old
+		} else {
+			delete(s.ranks.players, strings.ToLower(username))
+		}
+	}
+	s.ranks.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Could not save %v: %v", PlayerRanksFile, err)
+		return fmt.Errorf("could not save the rank of %v", username)
+	}
+
+	if p := s.Player(username); p != nil {
+		oldRank := p.setRank(r)
+
+		if oldRank == nil || oldRank.IsOp() != r.IsOp() {
+			p.Cli.WritePacket_UpdateUserType(r.IsOp())
+		}
+		p.SendMessage("&eYour rank is now " + r.ColoredName() + "&e.")
+	}
+
+	return nil
+}
+
+// Returns indented JSON, leaving characters like '&' in color codes unescaped so the file is easy to edit.
+func marshalIndent(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes a file through a temporary file, so that it's never left half-written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
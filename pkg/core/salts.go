@@ -0,0 +1,155 @@
+package core
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Salts by heartbeat URL. They're kept so that players who were given an mppass before a restart
+// can still join after it. Anyone who knows a salt can join under any name, so keep the file private.
+const SaltsFile = "salts.json"
+
+const saltLength = 32
+
+// Letters and digits only, which server lists pass on unchanged
+const saltAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// Addresses of players who may join unverified when allow_unverified_lan is set
+var localNetworks = parseCIDRs("127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "::1/128", "fc00::/7", "fe80::/10")
+
+// Generates a random salt from crypto/rand.
+func GenerateSalt() string {
+	// Bytes at or above this are skipped, so that every character is equally likely
+	limit := 256 - 256%len(saltAlphabet)
+
+	salt := make([]byte, 0, saltLength)
+	buf := make([]byte, saltLength)
+
+	for len(salt) < saltLength {
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("Could not generate a salt: %v", err)
+		}
+
+		for _, b := range buf {
+			if int(b) < limit && len(salt) < saltLength {
+				salt = append(salt, saltAlphabet[int(b)%len(saltAlphabet)])
+			}
+		}
+	}
+
+	return string(salt)
+}
+
+func isValidSalt(salt string) bool {
+	if len(salt) < 16 {
+		return false
+	}
+
+	for _, c := range salt {
+		if !strings.ContainsRune(saltAlphabet, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a salt for each heartbeat URL, keeping the ones in the salts file and generating the rest.
+// The salts are returned even if the file could not be read or written; They just won't outlast a restart.
+func loadSalts(urls []string) (map[string]string, error) {
+	saved := make(map[string]string)
+
+	var loadErr error
+	if data, err := ioutil.ReadFile(SaltsFile); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			loadErr = fmt.Errorf("%v: %v", SaltsFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		loadErr = err
+	}
+
+	salts := make(map[string]string)
+	changed := len(saved) != len(urls)
+
+	for _, u := range urls {
+		salt := saved[u]
+		if !isValidSalt(salt) {
+			salt = GenerateSalt()
+			changed = true
+		}
+		salts[u] = salt
+	}
+
+	// Salts of lists that are no longer used are dropped, so their mppasses stop working
+	if changed && loadErr == nil {
+		data, err := json.MarshalIndent(salts, "", "\t")
+		if err == nil {
+			err = ioutil.WriteFile(SaltsFile+".tmp", data, 0600)
+		}
+		if err == nil {
+			err = os.Rename(SaltsFile+".tmp", SaltsFile)
+		}
+		if err != nil {
+			return salts, err
+		}
+	}
+
+	return salts, loadErr
+}
+
+// Returns true if the mppass a player sent shows that one of the server lists the server sends
+// heartbeats to has verified their name. Players on the local network are let in unverified if
+// allow_unverified_lan is set. Exported for use in main.go
+func (s *Server) VerifyMppass(username, mppass, addr string) bool {
+	if !s.VerifyLogin {
+		return true
+	}
+
+	if s.allowUnverifiedLAN {
+		if ip := remoteIP(addr); ip != nil && isLocalIP(ip) {
+			return true
+		}
+	}
+
+	// Some lists drop leading zeros from the hash
+	mppass = strings.TrimLeft(strings.ToLower(mppass), "0")
+
+	verified := 0
+	for _, salt := range s.salts {
+		sum := md5.Sum([]byte(salt + username))
+		expected := strings.TrimLeft(hex.EncodeToString(sum[:]), "0")
+
+		verified |= subtle.ConstantTimeCompare([]byte(expected), []byte(mppass))
+	}
+
+	return verified == 1
+}
+
+func isLocalIP(ip net.IP) bool {
+	for _, n := range localNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -1,11 +1,16 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"log"
-	"math/rand"
-	"midnight/pkg/util"
+	"midnight/pkg/logging"
+	"midnight/pkg/protocol"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,16 +19,40 @@ var colorCodeRegex *regexp.Regexp = regexp.MustCompile(`%([0-9a-fA-F])`)
 type Server struct {
 	name        string
 	port        string
-	Salt        string // Salt exported for use in main.go
 	public      bool
+	web         bool // Tells server lists that the server supports the web client
 	maxUsers    int32
 	VerifyLogin bool // VerifyLogin exported for use in main.go
 
-	lvl     *Level
-	players map[int8]Player
+	salts              map[string]string // Salts by heartbeat URL; Set when the server starts
+	allowUnverifiedLAN bool              // Lets players on the local network join without a valid mppass
 
-	ch  *ClientHandler
-	sch *TaskScheduler
+	RequiredExtensions []string // RequiredExtensions exported for use in main.go
+
+	mainLevel        *Level
+	historyRetention time.Duration // How long block changes are kept; 0 keeps them forever
+	defaultPhysics   PhysicsMode   // Physics mode of levels that haven't been given one
+	ranks            *rankList
+	bans             *banList
+	whitelist        *whitelist
+
+	// Guards the maps below. Lock order: Server.mu, then Level.mu, then Player.mu.
+	mu      sync.RWMutex
+	levels  map[string]*Level        // Loaded levels by lowercase name
+	loading map[string]chan struct{} // Levels being loaded by lowercase name; Closed once the load has finished
+	players map[string]*Player       // Online players by lowercase username
+
+	ch         *ClientHandler
+	sch        *TaskScheduler
+	heartbeats []*heartbeat // Set when the server starts
+
+	stopTasks context.CancelFunc // Stops the task scheduler
+	tasksDone chan struct{}      // Closed once the task scheduler has stopped
+
+	shutdownOnce sync.Once
+	quit         chan struct{} // Closed when the server begins shutting down
+	done         chan struct{} // Closed once the server has shut down
+	exitCode     int
 }
 
 func StartServer(ch *ClientHandler, conf *Config) *Server {
@@ -32,198 +61,345 @@ func StartServer(ch *ClientHandler, conf *Config) *Server {
 	s.name = conf.ServerName
 	s.port = strconv.FormatInt(int64(conf.Port), 10)
 	s.public = conf.Public
+	s.web = conf.Web
 	s.maxUsers = int32(conf.MaxUsers)
 	s.VerifyLogin = conf.VerifyLogin
-	s.players = make(map[int8]Player)
+	s.RequiredExtensions = conf.RequiredExtensions
+	s.historyRetention = time.Duration(conf.BlockHistoryDays * float64(24*time.Hour))
+	s.defaultPhysics, _ = ParsePhysicsMode(conf.Physics)
+	s.players = make(map[string]*Player)
+	s.levels = make(map[string]*Level)
+	s.loading = make(map[string]chan struct{})
+	s.ch = ch
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+
+	for _, name := range s.RequiredExtensions {
+		if _, found := registeredVersion(name); !found {
+			log.Printf("[server.json] Required extension '%v' is not supported by this server; No CPE client will be able to join", name)
+		}
+	}
 
+	s.allowUnverifiedLAN = conf.AllowUnverifiedLAN
 	if conf.Debug.OverrideSalt == true {
-		s.Salt = conf.Debug.Salt
+		s.salts = make(map[string]string)
+		for _, u := range conf.HeartbeatURLs {
+			s.salts[u] = conf.Debug.Salt
+		}
 	} else {
-		s.Salt = GenerateSalt()
+		salts, err := loadSalts(conf.HeartbeatURLs)
+		if err != nil {
+			log.Printf("Could not load %v: %v; Players will have to reconnect through the server list after a restart", SaltsFile, err)
+		}
+		s.salts = salts
+	}
+	if s.VerifyLogin && len(s.salts) == 0 {
+		log.Printf("[server.json] 'verify_login' is set but 'heartbeat_urls' is empty; Players can't be verified")
+	}
+
+	ranks, err := loadRanks()
+	if err != nil {
+		log.Fatalf("Could not load ranks: %v", err)
+	}
+	s.ranks = ranks
+
+	bans, wl, err := loadModeration()
+	if err != nil {
+		log.Fatalf("Could not load bans: %v", err)
 	}
+	s.bans, s.whitelist = bans, wl
+
+	lvl, err := s.OpenLevel(conf.MainLevel)
+	if os.IsNotExist(err) {
+		seed := time.Now().UnixNano()
+		if conf.MainLevelSeed != "" {
+			seed = ParseSeed(conf.MainLevelSeed)
+		}
+
+		log.Printf("Level '%v' does not exist; Generating a new one with '%v' [seed %v]", conf.MainLevel, conf.MainLevelGenerator, seed)
 
-	s.lvl = ConstructLevel("main", 256, 256, 256)
-	s.lvl.GenerateFlat()
+		lvl, err = GenerateLevel(conf.MainLevel, 256, 256, 256, conf.MainLevelGenerator, seed)
+		if err != nil {
+			log.Fatalf("Could not generate main level '%v': %v", conf.MainLevel, err)
+		}
+		s.SaveLevel(lvl)
+		if err := s.addLevel(lvl); err != nil {
+			log.Fatalf("Could not add main level '%v': %v", conf.MainLevel, err)
+		}
+	} else if err != nil {
+		log.Fatalf("Could not load main level '%v': %v", conf.MainLevel, err)
+	}
+	s.mainLevel = lvl
 
 	if s.public {
-		go BeginHeartbeatLoop(s)
+		s.startHeartbeats(conf.HeartbeatURLs)
 	}
 
 	log.Printf("Starting task scheduler/loop")
 	s.sch = new(TaskScheduler)
-	go s.sch.StartServerTickLoop()
+	s.registerMetrics()
+	s.createBasicTasks(conf)
 
-	s.createBasicTasks(conf.AnnouncePlayers)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopTasks = cancel
+	s.tasksDone = make(chan struct{})
+	go func() {
+		s.sch.Run(ctx)
+		close(s.tasksDone)
+	}()
 
 	return s
 }
 
-func (s *Server) JoinUser(p Player) {
-	// Find open player ID
-	// TODO: Make this per-level instead of per-server. Right now it imposes a limit of 127 people in the server
+// Returns the online player with the given name, or nil if they aren't online.
+func (s *Server) Player(name string) *Player {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	var playerId int8
-	for i := int8(1); i < 127; i++ {
-		if _, found := s.players[i]; !found {
-			playerId = i
-		}
-	}
+	return s.players[strings.ToLower(name)]
+}
 
-	p.PlayerId = playerId
+// Returns every online player.
+func (s *Server) Players() []*Player {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	p.PosX = s.lvl.SpawnPos[0]
-	p.PosY = s.lvl.SpawnPos[1]
-	p.PosZ = s.lvl.SpawnPos[2]
+	players := make([]*Player, 0, len(s.players))
+	for _, p := range s.players {
+		players = append(players, p)
+	}
+	return players
+}
 
-	s.players[playerId] = p
-	s.lvl.Players[playerId] = p
+func (s *Server) PlayerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	log.Printf("%v has joined the server [%v]", p.Username, p.IP)
+	return len(s.players)
+}
 
-	// Send level
-	p.Cli.WritePacketUtil_SendLevel(s.lvl)
-	p.Cli.WritePacket_SpawnPlayer(p.PosX, p.PosY, p.PosZ, 0, 0, -1, p.Username)
+func (s *Server) JoinUser(p *Player) {
+	p.setRank(s.PlayerRank(p.Username))
+
+	// Only one session per name; The newest login replaces the old one
+	s.mu.Lock()
+	if s.Stopping() {
+		s.mu.Unlock()
+		p.markDisconnected()
+		p.Cli.WritePacket_DisconnectPlayer("Server is shutting down")
+		p.Cli.Close()
+		return
+	}
+	old := s.players[strings.ToLower(p.Username)]
+	s.players[strings.ToLower(p.Username)] = p
+	s.mu.Unlock()
 
-	// Send spawn packet for this user to all other players
-	for _, otherP := range s.lvl.Players {
-		if otherP == p {
-			continue // No need to send to self
-		}
+	if old != nil {
+		s.disconnectPlayer(old, "Logged in from another location")
+	}
 
-		// TODO: Allow setting Pitch and Yaw for spawn points
-		otherP.Cli.WritePacket_SpawnPlayer(s.lvl.SpawnPos[0], s.lvl.SpawnPos[1], s.lvl.SpawnPos[2], 0, 0, p.PlayerId, p.Username)
+	join := &PlayerJoinEvent{Player: p, Level: s.mainLevel}
+	FireEvent(join)
+	if join.Level == nil {
+		join.Level = s.mainLevel
+	}
 
-		// Now the other way around! Send spawn packets for all existing users to this player
-		p.Cli.WritePacket_SpawnPlayer(otherP.PosX, otherP.PosY, otherP.PosZ, otherP.Yaw, otherP.Pitch, otherP.PlayerId, otherP.Username)
+	if err := s.MovePlayer(p, join.Level); err != nil {
+		s.disconnectPlayer(p, "Could not join: "+err.Error())
+		return
 	}
 
+	metricConnectionsAccepted.Inc()
+	log.Printf("%v has joined the server [%v]", p.Username, p.IP)
+
 	// Player packet recieve loop
 	for {
-		packet, err := p.Cli.ReadPacketEntry()
+		packet, err := p.Cli.ReadPacket()
 
 		if err != nil {
-			s.disconnectPlayer(p, "")
-			return
-		}
-
-		switch packet {
-		case 0x05:
-			x, y, z, mode, blockType, err := p.Cli.ReadPacket_SetBlock()
-
-			if err != nil {
+			if errors.Is(err, protocol.ErrUnknownPacket) {
+				log.Printf("[%v] %v: %v", p.IP, p.Username, err)
+				s.disconnectPlayer(p, "Unknown packet")
+			} else {
 				s.disconnectPlayer(p, "")
-				return
 			}
+			return
+		}
 
-			if mode == 0x00 { // Destroy
-				s.lvl.ChangeBlock(0, util.Vector3i16{X: x, Y: y, Z: z})
-			} else { // mode == 0x01; Create
-				s.lvl.ChangeBlock(blockType, util.Vector3i16{X: x, Y: y, Z: z})
-			}
+		handler, found := packetHandlers[packet.Id()]
+		if !found {
+			logging.Log_Debugf("[%v] Ignoring packet [%v]", p.IP, packet.Id())
+			continue
+		}
 
-		case 0x08:
-			playerId, x, y, z, yaw, pitch, err := p.Cli.ReadPacket_PositionUpdate()
+		if err := handler(s, p, packet); err != nil {
+			log.Printf("[%v] Could not handle packet [%v] from %v: %v", p.IP, packet.Id(), p.Username, err)
+			s.disconnectPlayer(p, "Invalid packet")
+			return
+		}
+	}
+}
 
-			if err != nil {
-				s.disconnectPlayer(p, "")
-				return
-			}
+// Disconnects a player and reduces the number of players in the levels and the server.
+// Leave disconnectMsg empty is no 0x0e packet is being sent.
+// The connection is closed once the remaining queued packets have been sent.
+func (s *Server) disconnectPlayer(p *Player, disconnectMsg string) {
+	defer p.Cli.Close()
 
-			// TODO
-			_ = playerId
-			_ = x
-			_ = y
-			_ = z
-			_ = yaw
-			_ = pitch
-
-			if p.PosX != x || p.PosY != y || p.PosZ != z || p.Pitch != pitch || p.Yaw != yaw {
-				p.PosX = x
-				p.PosY = y
-				p.PosZ = z
-				p.Pitch = pitch
-				p.Yaw = yaw
-
-				s.players[p.PlayerId] = p
-				s.lvl.Players[p.PlayerId] = p
-
-				// Update position to all players in level
-				for _, otherP := range s.lvl.Players {
-					if otherP == p {
-						continue // No need to send to self
-					}
+	if !p.markDisconnected() {
+		return // Already disconnected
+	}
 
-					otherP.Cli.WritePacket_PlayerTeleport(x, y, z, yaw, pitch, p.PlayerId)
-				}
-			}
+	// Remove player from server player list
+	s.removePlayer(p)
 
-		case 0x0D:
-			longMessage, message, err := p.Cli.ReadPacket_Message()
+	// Remove player from level player list and despawn them for all other players in level
+	s.removeFromLevel(p)
 
-			if err != nil {
-				s.disconnectPlayer(p, "")
-				return
-			}
+	if disconnectMsg != "" {
+		p.Cli.WritePacket_DisconnectPlayer(disconnectMsg)
+	}
 
-			// TODO: Enable Long Message
-			_ = longMessage
+	log.Printf("Disconnected [%v]:[%v]", p.Username, p.IP)
 
-			s.handleIncomingMessage(p, message)
+	FireEvent(&PlayerQuitEvent{Player: p, Reason: disconnectMsg})
+}
 
-		default:
-			log.Printf("Test: %v", packet)
-		}
+// Removes a player from the server player list, unless a newer session has replaced them.
+func (s *Server) removePlayer(p *Player) {
+	s.mu.Lock()
+	if s.players[strings.ToLower(p.Username)] == p {
+		delete(s.players, strings.ToLower(p.Username))
 	}
+	s.mu.Unlock()
 }
 
-// Disconnects a player and reduces the number of players in the levels and the server.
-// Leave disconnectMsg empty is no 0x0e packet is being sent.
-func (s *Server) disconnectPlayer(p Player, disconnectMsg string) {
-	delete(s.players, p.PlayerId)     // Remove player from server player list
-	delete(s.lvl.Players, p.PlayerId) // Remove player from level player list
+func (s *Server) handleIncomingMessage(sender *Player, msg string) {
+	if strings.HasPrefix(msg, "/") {
+		s.ExecuteCommand(sender, msg)
+		return
+	}
 
-	// Despawn player for all other players in level
-	for _, otherP := range s.lvl.Players {
-		otherP.Cli.WritePacket_DespawnPlayer(p.PlayerId)
+	e := &PlayerChatEvent{Player: sender, Message: msg, Recipients: s.Players()}
+	if FireEvent(e) {
+		return
 	}
 
-	if disconnectMsg != "" {
-		p.Cli.WritePacket_DisconnectPlayer(disconnectMsg)
+	formatted := sender.DisplayName() + "&f: " + e.Message
+
+	for _, p := range e.Recipients {
+		s.SendMessage(p, formatted)
 	}
 
-	log.Printf("Disconnected [%v]:[%v]", p.Username, p.IP)
+	log.Printf("[Chat] %v: %v", sender.Username, e.Message)
 }
 
-func (s *Server) handleIncomingMessage(sender Player, msg string) {
-	formatted := "&e" + sender.Username + ": &f" + msg
+func (s *Server) SendMessage(p *Player, msg string) {
+	p.SendMessage(msg)
+}
 
-	for _, p := range s.players {
-		s.SendMessage(p, formatted)
+// Makes a message safe for vanilla clients, which can only display ASCII and crash on invalid color codes.
+func sanitizeClassicMessage(msg string) string {
+	raw := []byte(msg)
+	out := make([]byte, 0, len(raw))
+
+	for i := 0; i < len(raw); i++ {
+		b := raw[i]
+
+		if b == '&' && (i+1 >= len(raw) || !isHexDigit(raw[i+1])) {
+			continue // Drop color codes that don't name a valid color
+		}
+
+		if b < 0x20 || b > 0x7E {
+			b = '?'
+		}
+
+		out = append(out, b)
 	}
 
-	log.Printf("[Chat] %v: %v", sender.Username, msg)
+	return string(out)
 }
 
-func (s *Server) SendMessage(p Player, msg string) {
-	// TODO: Remove 64-char limit
-	if len(msg) > 64 {
-		msg = msg[0:64]
+// Splits a message into lines that fit in a message packet, breaking at spaces where possible.
+// Continued lines keep the color of the line before them.
+func wrapMessage(msg string) []string {
+	var lines []string
+	color := ""
+
+	for len(color)+len(msg) > 64 {
+		line := color + msg
+		cut := 64
+
+		if i := strings.LastIndexByte(line[:cut], ' '); i > len(color) {
+			cut = i
+		} else if line[cut-1] == '&' {
+			cut-- // Don't split a color code
+		}
+
+		lines = append(lines, line[:cut])
+		msg = strings.TrimLeft(line[cut:], " ")
+
+		if i := strings.LastIndexByte(line[:cut], '&'); i >= 0 && i+1 < cut && isHexDigit(line[i+1]) {
+			color = line[i : i+2]
+		}
 	}
 
-	// Change color codes from % to &. E.g. %e becomes &e
-	msg = colorCodeRegex.ReplaceAllString(msg, "&${1}")
+	return append(lines, color+msg)
+}
 
-	p.Cli.WritePacket_Message(-1, msg)
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
 }
 
 func (s *Server) SendAnnouncement(msg string) {
-	for _, p := range s.players {
+	log.Printf("[Server] %v", msg)
+
+	for _, p := range s.Players() {
 		s.SendMessage(p, "&e[Server] "+msg)
 	}
 }
 
-func (s *Server) createBasicTasks(plTaskEnabled bool) {
-	if plTaskEnabled {
+func (s *Server) Scheduler() *TaskScheduler {
+	return s.sch
+}
+
+// Stops the task scheduler, waiting for the current tick and any async tasks to finish.
+func (s *Server) stopScheduler() {
+	s.stopTasks()
+	<-s.tasksDone
+}
+
+// Saves a level to the levels folder, logging any error. Returns false if it could not be saved.
+func (s *Server) SaveLevel(l *Level) bool {
+	l.saving.Lock()
+	defer l.saving.Unlock()
+
+	// Cleared before saving so that changes made while the level is being written aren't lost
+	l.mu.Lock()
+	l.changed = false
+	l.mu.Unlock()
+
+	if l.history != nil {
+		if err := l.history.flush(); err != nil {
+			log.Printf("Could not write the block history of level '%v': %v", l.Name, err)
+		}
+	}
+
+	if err := l.Save(LevelPath(l.Name)); err != nil {
+		l.mu.Lock()
+		l.changed = true
+		l.mu.Unlock()
+
+		log.Printf("Could not save level '%v': %v", l.Name, err)
+		return false
+	}
+
+	log.Printf("Saved level '%v'", l.Name)
+	return true
+}
+
+func (s *Server) createBasicTasks(conf *Config) {
+	if conf.AnnouncePlayers {
 		// Create player announcement task
 		plTask := Task{
 			Id:           "players-announce",
@@ -231,11 +407,16 @@ func (s *Server) createBasicTasks(plTaskEnabled bool) {
 			DelayedStart: true,
 			TaskFunc: func() {
 				playerList := ""
-				for _, player := range s.players {
+				for _, player := range s.Players() {
+					l := player.Level()
+					if l == nil {
+						continue
+					}
+
 					if playerList != "" {
 						playerList += ", "
 					}
-					playerList += player.Username + "[" + strconv.Itoa(int(player.PlayerId)) + "]"
+					playerList += player.Username + "[" + l.Name + "]"
 				}
 
 				// TODO: Print as server message to all players
@@ -245,17 +426,56 @@ func (s *Server) createBasicTasks(plTaskEnabled bool) {
 
 		s.sch.AddTask(plTask)
 	}
-}
 
-var saltRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+-=[]{}\\|;':\",./<>?`~")
+	if conf.AutosaveInterval > 0 {
+		// Create level autosave task
+		saveTask := Task{
+			Id:           "level-autosave",
+			ExecDelay:    int64(conf.AutosaveInterval) * 1000,
+			DelayedStart: true,
+			Async:        true,
+			TaskFunc: func() {
+				for _, l := range s.Levels() {
+					if l.HasChanged() {
+						s.SaveLevel(l)
+					}
+				}
+			},
+		}
+
+		s.sch.AddTask(saveTask)
+	}
+
+	s.createPhysicsTask(int(conf.PhysicsBudget))
 
-// Generates a 256-byte salt
-func GenerateSalt() string {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if s.historyRetention > 0 {
+		// Create block history pruning task
+		pruneTask := Task{
+			Id:           "history-prune",
+			ExecDelay:    3600000, // 1 hour
+			DelayedStart: true,
+			Async:        true,
+			TaskFunc: func() {
+				s.pruneBlockHistory()
+			},
+		}
+
+		s.sch.AddTask(pruneTask)
+	}
+
+	if conf.LevelUnloadDelay > 0 {
+		// Create idle level unload task
+		unloadDelay := time.Duration(conf.LevelUnloadDelay) * time.Second
+		unloadTask := Task{
+			Id:           "level-unload",
+			ExecDelay:    10000, // 10 seconds
+			DelayedStart: true,
+			Async:        true,
+			TaskFunc: func() {
+				s.unloadIdleLevels(unloadDelay)
+			},
+		}
 
-	b := make([]rune, 256)
-	for i := range b {
-		b[i] = saltRunes[r.Intn(len(saltRunes))]
+		s.sch.AddTask(unloadTask)
 	}
-	return string(b)
 }
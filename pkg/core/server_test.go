@@ -0,0 +1,689 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"midnight/pkg/protocol"
+	"midnight/pkg/util"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 20 * time.Second
+
+// Creates a server with a loaded "main" level and an "other" level that's saved but not loaded,
+// running in a temporary folder.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	s := &Server{
+		name:           "Test",
+		maxUsers:       128,
+		defaultPhysics: PhysicsOff,
+		levels:         make(map[string]*Level),
+		loading:        make(map[string]chan struct{}),
+		players:        make(map[string]*Player),
+		sch:            new(TaskScheduler),
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	if s.ranks, err = loadRanks(); err != nil {
+		t.Fatal(err)
+	}
+	if s.bans, s.whitelist, err = loadModeration(); err != nil {
+		t.Fatal(err)
+	}
+
+	main, err := GenerateLevel("main", 64, 32, 64, "flat", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addLevel(main); err != nil {
+		t.Fatal(err)
+	}
+	s.mainLevel = main
+
+	other, err := GenerateLevel("other", 64, 32, 64, "flat", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SaveLevel(other) {
+		t.Fatal("could not save level 'other'")
+	}
+
+	return s
+}
+
+// A simulated player, keeping its own copy of the level like a real client does.
+type testClient struct {
+	name string
+	conn net.Conn
+	done chan struct{} // Closed once the server has finished with the player
+
+	spawned chan Position // Receives the player's spawn point each time a level has been sent
+
+	mu        sync.Mutex
+	level     []byte // The client's copy of the blocks of its level
+	size      [3]int16
+	levelData bytes.Buffer
+	setBlocks int // Number of SetBlock packets received
+	messages  []string
+}
+
+// Connects a player to the server the way a Classic client that has logged in would.
+func joinTestClient(s *Server, name string, ip string) *testClient {
+	serverConn, clientConn := net.Pipe()
+
+	c := &testClient{
+		name:    name,
+		conn:    clientConn,
+		done:    make(chan struct{}),
+		spawned: make(chan Position, 4),
+	}
+	go c.readLoop()
+
+	p := &Player{Cli: NewClient(serverConn), Username: name, IP: ip, Client_Software: "Test"}
+	go func() {
+		s.JoinUser(p)
+		close(c.done)
+	}()
+
+	return c
+}
+
+func (c *testClient) readLoop() {
+	for {
+		var id [1]byte
+		if _, err := io.ReadFull(c.conn, id[:]); err != nil {
+			return
+		}
+
+		body := make([]byte, protocol.Lengths[id[0]]-1)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			return
+		}
+
+		c.handle(id[0], body)
+	}
+}
+
+func (c *testClient) handle(id byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch id {
+	case protocol.IdLevelInitialize:
+		c.level = nil
+		c.levelData.Reset()
+
+	case protocol.IdLevelDataChunk:
+		var pk protocol.LevelDataChunk
+		if pk.Decode(bytes.NewReader(body)) == nil {
+			c.levelData.Write(pk.Data)
+		}
+
+	case protocol.IdLevelFinalize:
+		var pk protocol.LevelFinalize
+		pk.Decode(bytes.NewReader(body))
+
+		gz, err := gzip.NewReader(&c.levelData)
+		if err != nil {
+			return
+		}
+		if data, err := ioutil.ReadAll(gz); err == nil && len(data) >= 4 {
+			c.level = data[4:]
+			c.size = [3]int16{pk.X, pk.Y, pk.Z}
+		}
+
+	case protocol.IdSetBlock:
+		var pk protocol.SetBlock
+		pk.Decode(bytes.NewReader(body))
+		c.setBlocks++
+
+		if c.level != nil && pk.X >= 0 && pk.Y >= 0 && pk.Z >= 0 && pk.X < c.size[0] && pk.Y < c.size[1] && pk.Z < c.size[2] {
+			c.level[int(pk.X)+int(c.size[0])*(int(pk.Z)+int(c.size[2])*int(pk.Y))] = pk.BlockType
+		}
+
+	case protocol.IdSpawnPlayer:
+		var pk protocol.SpawnPlayer
+		pk.Decode(bytes.NewReader(body))
+
+		if pk.PlayerId == -1 {
+			c.spawned <- Position{X: float32(pk.X) / 32, Y: float32(pk.Y) / 32, Z: float32(pk.Z) / 32}
+		}
+
+	case protocol.IdMessage:
+		var pk protocol.Message
+		pk.Decode(bytes.NewReader(body))
+		c.messages = append(c.messages, pk.Message)
+	}
+}
+
+func (c *testClient) send(t *testing.T, pk protocol.Packet) {
+	if err := protocol.Write(c.conn, pk); err != nil {
+		t.Errorf("%v could not send packet [%v]: %v", c.name, pk.Id(), err)
+	}
+}
+
+func (c *testClient) waitSpawn(t *testing.T) (Position, bool) {
+	select {
+	case pos := <-c.spawned:
+		return pos, true
+	case <-time.After(testTimeout):
+		t.Errorf("%v was not sent a level", c.name)
+		return Position{}, false
+	}
+}
+
+func (c *testClient) chat(t *testing.T, msg string) {
+	c.send(t, &protocol.Message{PlayerId: -1, Message: msg})
+}
+
+// Counts the chat messages the client has received that contain text.
+func (c *testClient) countMessages(text string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, msg := range c.messages {
+		if strings.Contains(msg, text) {
+			n++
+		}
+	}
+	return n
+}
+
+// Waits until the client has received n chat messages that contain text.
+func (c *testClient) waitMessages(t *testing.T, text string, n int) bool {
+	deadline := time.Now().Add(testTimeout)
+	for c.countMessages(text) < n {
+		if time.Now().After(deadline) {
+			t.Errorf("%v only received %v of %v messages containing '%v'", c.name, c.countMessages(text), n, text)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Checks that the client's copy of its level matches the server's, and that the server has the player in it.
+func (c *testClient) compareLevel(t *testing.T, s *Server, level string) {
+	l := s.Level(level)
+	if l == nil {
+		t.Errorf("%v is in level '%v', which isn't loaded", c.name, level)
+		return
+	}
+	if p := s.Player(c.name); p == nil || p.Level() != l {
+		t.Errorf("%v should be in level '%v'", c.name, level)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !bytes.Equal(c.level, l.Data) {
+		t.Errorf("%v's copy of level '%v' doesn't match the server's", c.name, level)
+	}
+}
+
+// Dozens of players join, move, chat, change blocks, change levels, reconnect and leave at the same
+// time, while blocks keep changing in both levels. Run with -race. Afterwards every client's copy of
+// its level must match the server's.
+func TestConcurrentClients(t *testing.T) {
+	s := newTestServer(t)
+
+	const numClients = 40
+	const rounds = 24
+
+	// Everyone finishes playing before anyone says they're done, and compares their level before anyone leaves
+	var wg, ready, compared sync.WaitGroup
+	ready.Add(numClients)
+	compared.Add(numClients)
+
+	// Blocks change in both levels the whole time, like they do with physics on
+	editorDone := make(chan struct{})
+	go func() {
+		defer close(editorDone)
+
+		stop := make(chan struct{})
+		go func() {
+			ready.Wait()
+			close(stop)
+		}()
+
+		other, err := s.OpenLevel("other")
+		if err != nil {
+			t.Errorf("could not load level 'other': %v", err)
+			return
+		}
+		editLevels(func() bool { return isClosed(stop) }, time.Millisecond, s.mainLevel, other)
+	}()
+
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var readyOnce, comparedOnce sync.Once
+			defer readyOnce.Do(ready.Done)
+			defer comparedOnce.Do(compared.Done)
+
+			name := fmt.Sprintf("player%02d", i)
+			ip := fmt.Sprintf("127.0.0.%v:%v", i+1, 50000+i)
+			rng := rand.New(rand.NewSource(int64(i)))
+
+			c := joinTestClient(s, name, ip)
+			spawn, ok := c.waitSpawn(t)
+			if !ok {
+				return
+			}
+			level := "main"
+
+			for round := 0; round < rounds; round++ {
+				// Walk around the spawn point
+				x := spawn.X + float32(rng.Intn(3)-1)
+				z := spawn.Z + float32(rng.Intn(3)-1)
+				c.send(t, &protocol.PositionOrientation{PlayerId: -1, X: int16(x * 32), Y: int16(spawn.Y * 32), Z: int16(z * 32), Yaw: byte(rng.Intn(256))})
+
+				// Place or break a block within reach
+				mode, block := byte(1), byte(1+rng.Intn(5))
+				if rng.Intn(3) == 0 {
+					mode = 0
+				}
+				c.send(t, &protocol.SetBlockClient{
+					X: int16(x) + int16(rng.Intn(5)-2), Y: int16(spawn.Y) + int16(rng.Intn(4)-2), Z: int16(z) + int16(rng.Intn(5)-2),
+					Mode: mode, BlockType: block,
+				})
+
+				if round%6 == 0 {
+					c.chat(t, fmt.Sprintf("hello from %v", name))
+				}
+
+				if round%8 == i%8 {
+					level = otherLevel(level)
+					c.chat(t, "/goto "+level)
+					if spawn, ok = c.waitSpawn(t); !ok {
+						return
+					}
+				}
+
+				// Some players log in again from another connection, which replaces the old one
+				if round == rounds/2 && i%5 == 0 {
+					c.conn.Close()
+					<-c.done
+
+					c = joinTestClient(s, name, ip)
+					if spawn, ok = c.waitSpawn(t); !ok {
+						return
+					}
+					level = "main"
+				}
+			}
+
+			readyOnce.Do(ready.Done)
+			ready.Wait()
+			<-editorDone
+
+			// Once every player's done message has arrived, so have all of their block changes
+			c.chat(t, "done-"+name)
+			if !c.waitMessages(t, "done-", numClients) {
+				return
+			}
+			c.compareLevel(t, s, level)
+
+			comparedOnce.Do(compared.Done)
+			compared.Wait()
+
+			c.conn.Close()
+			<-c.done
+		}(i)
+	}
+	wg.Wait()
+
+	if n := s.PlayerCount(); n != 0 {
+		t.Errorf("%v players are still online after everyone left", n)
+	}
+	for _, l := range s.Levels() {
+		l.mu.RLock()
+		if len(l.players) != 0 || len(l.joining) != 0 {
+			t.Errorf("level '%v' still has %v players and %v joining", l.Name, len(l.players), len(l.joining))
+		}
+		l.mu.RUnlock()
+	}
+}
+
+// A player entering a level that keeps changing still ends up with the same blocks as the server,
+// whether the changes made while the level was sent are queued or the level has to be sent again.
+func TestBlockChangesWhileSendingLevel(t *testing.T) {
+	s := newTestServer(t)
+
+	// Lets blocks change while the level is compressed, even with a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Large enough that sending it takes a while
+	big, err := GenerateLevel("big", 256, 64, 256, "flat", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addLevel(big); err != nil {
+		t.Fatal(err)
+	}
+
+	c := joinTestClient(s, "player", "127.0.0.1:50000")
+	if _, ok := c.waitSpawn(t); !ok {
+		return
+	}
+
+	for i := 0; i < 6; i++ {
+		// A few changes are queued; Too many to queue make the level be sent again, from a new copy
+		delay, burst := 100*time.Microsecond, false
+		if i%2 == 1 {
+			delay, burst = 0, true
+		}
+
+		// Blocks only change until the player is in the level, so that the player isn't flooded with them.
+		// Bursts stop after a few times as many changes as can be queued while the level is being sent.
+		changes := 0
+		done := func() bool {
+			if s.Player("player").Level() == big {
+				return true
+			}
+			if !burst {
+				return false
+			}
+
+			big.mu.RLock()
+			sending := len(big.joining) > 0
+			big.mu.RUnlock()
+
+			if sending {
+				changes++
+			}
+			return changes > 4*maxBlockUpdates
+		}
+
+		editing, editorDone := make(chan struct{}), make(chan struct{})
+		go func() {
+			close(editing)
+			editLevels(done, delay, big)
+			close(editorDone)
+		}()
+		<-editing
+
+		c.chat(t, "/goto big")
+		_, ok := c.waitSpawn(t)
+		<-editorDone
+		if !ok {
+			return
+		}
+
+		// The message arrives after every block change made before it was sent
+		c.chat(t, fmt.Sprintf("sent-%v", i))
+		if !c.waitMessages(t, fmt.Sprintf("sent-%v", i), 1) {
+			return
+		}
+		c.compareLevel(t, s, "big")
+
+		c.chat(t, "/goto main")
+		if _, ok := c.waitSpawn(t); !ok {
+			return
+		}
+	}
+
+	c.conn.Close()
+	<-c.done
+}
+
+// Changes random blocks in the levels until done returns true, waiting delay between changes.
+func editLevels(done func() bool, delay time.Duration, levels ...*Level) {
+	rng := rand.New(rand.NewSource(1))
+
+	for !done() {
+		for _, l := range levels {
+			pos := util.Vector3i16{X: int16(rng.Intn(int(l.Size.X))), Y: int16(rng.Intn(int(l.Size.Y))), Z: int16(rng.Intn(int(l.Size.Z)))}
+			l.ChangeBlock(byte(rng.Intn(10)), pos, "")
+		}
+
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func otherLevel(level string) string {
+	if level == "main" {
+		return "other"
+	}
+	return "main"
+}
+
+// Reverting too many blocks to send one by one sends the level again to everyone in it, without holding
+// the level's lock while it's compressed. Blocks changed meanwhile still reach every player.
+func TestRevertWhileChanging(t *testing.T) {
+	s := newTestServer(t)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Large enough that compressing it takes a while
+	big, err := GenerateLevel("big", 256, 64, 256, "flat", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addLevel(big); err != nil {
+		t.Fatal(err)
+	}
+	s.mainLevel = big
+
+	var clients []*testClient
+	for i := 0; i < 3; i++ {
+		c := joinTestClient(s, fmt.Sprintf("player%v", i), fmt.Sprintf("127.0.0.%v:50000", i+1))
+		if _, ok := c.waitSpawn(t); !ok {
+			return
+		}
+		clients = append(clients, c)
+	}
+
+	since := time.Now().Add(-time.Second)
+	for i := 0; i < 2*maxBlockUpdates; i++ {
+		big.ChangeBlock(BlockStone, util.Vector3i16{X: int16(i % 256), Y: 40, Z: int16(i / 256)}, "griefer")
+	}
+
+	// A few hundred blocks change while the level is being sent again
+	reverted, editorDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(editorDone)
+		rng := rand.New(rand.NewSource(1))
+
+		for changes := 0; changes < maxBlockUpdates/4 && !isClosed(reverted); {
+			big.mu.RLock()
+			sending := len(big.joining) > 0
+			big.mu.RUnlock()
+
+			if !sending {
+				runtime.Gosched()
+				continue
+			}
+
+			pos := util.Vector3i16{X: int16(rng.Intn(256)), Y: int16(rng.Intn(64)), Z: int16(rng.Intn(256))}
+			big.ChangeBlock(byte(rng.Intn(10)), pos, "")
+			changes++
+		}
+	}()
+
+	n, err := big.RevertChanges(since, "griefer", "Console")
+	close(reverted)
+	<-editorDone
+
+	if err != nil {
+		t.Fatalf("could not revert: %v", err)
+	}
+	if n <= maxBlockUpdates {
+		t.Errorf("reverted %v blocks; Expected more than %v", n, maxBlockUpdates)
+	}
+
+	// Announcements are sent after the block changes that came before them
+	s.SendAnnouncement("reverted")
+	for _, c := range clients {
+		if c.waitMessages(t, "reverted", 1) {
+			c.compareLevel(t, s, "big")
+		}
+	}
+
+	big.mu.RLock()
+	if len(big.joining) != 0 {
+		t.Errorf("%v players are still waiting for the level", len(big.joining))
+	}
+	big.mu.RUnlock()
+
+	for _, c := range clients {
+		c.conn.Close()
+		<-c.done
+	}
+}
+
+// Loading the same level from many goroutines at once loads it once.
+func TestOpenLevelConcurrently(t *testing.T) {
+	s := newTestServer(t)
+
+	const numLoaders = 32
+
+	var wg sync.WaitGroup
+	levels := make([]*Level, numLoaders)
+	loaded := make([]bool, numLoaders)
+
+	for i := 0; i < numLoaders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			l, wasLoaded, err := s.loadLevel("other")
+			if err != nil {
+				t.Errorf("could not load level: %v", err)
+			}
+			levels[i], loaded[i] = l, wasLoaded
+
+			// Other players keep using the server while the level loads
+			s.Players()
+			s.Levels()
+		}(i)
+	}
+	wg.Wait()
+
+	loads := 0
+	for i := range levels {
+		if levels[i] != levels[0] {
+			t.Errorf("loader %v got a different level", i)
+		}
+		if loaded[i] {
+			loads++
+		}
+	}
+	if loads != 1 {
+		t.Errorf("level was loaded %v times; Expected once", loads)
+	}
+	if len(s.loading) != 0 {
+		t.Errorf("%v levels are still marked as loading", len(s.loading))
+	}
+}
+
+// Creating a level while others create or open a level with the same name adds it only once,
+// and everyone who opens it gets the level that was added.
+func TestNewLevelConcurrently(t *testing.T) {
+	s := newTestServer(t)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	const numCreators = 8
+	const numLoaders = 16
+
+	var wg sync.WaitGroup
+	created := make([]bool, numCreators)
+	levels := make([]*Level, numLoaders)
+
+	for i := 0; i < numCreators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			created[i] = cmdNewLevel(s, Console, []string{"new", "64", "64", "64", "flat"}) == nil
+		}(i)
+	}
+	for i := 0; i < numLoaders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			levels[i], _ = s.OpenLevel("new") // Fails if the level hasn't been created yet
+		}(i)
+	}
+	wg.Wait()
+
+	creates := 0
+	for _, ok := range created {
+		if ok {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Errorf("level was created %v times; Expected once", creates)
+	}
+
+	l := s.Level("new")
+	if l == nil {
+		t.Fatal("level 'new' isn't loaded")
+	}
+	for i, opened := range levels {
+		if opened != nil && opened != l {
+			t.Errorf("loader %v got a different level", i)
+		}
+	}
+	if len(s.loading) != 0 {
+		t.Errorf("%v levels are still marked as loading", len(s.loading))
+	}
+}
+
+// Delays that are negative, too long or overflow are rejected instead of shutting down right away.
+func TestParseShutdownDelay(t *testing.T) {
+	valid := map[string]time.Duration{"0": 0, "30": 30 * time.Second, "86400": maxShutdownDelay, "5m": 5 * time.Minute, "1d": maxShutdownDelay}
+	for str, expected := range valid {
+		if d, err := parseShutdownDelay(str); err != nil || d != expected {
+			t.Errorf("'%v' is %v (%v); Expected %v", str, d, err, expected)
+		}
+	}
+
+	for _, str := range []string{"-1", "86401", "10000000000", "18446744074", "99999999999999999999", "2d", "10y", "5x"} {
+		if d, err := parseShutdownDelay(str); err == nil {
+			t.Errorf("'%v' should be rejected, got %v", str, d)
+		}
+	}
+
+	s := newTestServer(t)
+	if err := s.ScheduleShutdown(-time.Second, "", false); err == nil {
+		t.Error("a negative delay should be rejected")
+	}
+}
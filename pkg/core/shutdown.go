@@ -0,0 +1,138 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Exit codes returned by Wait. A process supervisor or start script can start the server again on ExitRestart.
+const (
+	ExitShutdown = 0 // Shut down normally
+	ExitError    = 1 // Shut down, but a level could not be saved
+	ExitRestart  = 3 // Shut down so that the server can be started again
+)
+
+// Seconds left at which a scheduled shutdown is announced
+var shutdownWarnings = []int{600, 300, 120, 60, 30, 15, 10, 5, 4, 3, 2, 1}
+
+// Stops the server: Stops accepting clients, stops the task scheduler and heartbeat, kicks every
+// player with the reason, then saves every changed level. Wait returns once it's done.
+// Only the first call does anything. Don't call it from a task, which the scheduler would wait on; Use go s.Shutdown instead.
+func (s *Server) Shutdown(reason string, restart bool) {
+	s.shutdownOnce.Do(func() {
+		if restart {
+			log.Printf("Restarting server: %v", reason)
+		} else {
+			log.Printf("Shutting down server: %v", reason)
+		}
+
+		close(s.quit)
+
+		if err := s.ch.Listener.Close(); err != nil {
+			log.Printf("Could not close the listener: %v", err)
+		}
+
+		s.stopScheduler()
+
+		players := s.Players()
+		for _, p := range players {
+			s.disconnectPlayer(p, reason)
+		}
+
+		code := ExitShutdown
+		if restart {
+			code = ExitRestart
+		}
+
+		for _, l := range s.Levels() {
+			if l.HasChanged() {
+				if !s.SaveLevel(l) {
+					code = ExitError
+				}
+			} else if l.history != nil {
+				if err := l.history.flush(); err != nil {
+					log.Printf("Could not write the block history of level '%v': %v", l.Name, err)
+				}
+			}
+		}
+
+		// Give the kick packets a chance to reach the players; Close gives up on slow clients after closeTimeout
+		for _, p := range players {
+			p.Cli.WaitClosed()
+		}
+
+		s.exitCode = code
+		close(s.done)
+	})
+}
+
+// Returns true once the server has begun shutting down.
+func (s *Server) Stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the server to shut down. Returns the code the process should exit with.
+func (s *Server) Wait() int {
+	<-s.done
+	return s.exitCode
+}
+
+// Longest delay a shutdown can be scheduled with
+const maxShutdownDelay = 24 * time.Hour
+
+// Shuts down the server after a delay of up to maxShutdownDelay, announcing the time left in chat.
+// Scheduling another shutdown replaces this one.
+func (s *Server) ScheduleShutdown(delay time.Duration, reason string, restart bool) error {
+	if delay < 0 || delay > maxShutdownDelay {
+		return fmt.Errorf("the delay must be from 0 to %v", formatDuration(maxShutdownDelay))
+	}
+
+	action := "shutting down"
+	if restart {
+		action = "restarting"
+	}
+
+	end := time.Now().Add(delay)
+	lastWarning := -1
+
+	s.sch.AddTask(Task{
+		Id:        "shutdown",
+		ExecDelay: 250,
+		TaskFunc: func() {
+			left := time.Until(end)
+			if left <= 0 {
+				s.sch.RemoveTask("shutdown")
+				go s.Shutdown(reason, restart)
+				return
+			}
+
+			// Announced when scheduled, then at each warning
+			secs := int((left + time.Second - 1) / time.Second)
+			if lastWarning == -1 || secs != lastWarning && isShutdownWarning(secs) {
+				s.SendAnnouncement(fmt.Sprintf("&cServer %v in %v: %v", action, formatDuration(time.Duration(secs)*time.Second), reason))
+				lastWarning = secs
+			}
+		},
+	})
+	return nil
+}
+
+func isShutdownWarning(secs int) bool {
+	for _, w := range shutdownWarnings {
+		if secs == w {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancels a scheduled shutdown. Returns false if none was scheduled.
+func (s *Server) CancelShutdown() bool {
+	return s.sch.RemoveTask("shutdown")
+}
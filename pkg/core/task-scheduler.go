@@ -1,68 +1,281 @@
 package core
 
 import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	TicksPerSecond = 20
+	TickInterval   = time.Second / TicksPerSecond
+)
+
+// Ticks that take longer than this are logged
+const slowTickWarning = 2 * time.Second
+
 type Task struct {
-	Id           string
-	ExecDelay    int64
-	LastExec     int64 `default:"0"`
-	DelayedStart bool  `default:"false"`
-	Enabled      bool  `default:"true"`
-	Executing    bool  `default:"false"`
+	Id           string // Name used to remove, enable or disable the task; Adding a task with the Id of another replaces it
+	ExecDelay    int64  // Milliseconds between runs, or before the run of a one-shot task with DelayedStart
+	DelayedStart bool   // If set, the first run waits for ExecDelay; Otherwise it happens on the next tick
+	OneShot      bool   // If set, the task runs once and is then removed
+	Async        bool   // If set, the task runs in its own goroutine instead of on the tick loop. Runs are skipped while it's still running.
 	TaskFunc     func()
 }
 
+type scheduledTask struct {
+	Task
+	nextExec time.Time
+	disabled bool
+	running  int32 // Set while an async run is going; Accessed atomically
+}
+
+// A scheduled task as it was when Tasks was called.
+type TaskStatus struct {
+	Task
+	NextRun  time.Time // Zero if the task runs on the next tick
+	Disabled bool
+	Running  bool // Set while an async run is going
+}
+
 type TaskScheduler struct {
-	tasks []Task
+	mu    sync.Mutex // Guards everything below; Tasks can be added and removed from any goroutine
+	tasks []*scheduledTask
+
+	tick      uint64
+	lastTick  time.Time
+	tickTime  time.Duration // Average time between ticks
+	workTime  time.Duration // Average time spent running tasks each tick
+	asyncRuns sync.WaitGroup
 }
 
-func (ts *TaskScheduler) StartServerTickLoop() {
+// Runs the tick loop until ctx is done, then waits for async tasks that are still running.
+func (ts *TaskScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(TickInterval)
+	defer ticker.Stop()
+
 	for {
-		for c, task := range ts.tasks {
-			if task.LastExec == 0 && task.DelayedStart { // Newly added task; Check for delayed start.
-				ts.tasks[c].LastExec = (time.Now().UnixNano() / 1000000)
-				continue
-			}
+		select {
+		case <-ctx.Done():
+			ts.asyncRuns.Wait()
+			return
+		case now := <-ticker.C:
+			ts.runTick(now)
+		}
+	}
+}
+
+func (ts *TaskScheduler) runTick(now time.Time) {
+	var due []*scheduledTask
+
+	ts.mu.Lock()
+	ts.tick++
+	if !ts.lastTick.IsZero() {
+		ts.tickTime = movingAverage(ts.tickTime, now.Sub(ts.lastTick))
+	}
+	ts.lastTick = now
+
+	// Tasks due within half a tick run now, so that jitter in the ticker doesn't delay them by a whole tick
+	cutoff := now.Add(TickInterval / 2)
+
+	kept := ts.tasks[:0]
+	for _, task := range ts.tasks {
+		if task.disabled || cutoff.Before(task.nextExec) {
+			kept = append(kept, task)
+			continue
+		}
+
+		due = append(due, task)
+		if !task.OneShot {
+			task.nextExec = now.Add(time.Duration(task.ExecDelay) * time.Millisecond)
+			kept = append(kept, task)
+		}
+	}
+	for i := len(kept); i < len(ts.tasks); i++ {
+		ts.tasks[i] = nil
+	}
+	ts.tasks = kept
+	ts.mu.Unlock()
+
+	// Tasks run without the lock held so they can add and remove tasks themselves
+	for _, task := range due {
+		if task.Async {
+			ts.runAsync(task)
+		} else {
+			runTask(task)
+		}
+	}
+
+	work := time.Since(now)
+	if work > slowTickWarning {
+		log.Printf("Can't keep up! Tick %v took %v", ts.Tick(), work.Round(time.Millisecond))
+	}
+
+	metricTickDuration.ObserveDuration(work)
 
-			// Check if task needs to be executed
-			if task.LastExec+task.ExecDelay < time.Now().UnixNano()/1000000 {
-				if task.Executing {
-					continue
-				}
+	ts.mu.Lock()
+	ts.workTime = movingAverage(ts.workTime, work)
+	ts.mu.Unlock()
+}
+
+func (ts *TaskScheduler) runAsync(task *scheduledTask) {
+	if !atomic.CompareAndSwapInt32(&task.running, 0, 1) {
+		return // The last run hasn't finished
+	}
 
-				ts.tasks[c].LastExec = time.Now().UnixNano() / 1000000
+	ts.asyncRuns.Add(1)
+	go func() {
+		defer ts.asyncRuns.Done()
+		defer atomic.StoreInt32(&task.running, 0)
+
+		runTask(task)
+	}()
+}
+
+// Runs a task, logging it if it panics so that one broken task can't stop the others.
+func runTask(task *scheduledTask) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Task '%v' panicked: %v\n%s", task.Id, err, debug.Stack())
+		}
+	}()
 
-				ts.tasks[c].Executing = true
-				task.TaskFunc()
-				ts.tasks[c].Executing = false
+	task.TaskFunc()
+}
+
+// Averages over roughly the last 100 ticks.
+func movingAverage(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return avg + (sample-avg)/100
+}
+
+// Schedules a task. A task with the same Id as one already scheduled replaces it.
+func (ts *TaskScheduler) AddTask(task Task) {
+	st := &scheduledTask{Task: task}
+	if task.DelayedStart {
+		st.nextExec = time.Now().Add(time.Duration(task.ExecDelay) * time.Millisecond)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if task.Id != "" {
+		for i, other := range ts.tasks {
+			if other.Id == task.Id {
+				ts.tasks[i] = st
+				return
 			}
 		}
-		time.Sleep(50) // 20 ticks in a second; 1000 / 20
 	}
+	ts.tasks = append(ts.tasks, st)
 }
 
-func (s *TaskScheduler) AddTask(task Task) {
-	s.tasks = append(s.tasks, task)
+// Runs a function once on the tick loop after a delay.
+func (ts *TaskScheduler) RunLater(delay time.Duration, fn func()) {
+	ts.AddTask(Task{
+		ExecDelay:    delay.Milliseconds(),
+		DelayedStart: true,
+		OneShot:      true,
+		TaskFunc:     fn,
+	})
 }
 
-func (s *TaskScheduler) DisableTask(taskId string) bool {
-	for _, task := range s.tasks {
+// Unschedules a task. A run of an async task that's already going isn't stopped.
+func (ts *TaskScheduler) RemoveTask(taskId string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for i, task := range ts.tasks {
 		if task.Id == taskId {
-			task.Enabled = false
+			ts.tasks = append(ts.tasks[:i], ts.tasks[i+1:]...)
 			return true
 		}
 	}
 	return false
 }
 
-func (s *TaskScheduler) EnableTask(taskId string) bool {
-	for _, task := range s.tasks {
+func (ts *TaskScheduler) DisableTask(taskId string) bool {
+	return ts.setDisabled(taskId, true)
+}
+
+func (ts *TaskScheduler) EnableTask(taskId string) bool {
+	return ts.setDisabled(taskId, false)
+}
+
+func (ts *TaskScheduler) setDisabled(taskId string, disabled bool) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, task := range ts.tasks {
 		if task.Id == taskId {
-			task.Enabled = true
+			task.disabled = disabled
 			return true
 		}
 	}
 	return false
 }
+
+// Returns the scheduled tasks in the order they run each tick.
+func (ts *TaskScheduler) Tasks() []TaskStatus {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tasks := make([]TaskStatus, len(ts.tasks))
+	for i, task := range ts.tasks {
+		tasks[i] = TaskStatus{
+			Task:     task.Task,
+			NextRun:  task.nextExec,
+			Disabled: task.disabled,
+			Running:  atomic.LoadInt32(&task.running) == 1,
+		}
+	}
+	return tasks
+}
+
+// Returns the number of ticks run so far.
+func (ts *TaskScheduler) Tick() uint64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.tick
+}
+
+// Returns the average number of ticks per second, which is below TicksPerSecond when ticks take too long.
+func (ts *TaskScheduler) TPS() float64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.tickTime == 0 {
+		return TicksPerSecond
+	}
+
+	tps := float64(time.Second) / float64(ts.tickTime)
+	if tps > TicksPerSecond {
+		tps = TicksPerSecond
+	}
+	return tps
+}
+
+// Returns the average time between ticks.
+func (ts *TaskScheduler) tickInterval() time.Duration {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.tickTime == 0 {
+		return TickInterval
+	}
+	return ts.tickTime
+}
+
+// Returns the average time spent running tasks each tick.
+func (ts *TaskScheduler) TickTime() time.Duration {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.workTime
+}
@@ -0,0 +1,267 @@
+package httpapi
+
+import (
+	"log"
+	"midnight/pkg/core"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type statusJSON struct {
+	Name       string  `json:"name"`
+	Players    int     `json:"players"`
+	MaxPlayers int     `json:"max_players"`
+	Levels     int     `json:"levels"`
+	TPS        float64 `json:"tps"`
+	TickTimeMs float64 `json:"tick_time_ms"` // Average time spent running tasks each tick
+	Stopping   bool    `json:"stopping"`
+}
+
+type playerJSON struct {
+	Name     string       `json:"name"`
+	IP       string       `json:"ip"`
+	Level    string       `json:"level"`
+	Position positionJSON `json:"position"`
+	Client   string       `json:"client"`
+	Rank     string       `json:"rank"`
+}
+
+type positionJSON struct {
+	X     float32 `json:"x"`
+	Y     float32 `json:"y"`
+	Z     float32 `json:"z"`
+	Yaw   byte    `json:"yaw"`
+	Pitch byte    `json:"pitch"`
+}
+
+type levelJSON struct {
+	Name    string `json:"name"`
+	Width   int16  `json:"width"`
+	Height  int16  `json:"height"`
+	Length  int16  `json:"length"`
+	Players int    `json:"players"`
+	Changed bool   `json:"changed"` // Set if it has changes that haven't been saved
+	Physics string `json:"physics"`
+}
+
+type taskJSON struct {
+	Id       string     `json:"id"`
+	Interval int64      `json:"interval_ms"`
+	OneShot  bool       `json:"one_shot"`
+	Async    bool       `json:"async"`
+	Disabled bool       `json:"disabled"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+func (srv *Server) handleStatus(r *http.Request) (interface{}, error) {
+	sch := srv.s.Scheduler()
+
+	return statusJSON{
+		Name:       srv.conf.ServerName,
+		Players:    srv.s.PlayerCount(),
+		MaxPlayers: int(srv.conf.MaxUsers),
+		Levels:     len(srv.s.Levels()),
+		TPS:        sch.TPS(),
+		TickTimeMs: float64(sch.TickTime()) / float64(time.Millisecond),
+		Stopping:   srv.s.Stopping(),
+	}, nil
+}
+
+func (srv *Server) handlePlayers(r *http.Request) (interface{}, error) {
+	players := []playerJSON{}
+
+	for _, p := range srv.s.Players() {
+		pj := playerJSON{
+			Name:   p.Username,
+			IP:     p.IP,
+			Client: p.Client_Software,
+		}
+		if l := p.Level(); l != nil {
+			pj.Level = l.Name
+		}
+		if rank := p.Rank(); rank != nil {
+			pj.Rank = rank.Name
+		}
+
+		pos := p.Position()
+		pj.Position = positionJSON{X: pos.X, Y: pos.Y, Z: pos.Z, Yaw: pos.Yaw, Pitch: pos.Pitch}
+
+		players = append(players, pj)
+	}
+
+	return players, nil
+}
+
+func (srv *Server) handleLevels(r *http.Request) (interface{}, error) {
+	levels := []levelJSON{}
+
+	for _, l := range srv.s.Levels() {
+		levels = append(levels, levelJSONFor(l))
+	}
+
+	return levels, nil
+}
+
+func levelJSONFor(l *core.Level) levelJSON {
+	return levelJSON{
+		Name:    l.Name,
+		Width:   l.Size.X,
+		Height:  l.Size.Y,
+		Length:  l.Size.Z,
+		Players: l.PlayerCount(),
+		Changed: l.HasChanged(),
+		Physics: l.PhysicsMode().String(),
+	}
+}
+
+func (srv *Server) handleTasks(r *http.Request) (interface{}, error) {
+	tasks := []taskJSON{}
+
+	for _, t := range srv.s.Scheduler().Tasks() {
+		tj := taskJSON{
+			Id:       t.Id,
+			Interval: t.ExecDelay,
+			OneShot:  t.OneShot,
+			Async:    t.Async,
+			Disabled: t.Disabled,
+			Running:  t.Running,
+		}
+		if !t.NextRun.IsZero() {
+			next := t.NextRun
+			tj.NextRun = &next
+		}
+
+		tasks = append(tasks, tj)
+	}
+
+	return tasks, nil
+}
+
+func (srv *Server) handleHeartbeats(r *http.Request) (interface{}, error) {
+	return srv.s.Heartbeats(), nil
+}
+
+func (srv *Server) handleConfig(r *http.Request) (interface{}, error) {
+	conf := *srv.conf
+	conf.RCON.Password = redact(conf.RCON.Password)
+	conf.HTTPAPI.Token = redact(conf.HTTPAPI.Token)
+	conf.Debug.Salt = redact(conf.Debug.Salt)
+
+	return conf, nil
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+func (srv *Server) handleKick(r *http.Request) (interface{}, error) {
+	var req struct {
+		Name   string `json:"name"`
+		Reason string `json:"reason"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+
+	p := srv.s.Player(req.Name)
+	if p == nil {
+		return nil, notFound(req.Name + " is not online")
+	}
+
+	srv.s.Kick(p, req.Reason, issuer)
+	return map[string]string{"kicked": p.Username}, nil
+}
+
+func (srv *Server) handleBan(r *http.Request) (interface{}, error) {
+	var req struct {
+		Name     string `json:"name"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, badRequest("name is required")
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := core.ParseDuration(req.Duration)
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		duration = d
+	}
+
+	name := req.Name
+	if p := srv.s.Player(name); p != nil {
+		name = p.Username
+	}
+
+	ban, err := srv.s.BanName(name, req.Reason, issuer, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%v banned %v: %v", issuer, name, req.Reason)
+	return ban, nil
+}
+
+func (srv *Server) handleAnnounce(r *http.Request) (interface{}, error) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		return nil, badRequest("message is required")
+	}
+
+	srv.s.SendAnnouncement(req.Message)
+	return map[string]string{"announced": req.Message}, nil
+}
+
+func (srv *Server) handleSaveLevel(r *http.Request) (interface{}, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+
+	l := srv.s.Level(req.Name)
+	if l == nil {
+		return nil, notFound("there is no loaded level named '" + req.Name + "'")
+	}
+
+	if !srv.s.SaveLevel(l) {
+		return nil, &apiError{http.StatusInternalServerError, "could not save level '" + l.Name + "'"}
+	}
+	return levelJSONFor(l), nil
+}
+
+func (srv *Server) handleLoadLevel(r *http.Request) (interface{}, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+
+	l, err := srv.s.OpenLevel(req.Name)
+	if os.IsNotExist(err) {
+		return nil, notFound("there is no level named '" + req.Name + "'")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return levelJSONFor(l), nil
+}
@@ -0,0 +1,172 @@
+// Package httpapi serves the server's state and admin actions as JSON, for dashboards and bots.
+// Every request must carry the token from server.json as "Authorization: Bearer <token>".
+//
+//	GET  /api/status         Server name, player count, TPS and tick time
+//	GET  /api/players        Online players
+//	GET  /api/levels         Loaded levels
+//	GET  /api/tasks          Scheduled tasks
+//	GET  /api/heartbeats     Server lists, with the server's URL on each and the last heartbeat error
+//	GET  /api/config         server.json, without passwords and tokens
+//	POST /api/players/kick   {"name": "...", "reason": "..."}
+//	POST /api/players/ban    {"name": "...", "reason": "...", "duration": "2d"}; Leave out duration to ban permanently
+//	POST /api/announce       {"message": "..."}
+//	POST /api/levels/save    {"name": "..."}
+//	POST /api/levels/load    {"name": "..."}
+//
+// Errors are returned as {"error": "..."} with a matching status code.
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"midnight/pkg/core"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest request body that's read
+const maxBodySize = 64 << 10
+
+// Name that actions taken through the API are logged under
+const issuer = "HTTP API"
+
+type Server struct {
+	s     *core.Server
+	conf  *core.Config
+	token [sha256.Size]byte // Hashed so comparing it doesn't reveal its length
+	http  *http.Server
+}
+
+// Starts serving the API on addr.
+func Listen(s *core.Server, conf *core.Config, addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{s: s, conf: conf, token: sha256.Sum256([]byte(conf.HTTPAPI.Token))}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", get(srv.handleStatus))
+	mux.HandleFunc("/api/players", get(srv.handlePlayers))
+	mux.HandleFunc("/api/levels", get(srv.handleLevels))
+	mux.HandleFunc("/api/tasks", get(srv.handleTasks))
+	mux.HandleFunc("/api/heartbeats", get(srv.handleHeartbeats))
+	mux.HandleFunc("/api/config", get(srv.handleConfig))
+	mux.HandleFunc("/api/players/kick", post(srv.handleKick))
+	mux.HandleFunc("/api/players/ban", post(srv.handleBan))
+	mux.HandleFunc("/api/announce", post(srv.handleAnnounce))
+	mux.HandleFunc("/api/levels/save", post(srv.handleSaveLevel))
+	mux.HandleFunc("/api/levels/load", post(srv.handleLoadLevel))
+
+	srv.http = &http.Server{
+		Handler:      srv.authenticate(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		if err := srv.http.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("HTTP API stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Started HTTP API on %v", listener.Addr())
+	return srv, nil
+}
+
+// Stops the API, letting requests that are being handled finish.
+func (srv *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return srv.http.Shutdown(ctx)
+}
+
+// An error with the status code it's returned with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func badRequest(msg string) error { return &apiError{http.StatusBadRequest, msg} }
+func notFound(msg string) error   { return &apiError{http.StatusNotFound, msg} }
+
+// Handles a request, returning the value to send back as JSON.
+type handlerFunc func(r *http.Request) (interface{}, error)
+
+func (srv *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare(token[:], srv.token[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func get(fn handlerFunc) http.HandlerFunc {
+	return handle(http.MethodGet, fn)
+}
+
+func post(fn handlerFunc) http.HandlerFunc {
+	return handle(http.MethodPost, fn)
+}
+
+func handle(method string, fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		result, err := fn(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				status = apiErr.status
+			}
+
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// Decodes a request's JSON body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: " + err.Error())
+	}
+	return nil
+}
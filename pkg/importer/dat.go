@@ -0,0 +1,185 @@
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"midnight/pkg/core"
+	"os"
+	"sort"
+)
+
+// Minecraft Classic (.dat/.mine) level format
+//
+// A gzip stream starting with the big-endian magic number 0x271BB788 and a version byte.
+// Version 1 files contain a fixed header followed by the blocks. Version 2 files contain a
+// serialized com.mojang.minecraft.level.Level Java object.
+//
+// Classic calls the horizontal Z axis "height" and the vertical Y axis "depth".
+
+const (
+	datMagic     = 0x271BB788
+	datLevelName = "com.mojang.minecraft.level.Level"
+)
+
+// Level fields that are read; Any other field that holds data is reported as ignored
+var datImportedFields = map[string]bool{
+	"width": true, "height": true, "depth": true, "blocks": true,
+	"xSpawn": true, "ySpawn": true, "zSpawn": true, "rotSpawn": true,
+	"name": true, "creator": true, "createTime": true,
+}
+
+func ImportDat(path string, name string) (*core.Level, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	r := bufio.NewReader(gz)
+
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[:]) != datMagic {
+		return nil, nil, errors.New("not a Minecraft Classic level")
+	}
+
+	switch header[4] {
+	case 1:
+		return importDatV1(r, name)
+	case 2:
+		return importDatV2(r, name)
+	}
+
+	return nil, nil, fmt.Errorf("unsupported Minecraft Classic level version [%v]", header[4])
+}
+
+func importDatV1(r io.Reader, name string) (*core.Level, []string, error) {
+	jr := &javaReader{r: r}
+
+	// Level name, creator and creation time
+	if _, err := jr.readUTF(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := jr.readUTF(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := jr.readU64(); err != nil {
+		return nil, nil, err
+	}
+
+	var dims [3]uint16
+	for i := range dims {
+		v, err := jr.readU16()
+		if err != nil {
+			return nil, nil, err
+		}
+		dims[i] = v
+	}
+
+	l, err := newLevel(name, int(dims[0]), int(dims[2]), int(dims[1]))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := io.ReadFull(r, l.Data); err != nil {
+		return nil, nil, fmt.Errorf("could not read blocks: %v", err)
+	}
+
+	// Version 1 levels don't store a spawn point, so the default from ConstructLevel is kept
+	warnings := []string{"level has no spawn point; Using the center of the level"}
+	warnings = append(warnings, replaceUnknownBlocks(l.Data)...)
+
+	return l, warnings, nil
+}
+
+func importDatV2(r io.Reader, name string) (*core.Level, []string, error) {
+	jr, err := newJavaReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := jr.readContent()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, ok := content.(*javaObject)
+	if !ok || obj.class.name != datLevelName {
+		return nil, nil, errors.New("file does not contain a Minecraft Classic level object")
+	}
+
+	width, okX := obj.fields["width"].(int32)
+	depth, okY := obj.fields["depth"].(int32)
+	height, okZ := obj.fields["height"].(int32)
+	blocks, okBlocks := obj.fields["blocks"].([]byte)
+
+	if !okX || !okY || !okZ || !okBlocks {
+		return nil, nil, errors.New("level object is missing its dimensions or blocks")
+	}
+
+	l, err := newLevel(name, int(width), int(depth), int(height))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if int32(len(blocks)) != l.BlocksTotal {
+		return nil, nil, fmt.Errorf("level has %v blocks; Expected %v", len(blocks), l.BlocksTotal)
+	}
+	copy(l.Data, blocks)
+
+	var warnings []string
+
+	xSpawn, okX := obj.fields["xSpawn"].(int32)
+	ySpawn, okY := obj.fields["ySpawn"].(int32)
+	zSpawn, okZ := obj.fields["zSpawn"].(int32)
+
+	if okX && okY && okZ {
+		l.SpawnPos[0] = float32(xSpawn)
+		l.SpawnPos[1] = float32(ySpawn)
+		l.SpawnPos[2] = float32(zSpawn)
+	} else {
+		warnings = append(warnings, "level has no spawn point; Using the center of the level")
+	}
+
+	if rot, ok := obj.fields["rotSpawn"].(float32); ok {
+		l.SpawnYaw = packAngle(rot)
+	}
+
+	var ignored []string
+	for field, v := range obj.fields {
+		if !datImportedFields[field] && isJavaObject(v) {
+			ignored = append(ignored, field)
+		}
+	}
+	sort.Strings(ignored)
+
+	if len(ignored) > 0 {
+		warnings = append(warnings, fmt.Sprintf("ignored level data that isn't supported (entities, environment, etc.): %v", ignored))
+	}
+
+	warnings = append(warnings, replaceUnknownBlocks(l.Data)...)
+
+	return l, warnings, nil
+}
+
+// Returns true for values that hold structured data rather than a simple setting.
+func isJavaObject(v interface{}) bool {
+	switch v.(type) {
+	case *javaObject, []interface{}:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"midnight/pkg/core"
+	"os"
+)
+
+// fCraft (.fcm) level format, version 3
+//
+// A little-endian header, followed by a deflate stream holding the metadata and the block array:
+//
+//	u32 0x0FC2AF40, u8 revision (13)
+//	u16 width (X), u16 height (Y), u16 length (Z)
+//	u16 spawn X, u16 spawn Y, u16 spawn Z (fixed point, 1/32 of a block)
+//	u8 spawn yaw, u8 spawn pitch
+//	u32 modified time, u32 created time, u8[16] UUID
+//	u8 layer count, layer index
+//	u32 metadata entry count
+//
+// Each metadata entry is three u16 length-prefixed strings: group, key and value.
+
+const (
+	fcmIdentifier    = 0x0FC2AF40
+	fcmRevision      = 13
+	fcmHeaderLength  = 79
+	fcmLayerIndexEnd = 75
+)
+
+func ImportFcm(path string, name string) (*core.Level, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	header := make([]byte, fcmHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header) != fcmIdentifier {
+		return nil, nil, errors.New("not an fCraft level, or an fCraft level older than version 3")
+	}
+	if header[4] != fcmRevision {
+		return nil, nil, fmt.Errorf("unsupported fCraft level revision [%v]", header[4])
+	}
+
+	sizeX := int(binary.LittleEndian.Uint16(header[5:]))
+	sizeY := int(binary.LittleEndian.Uint16(header[7:]))
+	sizeZ := int(binary.LittleEndian.Uint16(header[9:]))
+
+	l, err := newLevel(name, sizeX, sizeY, sizeZ)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.SpawnPos[0] = float32(int16(binary.LittleEndian.Uint16(header[11:]))) / 32
+	l.SpawnPos[1] = float32(int16(binary.LittleEndian.Uint16(header[13:]))) / 32
+	l.SpawnPos[2] = float32(int16(binary.LittleEndian.Uint16(header[15:]))) / 32
+	l.SpawnYaw = header[17]
+	l.SpawnPitch = header[18]
+	copy(l.UUID[:], header[27:43])
+
+	var warnings []string
+
+	if layers := header[43]; layers != 1 {
+		warnings = append(warnings, fmt.Sprintf("level has %v data layers; Only the block layer is imported", layers))
+	}
+
+	metadataCount := int(binary.LittleEndian.Uint32(header[fcmLayerIndexEnd:]))
+
+	ds := flate.NewReader(r)
+	defer ds.Close()
+
+	dr := bufio.NewReader(ds)
+
+	for i := 0; i < metadataCount; i++ {
+		for field := 0; field < 3; field++ { // Group, key and value
+			if err := skipFcmString(dr); err != nil {
+				return nil, nil, fmt.Errorf("could not read metadata: %v", err)
+			}
+		}
+	}
+
+	if metadataCount > 0 {
+		warnings = append(warnings, fmt.Sprintf("ignored %v metadata entries (zones, permissions, environment, etc.)", metadataCount))
+	}
+
+	if _, err := io.ReadFull(dr, l.Data); err != nil {
+		return nil, nil, fmt.Errorf("could not read blocks: %v", err)
+	}
+
+	warnings = append(warnings, replaceUnknownBlocks(l.Data)...)
+
+	return l, warnings, nil
+}
+
+func skipFcmString(r *bufio.Reader) error {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+
+	_, err := r.Discard(int(binary.LittleEndian.Uint16(length[:])))
+	return err
+}
@@ -0,0 +1,59 @@
+// Package importer reads levels saved by other Classic servers and clients.
+//
+// Importing this package registers its formats with core, so that core.FindLevel
+// converts them to ClassicWorld the first time they're loaded:
+//
+//	import _ "midnight/pkg/importer"
+package importer
+
+import (
+	"fmt"
+	"midnight/pkg/core"
+)
+
+func init() {
+	core.RegisterLevelImporter(".lvl", ImportLvl)
+	core.RegisterLevelImporter(".dat", ImportDat)
+	core.RegisterLevelImporter(".mine", ImportDat)
+	core.RegisterLevelImporter(".fcm", ImportFcm)
+}
+
+// Creates an empty level, checking that the dimensions fit in a Classic level.
+func newLevel(name string, x, y, z int) (*core.Level, error) {
+	if x <= 0 || y <= 0 || z <= 0 || x > 32767 || y > 32767 || z > 32767 {
+		return nil, fmt.Errorf("invalid level dimensions [%v, %v, %v]", x, y, z)
+	}
+
+	if int64(x)*int64(y)*int64(z) > 1<<31-1 {
+		return nil, fmt.Errorf("level dimensions too large [%v, %v, %v]", x, y, z)
+	}
+
+	l := core.ConstructLevel(name, int16(x), int16(y), int16(z))
+	l.Data = make([]byte, l.BlocksTotal)
+
+	return l, nil
+}
+
+// Replaces block IDs that aren't part of Classic or CustomBlocks with stone.
+// Returns a warning if any blocks were replaced.
+func replaceUnknownBlocks(data []byte) []string {
+	replaced := make(map[byte]int)
+
+	for i, b := range data {
+		if b > core.MaxCPEBlockId {
+			replaced[b]++
+			data[i] = core.BlockStone
+		}
+	}
+
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("replaced unknown block IDs with stone (ID: count) %v", replaced)}
+}
+
+// Converts an angle in degrees to the packed byte used by the protocol.
+func packAngle(degrees float32) byte {
+	return byte(int(degrees*256/360) & 0xFF)
+}
@@ -0,0 +1,457 @@
+package importer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// A minimal reader for Java's object serialization stream format, enough to read
+// the com.mojang.minecraft.level.Level objects saved by Minecraft Classic.
+// Reference Page: https://docs.oracle.com/javase/8/docs/platform/serialization/spec/protocol.html
+
+const (
+	javaStreamMagic   = 0xACED
+	javaStreamVersion = 5
+
+	tcNull           = 0x70
+	tcReference      = 0x71
+	tcClassDesc      = 0x72
+	tcObject         = 0x73
+	tcString         = 0x74
+	tcArray          = 0x75
+	tcClass          = 0x76
+	tcBlockData      = 0x77
+	tcEndBlockData   = 0x78
+	tcReset          = 0x79
+	tcBlockDataLong  = 0x7A
+	tcLongString     = 0x7C
+	tcProxyClassDesc = 0x7D
+	tcEnum           = 0x7E
+
+	javaBaseHandle = 0x7E0000
+
+	scWriteMethod    = 0x01
+	scSerializable   = 0x02
+	scExternalizable = 0x04
+)
+
+type javaField struct {
+	typeCode  byte
+	name      string
+	className string
+}
+
+type javaClass struct {
+	name   string
+	flags  byte
+	fields []javaField
+	super  *javaClass
+}
+
+type javaObject struct {
+	class  *javaClass
+	fields map[string]interface{} // Field values of the object's class and its superclasses
+}
+
+type javaReader struct {
+	r       io.Reader
+	handles []interface{}
+	depth   int
+}
+
+func newJavaReader(r io.Reader) (*javaReader, error) {
+	jr := &javaReader{r: r}
+
+	magic, err := jr.readU16()
+	if err != nil {
+		return nil, err
+	}
+	version, err := jr.readU16()
+	if err != nil {
+		return nil, err
+	}
+
+	if magic != javaStreamMagic || version != javaStreamVersion {
+		return nil, errors.New("not a Java serialization stream")
+	}
+
+	return jr, nil
+}
+
+func (jr *javaReader) readU8() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(jr.r, b[:])
+	return b[0], err
+}
+
+func (jr *javaReader) readU16() (uint16, error) {
+	var b [2]byte
+	_, err := io.ReadFull(jr.r, b[:])
+	return binary.BigEndian.Uint16(b[:]), err
+}
+
+func (jr *javaReader) readU32() (uint32, error) {
+	var b [4]byte
+	_, err := io.ReadFull(jr.r, b[:])
+	return binary.BigEndian.Uint32(b[:]), err
+}
+
+func (jr *javaReader) readU64() (uint64, error) {
+	var b [8]byte
+	_, err := io.ReadFull(jr.r, b[:])
+	return binary.BigEndian.Uint64(b[:]), err
+}
+
+func (jr *javaReader) readUTF() (string, error) {
+	length, err := jr.readU16()
+	if err != nil {
+		return "", err
+	}
+
+	raw := make([]byte, length)
+	_, err = io.ReadFull(jr.r, raw)
+	return string(raw), err
+}
+
+func (jr *javaReader) newHandle(v interface{}) int {
+	jr.handles = append(jr.handles, v)
+	return len(jr.handles) - 1
+}
+
+func (jr *javaReader) readHandle() (interface{}, error) {
+	handle, err := jr.readU32()
+	if err != nil {
+		return nil, err
+	}
+
+	i := int(handle) - javaBaseHandle
+	if i < 0 || i >= len(jr.handles) {
+		return nil, fmt.Errorf("invalid object reference [%x]", handle)
+	}
+
+	return jr.handles[i], nil
+}
+
+// Reads a single content element: an object, string, array, class, enum, null, or reference.
+func (jr *javaReader) readContent() (interface{}, error) {
+	tc, err := jr.readU8()
+	if err != nil {
+		return nil, err
+	}
+
+	return jr.readContentOfType(tc)
+}
+
+func (jr *javaReader) readContentOfType(tc byte) (interface{}, error) {
+	jr.depth++
+	defer func() { jr.depth-- }()
+
+	if jr.depth > 256 {
+		return nil, errors.New("objects are nested too deeply")
+	}
+
+	switch tc {
+	case tcNull:
+		return nil, nil
+
+	case tcReference:
+		return jr.readHandle()
+
+	case tcString:
+		s, err := jr.readUTF()
+		jr.newHandle(s)
+		return s, err
+
+	case tcLongString:
+		length, err := jr.readU64()
+		if err != nil {
+			return nil, err
+		}
+		if length > math.MaxInt32 {
+			return nil, errors.New("string too long")
+		}
+
+		raw := make([]byte, length)
+		_, err = io.ReadFull(jr.r, raw)
+		jr.newHandle(string(raw))
+		return string(raw), err
+
+	case tcClassDesc, tcProxyClassDesc:
+		return jr.readClassDescOfType(tc)
+
+	case tcClass:
+		class, err := jr.readClassDesc()
+		jr.newHandle(class)
+		return class, err
+
+	case tcObject:
+		return jr.readObject()
+
+	case tcArray:
+		return jr.readArray()
+
+	case tcEnum:
+		if _, err := jr.readClassDesc(); err != nil {
+			return nil, err
+		}
+
+		handle := jr.newHandle(nil)
+		constant, err := jr.readContent()
+		jr.handles[handle] = constant
+		return constant, err
+
+	case tcBlockData:
+		length, err := jr.readU8()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(ioutil.Discard, jr.r, int64(length))
+		return nil, err
+
+	case tcBlockDataLong:
+		length, err := jr.readU32()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(ioutil.Discard, jr.r, int64(length))
+		return nil, err
+
+	case tcReset:
+		jr.handles = nil
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported serialization type code [%x]", tc)
+}
+
+func (jr *javaReader) readClassDesc() (*javaClass, error) {
+	tc, err := jr.readU8()
+	if err != nil {
+		return nil, err
+	}
+
+	return jr.readClassDescOfType(tc)
+}
+
+func (jr *javaReader) readClassDescOfType(tc byte) (*javaClass, error) {
+	switch tc {
+	case tcNull:
+		return nil, nil
+
+	case tcReference:
+		v, err := jr.readHandle()
+		if err != nil {
+			return nil, err
+		}
+
+		class, ok := v.(*javaClass)
+		if !ok {
+			return nil, errors.New("reference is not a class description")
+		}
+		return class, nil
+
+	case tcProxyClassDesc:
+		return nil, errors.New("proxy classes are not supported")
+
+	case tcClassDesc:
+		class := new(javaClass)
+
+		name, err := jr.readUTF()
+		if err != nil {
+			return nil, err
+		}
+		class.name = name
+
+		if _, err := jr.readU64(); err != nil { // serialVersionUID
+			return nil, err
+		}
+
+		jr.newHandle(class)
+
+		if class.flags, err = jr.readU8(); err != nil {
+			return nil, err
+		}
+
+		fieldCount, err := jr.readU16()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < int(fieldCount); i++ {
+			var field javaField
+
+			if field.typeCode, err = jr.readU8(); err != nil {
+				return nil, err
+			}
+			if field.name, err = jr.readUTF(); err != nil {
+				return nil, err
+			}
+
+			if field.typeCode == '[' || field.typeCode == 'L' {
+				className, err := jr.readContent()
+				if err != nil {
+					return nil, err
+				}
+				field.className, _ = className.(string)
+			}
+
+			class.fields = append(class.fields, field)
+		}
+
+		if err := jr.skipAnnotations(); err != nil {
+			return nil, err
+		}
+
+		if class.super, err = jr.readClassDesc(); err != nil {
+			return nil, err
+		}
+
+		return class, nil
+	}
+
+	return nil, fmt.Errorf("expected class description, got type code [%x]", tc)
+}
+
+// Skips block data and objects written by custom writeObject methods up to TC_ENDBLOCKDATA.
+func (jr *javaReader) skipAnnotations() error {
+	for {
+		tc, err := jr.readU8()
+		if err != nil {
+			return err
+		}
+
+		if tc == tcEndBlockData {
+			return nil
+		}
+
+		if _, err := jr.readContentOfType(tc); err != nil {
+			return err
+		}
+	}
+}
+
+func (jr *javaReader) readObject() (*javaObject, error) {
+	class, err := jr.readClassDesc()
+	if err != nil {
+		return nil, err
+	}
+	if class == nil {
+		return nil, errors.New("object has no class description")
+	}
+
+	obj := &javaObject{class: class, fields: make(map[string]interface{})}
+	jr.newHandle(obj)
+
+	// Class data is written from the topmost serializable superclass down
+	var hierarchy []*javaClass
+	for c := class; c != nil; c = c.super {
+		hierarchy = append([]*javaClass{c}, hierarchy...)
+	}
+
+	for _, c := range hierarchy {
+		if c.flags&scExternalizable != 0 {
+			return nil, fmt.Errorf("externalizable class '%v' is not supported", c.name)
+		}
+
+		if c.flags&scSerializable == 0 {
+			continue
+		}
+
+		for _, field := range c.fields {
+			v, err := jr.readFieldValue(field.typeCode)
+			if err != nil {
+				return nil, fmt.Errorf("%v.%v: %v", c.name, field.name, err)
+			}
+
+			obj.fields[field.name] = v
+		}
+
+		if c.flags&scWriteMethod != 0 {
+			if err := jr.skipAnnotations(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return obj, nil
+}
+
+func (jr *javaReader) readArray() (interface{}, error) {
+	class, err := jr.readClassDesc()
+	if err != nil {
+		return nil, err
+	}
+	if class == nil || len(class.name) < 2 || class.name[0] != '[' {
+		return nil, errors.New("invalid array class")
+	}
+
+	handle := jr.newHandle(nil)
+
+	length, err := jr.readU32()
+	if err != nil {
+		return nil, err
+	}
+	if length > math.MaxInt32 {
+		return nil, errors.New("array too long")
+	}
+
+	// Byte arrays (such as the level's blocks) are read in one go
+	if class.name[1] == 'B' {
+		data := make([]byte, length)
+		_, err = io.ReadFull(jr.r, data)
+		jr.handles[handle] = data
+		return data, err
+	}
+
+	values := make([]interface{}, 0)
+	for i := uint32(0); i < length; i++ {
+		v, err := jr.readFieldValue(class.name[1])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	jr.handles[handle] = values
+	return values, nil
+}
+
+func (jr *javaReader) readFieldValue(typeCode byte) (interface{}, error) {
+	switch typeCode {
+	case 'B':
+		return jr.readU8()
+
+	case 'Z':
+		b, err := jr.readU8()
+		return b != 0, err
+
+	case 'C', 'S':
+		v, err := jr.readU16()
+		return int16(v), err
+
+	case 'I':
+		v, err := jr.readU32()
+		return int32(v), err
+
+	case 'F':
+		v, err := jr.readU32()
+		return math.Float32frombits(v), err
+
+	case 'J':
+		v, err := jr.readU64()
+		return int64(v), err
+
+	case 'D':
+		v, err := jr.readU64()
+		return math.Float64frombits(v), err
+
+	case 'L', '[':
+		return jr.readContent()
+	}
+
+	return nil, fmt.Errorf("unknown field type code [%c]", typeCode)
+}
@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"midnight/pkg/core"
+	"os"
+)
+
+// MCGalaxy (.lvl) level format
+//
+// A gzip stream containing a little-endian header followed by the block array:
+//
+//	u16 1874 (only in newer files)
+//	u16 width (X), u16 length (Z), u16 height (Y)
+//	u16 spawn X, u16 spawn Z, u16 spawn Y
+//	u8 spawn yaw, u8 spawn pitch
+//	u8 visit permission, u8 build permission (only in newer files)
+//	blocks[width * height * length]
+//
+// The blocks may be followed by optional sections, such as custom block IDs (0xBD).
+
+const (
+	lvlVersionMagic   = 1874
+	lvlCustomSection  = 0xBD
+	lvlCustomBlock    = 163
+	lvlCustomChunkLen = 16 * 16 * 16
+)
+
+// MCGalaxy's operator-only blocks, which look the same as regular blocks
+var lvlOpBlocks = map[byte]byte{
+	100: core.BlockGlass,
+	101: core.BlockObsidian,
+	102: core.BlockBrick,
+	103: core.BlockStone,
+	104: core.BlockCobblestone,
+	105: core.BlockAir,
+	106: core.BlockWater,
+	107: core.BlockLava,
+}
+
+func ImportLvl(path string, name string) (*core.Level, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	r := bufio.NewReader(gz)
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return nil, nil, err
+	}
+
+	if binary.LittleEndian.Uint16(header) == lvlVersionMagic {
+		_, err = io.ReadFull(r, header)
+	} else {
+		_, err = io.ReadFull(r, header[2:14])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sizeX := int(binary.LittleEndian.Uint16(header[0:]))
+	sizeZ := int(binary.LittleEndian.Uint16(header[2:]))
+	sizeY := int(binary.LittleEndian.Uint16(header[4:]))
+
+	l, err := newLevel(name, sizeX, sizeY, sizeZ)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.SpawnPos[0] = float32(binary.LittleEndian.Uint16(header[6:]))
+	l.SpawnPos[2] = float32(binary.LittleEndian.Uint16(header[8:]))
+	l.SpawnPos[1] = float32(binary.LittleEndian.Uint16(header[10:]))
+	l.SpawnYaw = header[12]
+	l.SpawnPitch = header[13]
+
+	if _, err := io.ReadFull(r, l.Data); err != nil {
+		return nil, nil, fmt.Errorf("could not read blocks: %v", err)
+	}
+
+	var warnings []string
+
+	customBlocks, err := readLvlCustomBlocks(r, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if customBlocks > 0 {
+		warnings = append(warnings, fmt.Sprintf("%v custom blocks (BlockDefinitions) are not supported and were replaced with stone", customBlocks))
+	}
+
+	if _, err := r.Peek(1); err == nil {
+		warnings = append(warnings, "ignored extra level data (physics state, block properties or metadata)")
+	}
+
+	opBlocks := 0
+	for i, b := range l.Data {
+		if replacement, found := lvlOpBlocks[b]; found {
+			l.Data[i] = replacement
+			opBlocks++
+		}
+	}
+	if opBlocks > 0 {
+		warnings = append(warnings, fmt.Sprintf("%v operator-only blocks were converted to their regular counterparts", opBlocks))
+	}
+
+	warnings = append(warnings, replaceUnknownBlocks(l.Data)...)
+
+	return l, warnings, nil
+}
+
+// Reads the custom blocks section if there is one, replacing custom blocks with stone.
+// Returns the number of custom blocks in the level.
+func readLvlCustomBlocks(r *bufio.Reader, l *core.Level) (int, error) {
+	if marker, err := r.Peek(1); err != nil || marker[0] != lvlCustomSection {
+		return replaceCustomBlocks(l.Data), nil
+	}
+	r.ReadByte()
+
+	// Extended block IDs are stored in 16x16x16 chunks, each preceded by a flag saying whether it exists.
+	// They are skipped; Only the base blocks are imported.
+	chunksX := (int(l.Size.X) + 15) / 16
+	chunksY := (int(l.Size.Y) + 15) / 16
+	chunksZ := (int(l.Size.Z) + 15) / 16
+	chunk := make([]byte, lvlCustomChunkLen)
+
+	for i := 0; i < chunksX*chunksY*chunksZ; i++ {
+		present, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("could not read custom blocks: %v", err)
+		}
+
+		if present == 1 {
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return 0, fmt.Errorf("could not read custom blocks: %v", err)
+			}
+		}
+	}
+
+	return replaceCustomBlocks(l.Data), nil
+}
+
+// Replaces custom blocks with stone, returning the number replaced.
+func replaceCustomBlocks(data []byte) int {
+	count := 0
+
+	for i, b := range data {
+		if b == lvlCustomBlock {
+			data[i] = core.BlockStone
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,266 @@
+// Package metrics keeps counters, gauges and histograms and serves them in the Prometheus text format.
+// Updating a metric is a few atomic operations, so it can be done on hot paths such as packet handling.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = append(registry, m)
+}
+
+// A value that only goes up.
+type Counter struct {
+	v uint64 // Accessed atomically; First in the struct so that it's 64-bit aligned
+}
+
+func (c *Counter) Inc()         { atomic.AddUint64(&c.v, 1) }
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.v, n) }
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) writeHeader(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", d.name, d.help, d.name, typ)
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	NewCollector(name, help, "counter", nil, func(emit func(value float64, labelValues ...string)) {
+		emit(float64(c.Value()))
+	})
+	return c
+}
+
+// Counters told apart by the values of labels, e.g. connections rejected by reason.
+type CounterVec struct {
+	desc
+	counters sync.Map // *Counter by label values joined with "\xff"
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{desc: desc{name, help, labels}}
+	register(v)
+	return v
+}
+
+// Returns the counter for the label values, which are given in the order the labels were.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	key := strings.Join(labelValues, "\xff")
+	if c, found := v.counters.Load(key); found {
+		return c.(*Counter)
+	}
+
+	c, _ := v.counters.LoadOrStore(key, &Counter{})
+	return c.(*Counter)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.writeHeader(w, "counter")
+
+	var keys []string
+	v.counters.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		c, _ := v.counters.Load(key)
+		writeSample(w, v.name, v.labels, strings.Split(key, "\xff"), float64(c.(*Counter).Value()))
+	}
+}
+
+// Counters for each value of a byte, e.g. packets by packet ID. Only counters that aren't zero are shown.
+type ByteCounter struct {
+	counts [256]uint64 // Accessed atomically
+	desc
+}
+
+func NewByteCounter(name, help, label string) *ByteCounter {
+	c := &ByteCounter{desc: desc{name, help, []string{label}}}
+	register(c)
+	return c
+}
+
+func (c *ByteCounter) Inc(b byte)           { atomic.AddUint64(&c.counts[b], 1) }
+func (c *ByteCounter) Add(b byte, n uint64) { atomic.AddUint64(&c.counts[b], n) }
+
+func (c *ByteCounter) write(w io.Writer) {
+	c.writeHeader(w, "counter")
+
+	for i := range c.counts {
+		if n := atomic.LoadUint64(&c.counts[i]); n > 0 {
+			writeSample(w, c.name, c.labels, []string{strconv.Itoa(i)}, float64(n))
+		}
+	}
+}
+
+// Counts observations, such as durations, in buckets.
+type Histogram struct {
+	count   uint64 // Accessed atomically
+	sumBits uint64 // Sum of observations as float64 bits; Accessed atomically
+	desc
+	buckets []float64 // Upper bounds, in increasing order
+	counts  []uint64  // Observations in each bucket, not counting the buckets below; Accessed atomically
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help}, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w, "histogram")
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, h.name+"_bucket", []string{"le"}, []string{formatFloat(bound)}, float64(cumulative))
+	}
+
+	count := atomic.LoadUint64(&h.count)
+	writeSample(w, h.name+"_bucket", []string{"le"}, []string{"+Inf"}, float64(count))
+	writeSample(w, h.name+"_sum", nil, nil, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	writeSample(w, h.name+"_count", nil, nil, float64(count))
+}
+
+// A metric whose samples are collected when it's scraped, e.g. the number of players online.
+type collector struct {
+	desc
+	typ     string
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// Registers a metric of type typ ("gauge" or "counter") whose samples are collected when it's scraped.
+// collect calls emit for each sample, with values for the labels in the order they were given.
+func NewCollector(name, help, typ string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	register(&collector{desc{name, help, labels}, typ, collect})
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	NewCollector(name, help, "gauge", nil, func(emit func(value float64, labelValues ...string)) {
+		emit(fn())
+	})
+}
+
+func (c *collector) write(w io.Writer) {
+	c.writeHeader(w, c.typ)
+
+	c.collect(func(value float64, labelValues ...string) {
+		writeSample(w, c.name, c.labels, labelValues, value)
+	})
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, value float64) {
+	io.WriteString(w, name)
+
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+
+			v := ""
+			if i < len(values) {
+				v = values[i]
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", label, labelEscaper.Replace(v))
+		}
+		io.WriteString(w, "}")
+	}
+
+	fmt.Fprintf(w, " %v\n", formatFloat(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes every metric in the Prometheus text format.
+func WriteAll(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Serves the metrics at /metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteAll(w)
+	})
+}
+
+// Starts serving the metrics at /metrics on addr.
+func Listen(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	srv := &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 30 * time.Second}
+	go srv.Serve(listener)
+
+	return srv, nil
+}
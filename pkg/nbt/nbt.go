@@ -0,0 +1,412 @@
+// Package nbt reads and writes uncompressed Named Binary Tag data.
+//
+// Reference Page: https://wiki.vg/NBT
+//
+// Tags are represented with plain Go values:
+//
+//	TAG_Byte       byte
+//	TAG_Short      int16
+//	TAG_Int        int32
+//	TAG_Long       int64
+//	TAG_Float      float32
+//	TAG_Double     float64
+//	TAG_Byte_Array []byte
+//	TAG_String     string
+//	TAG_List       List
+//	TAG_Compound   Compound
+//	TAG_Int_Array  []int32
+//	TAG_Long_Array []int64
+package nbt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	TagEnd byte = iota
+	TagByte
+	TagShort
+	TagInt
+	TagLong
+	TagFloat
+	TagDouble
+	TagByteArray
+	TagString
+	TagList
+	TagCompound
+	TagIntArray
+	TagLongArray
+)
+
+// Compound maps tag names to their values.
+type Compound map[string]interface{}
+
+// List holds values that all share the same tag type.
+type List struct {
+	Type   byte
+	Values []interface{}
+}
+
+var ErrNotCompound = errors.New("nbt: root tag is not a compound")
+
+// Limits array and list lengths so a corrupt length can't exhaust memory.
+const maxArrayLength = 1 << 28
+
+// Reads a named root compound from r.
+func Read(r io.Reader) (name string, root Compound, err error) {
+	d := decoder{r: r}
+
+	tagType := d.readByte()
+	if d.err == nil && tagType != TagCompound {
+		return "", nil, ErrNotCompound
+	}
+
+	name = d.readString()
+	root, _ = d.readPayload(TagCompound, 0).(Compound)
+
+	return name, root, d.err
+}
+
+// Writes root to w as a named root compound.
+func Write(w io.Writer, name string, root Compound) error {
+	e := encoder{w: w}
+
+	e.writeByte(TagCompound)
+	e.writeString(name)
+	e.writePayload(root)
+
+	return e.err
+}
+
+// Returns the NBT tag type used for a Go value, or TagEnd if the value can't be stored.
+func TagType(v interface{}) byte {
+	switch v.(type) {
+	case byte:
+		return TagByte
+	case int16:
+		return TagShort
+	case int32:
+		return TagInt
+	case int64:
+		return TagLong
+	case float32:
+		return TagFloat
+	case float64:
+		return TagDouble
+	case []byte:
+		return TagByteArray
+	case string:
+		return TagString
+	case List:
+		return TagList
+	case Compound:
+		return TagCompound
+	case []int32:
+		return TagIntArray
+	case []int64:
+		return TagLongArray
+	}
+	return TagEnd
+}
+
+// Compound accessors. Each returns false if the tag is missing or has a different type.
+
+func (c Compound) Byte(name string) (byte, bool) {
+	v, ok := c[name].(byte)
+	return v, ok
+}
+
+func (c Compound) Short(name string) (int16, bool) {
+	v, ok := c[name].(int16)
+	return v, ok
+}
+
+func (c Compound) Int(name string) (int32, bool) {
+	v, ok := c[name].(int32)
+	return v, ok
+}
+
+func (c Compound) Long(name string) (int64, bool) {
+	v, ok := c[name].(int64)
+	return v, ok
+}
+
+func (c Compound) String(name string) (string, bool) {
+	v, ok := c[name].(string)
+	return v, ok
+}
+
+func (c Compound) ByteArray(name string) ([]byte, bool) {
+	v, ok := c[name].([]byte)
+	return v, ok
+}
+
+func (c Compound) Compound(name string) (Compound, bool) {
+	v, ok := c[name].(Compound)
+	return v, ok
+}
+
+// Decoding
+
+type decoder struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return d.buf[:n]
+	}
+
+	_, d.err = io.ReadFull(d.r, d.buf[:n])
+	return d.buf[:n]
+}
+
+func (d *decoder) readByte() byte {
+	return d.read(1)[0]
+}
+
+func (d *decoder) readShort() int16 {
+	return int16(binary.BigEndian.Uint16(d.read(2)))
+}
+
+func (d *decoder) readInt() int32 {
+	return int32(binary.BigEndian.Uint32(d.read(4)))
+}
+
+func (d *decoder) readLong() int64 {
+	return int64(binary.BigEndian.Uint64(d.read(8)))
+}
+
+func (d *decoder) readLength() int {
+	length := d.readInt()
+
+	if d.err == nil && (length < 0 || length > maxArrayLength) {
+		d.err = fmt.Errorf("nbt: invalid length [%v]", length)
+	}
+	if d.err != nil {
+		return 0
+	}
+
+	return int(length)
+}
+
+func (d *decoder) readString() string {
+	length := uint16(d.readShort())
+	if d.err != nil {
+		return ""
+	}
+
+	raw := make([]byte, length)
+	_, d.err = io.ReadFull(d.r, raw)
+
+	return string(raw)
+}
+
+func (d *decoder) readPayload(tagType byte, depth int) interface{} {
+	if depth > 512 {
+		d.err = errors.New("nbt: tags are nested too deeply")
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	switch tagType {
+	case TagByte:
+		return d.readByte()
+
+	case TagShort:
+		return d.readShort()
+
+	case TagInt:
+		return d.readInt()
+
+	case TagLong:
+		return d.readLong()
+
+	case TagFloat:
+		return math.Float32frombits(uint32(d.readInt()))
+
+	case TagDouble:
+		return math.Float64frombits(uint64(d.readLong()))
+
+	case TagByteArray:
+		raw := make([]byte, d.readLength())
+		if d.err == nil {
+			_, d.err = io.ReadFull(d.r, raw)
+		}
+		return raw
+
+	case TagString:
+		return d.readString()
+
+	case TagList:
+		list := List{Type: d.readByte()}
+		length := d.readLength()
+
+		for i := 0; i < length && d.err == nil; i++ {
+			list.Values = append(list.Values, d.readPayload(list.Type, depth+1))
+		}
+		return list
+
+	case TagCompound:
+		c := make(Compound)
+
+		for d.err == nil {
+			childType := d.readByte()
+			if childType == TagEnd {
+				break
+			}
+
+			name := d.readString()
+			c[name] = d.readPayload(childType, depth+1)
+		}
+		return c
+
+	case TagIntArray:
+		values := make([]int32, d.readLength())
+		for i := range values {
+			values[i] = d.readInt()
+		}
+		return values
+
+	case TagLongArray:
+		values := make([]int64, d.readLength())
+		for i := range values {
+			values[i] = d.readLong()
+		}
+		return values
+	}
+
+	d.err = fmt.Errorf("nbt: unknown tag type [%v]", tagType)
+	return nil
+}
+
+// Encoding
+
+type encoder struct {
+	w   io.Writer
+	buf [8]byte
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+
+	_, e.err = e.w.Write(b)
+}
+
+func (e *encoder) writeByte(v byte) {
+	e.buf[0] = v
+	e.write(e.buf[:1])
+}
+
+func (e *encoder) writeShort(v int16) {
+	binary.BigEndian.PutUint16(e.buf[:2], uint16(v))
+	e.write(e.buf[:2])
+}
+
+func (e *encoder) writeInt(v int32) {
+	binary.BigEndian.PutUint32(e.buf[:4], uint32(v))
+	e.write(e.buf[:4])
+}
+
+func (e *encoder) writeLong(v int64) {
+	binary.BigEndian.PutUint64(e.buf[:8], uint64(v))
+	e.write(e.buf[:8])
+}
+
+func (e *encoder) writeString(v string) {
+	if len(v) > math.MaxUint16 {
+		e.err = fmt.Errorf("nbt: string too long [%v bytes]", len(v))
+		return
+	}
+
+	e.writeShort(int16(uint16(len(v))))
+	e.write([]byte(v))
+}
+
+func (e *encoder) writePayload(v interface{}) {
+	switch v := v.(type) {
+	case byte:
+		e.writeByte(v)
+
+	case int16:
+		e.writeShort(v)
+
+	case int32:
+		e.writeInt(v)
+
+	case int64:
+		e.writeLong(v)
+
+	case float32:
+		e.writeInt(int32(math.Float32bits(v)))
+
+	case float64:
+		e.writeLong(int64(math.Float64bits(v)))
+
+	case []byte:
+		e.writeInt(int32(len(v)))
+		e.write(v)
+
+	case string:
+		e.writeString(v)
+
+	case List:
+		e.writeByte(v.Type)
+		e.writeInt(int32(len(v.Values)))
+
+		for _, value := range v.Values {
+			if TagType(value) != v.Type {
+				e.err = fmt.Errorf("nbt: list of type [%v] contains value of type %T", v.Type, value)
+				return
+			}
+			e.writePayload(value)
+		}
+
+	case Compound:
+		// Sort names so that identical compounds always encode identically
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			tagType := TagType(v[name])
+			if tagType == TagEnd {
+				e.err = fmt.Errorf("nbt: tag '%v' has unsupported type %T", name, v[name])
+				return
+			}
+
+			e.writeByte(tagType)
+			e.writeString(name)
+			e.writePayload(v[name])
+		}
+		e.writeByte(TagEnd)
+
+	case []int32:
+		e.writeInt(int32(len(v)))
+		for _, value := range v {
+			e.writeInt(value)
+		}
+
+	case []int64:
+		e.writeInt(int32(len(v)))
+		for _, value := range v {
+			e.writeLong(value)
+		}
+
+	default:
+		e.err = fmt.Errorf("nbt: unsupported type %T", v)
+	}
+}
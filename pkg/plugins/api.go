@@ -0,0 +1,449 @@
+package plugins
+
+import (
+	"errors"
+	"log"
+	"midnight/pkg/core"
+	"midnight/pkg/util"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts get the global table "midnight":
+//
+//	midnight.on(event, handler [, priority])  Calls handler(e) for an event, e.g. "PlayerChat"; See events.go for the fields of e.
+//	                                          Priority is "lowest", "low", "normal" (the default), "high", "highest" or "monitor".
+//	midnight.command{name=, aliases=, usage=, description=, permission=, handler=}
+//	                                          Registers a command. handler(sender, args) may return a message to show as an
+//	                                          error, or false to show the usage.
+//	midnight.broadcast(msg)                   Sends a message to every player.
+//	midnight.log(msg)                         Writes to the server log.
+//	midnight.player(name), midnight.players() Return online players.
+//	midnight.level(name), midnight.levels()   Return loaded levels.
+//	midnight.block(name), midnight.blockName(id)
+//
+// Players:  p:name(), p:message(msg), p:hasPermission(perm), p:position() -> x, y, z, yaw, pitch,
+//           p:teleport(x, y, z [, yaw, pitch]), p:level()
+// Levels:   l:name(), l:size() -> x, y, z, l:getBlock(x, y, z), l:setBlock(x, y, z, block), l:players()
+// Console:  c:name(), c:message(msg), c:hasPermission(perm); Passed to command handlers as the sender
+//
+// Blocks can be given by ID or name. Block changes made by scripts aren't recorded in the block history.
+
+const (
+	playerType = "midnight.Player"
+	levelType  = "midnight.Level"
+	senderType = "midnight.Sender"
+)
+
+func openAPI(pl *Plugin) {
+	L := pl.L
+
+	registerType(L, playerType, map[string]lua.LGFunction{
+		"name":          playerName,
+		"message":       playerMessage,
+		"hasPermission": playerHasPermission,
+		"position":      playerPosition,
+		"teleport":      playerTeleport,
+		"level":         playerLevel,
+	})
+	registerType(L, levelType, map[string]lua.LGFunction{
+		"name":     levelName,
+		"size":     levelSize,
+		"getBlock": levelGetBlock,
+		"setBlock": levelSetBlock,
+		"players":  levelPlayers,
+	})
+	registerType(L, senderType, map[string]lua.LGFunction{
+		"name":          senderName,
+		"message":       senderMessage,
+		"hasPermission": senderHasPermission,
+	})
+
+	L.SetGlobal("midnight", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"on":        pl.luaOn,
+		"command":   pl.luaCommand,
+		"broadcast": pl.luaBroadcast,
+		"log":       pl.luaLog,
+		"player":    pl.luaPlayer,
+		"players":   pl.luaPlayers,
+		"level":     pl.luaLevel,
+		"levels":    pl.luaLevels,
+		"block":     luaBlock,
+		"blockName": luaBlockName,
+	}))
+}
+
+func registerType(L *lua.LState, name string, methods map[string]lua.LGFunction) {
+	mt := L.NewTypeMetatable(name)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+}
+
+var eventTypes = map[string]core.EventType{}
+
+func init() {
+	for _, t := range []core.EventType{
+		core.EventPlayerPreLogin, core.EventPlayerJoin, core.EventPlayerQuit, core.EventPlayerChat, core.EventPlayerMove,
+		core.EventBlockPlace, core.EventBlockBreak, core.EventLevelLoad, core.EventCommandExecute,
+	} {
+		eventTypes[strings.ToLower(string(t))] = t
+	}
+}
+
+var priorities = map[string]core.EventPriority{
+	"lowest":  core.PriorityLowest,
+	"low":     core.PriorityLow,
+	"normal":  core.PriorityNormal,
+	"high":    core.PriorityHigh,
+	"highest": core.PriorityHighest,
+	"monitor": core.PriorityMonitor,
+}
+
+func (pl *Plugin) luaOn(L *lua.LState) int {
+	t, found := eventTypes[strings.ToLower(L.CheckString(1))]
+	if !found {
+		L.ArgError(1, "unknown event")
+	}
+	fn := L.CheckFunction(2)
+	priority, found := priorities[strings.ToLower(L.OptString(3, "normal"))]
+	if !found {
+		L.ArgError(3, "unknown priority")
+	}
+
+	eh := &core.EventHandler{Event: t, Priority: priority}
+	eh.Handle = func(e core.Event) {
+		var tbl *lua.LTable
+
+		err := pl.call(fn, func() []lua.LValue {
+			tbl = eventTable(pl.L, e)
+			return []lua.LValue{tbl}
+		}, func(lua.LValue) {
+			applyEventTable(e, tbl)
+		})
+		if err != nil {
+			pl.logError(string(t)+" handler", err)
+		}
+	}
+
+	core.RegisterEventHandler(eh)
+	pl.handlers = append(pl.handlers, eh)
+	return 0
+}
+
+func (pl *Plugin) luaCommand(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+
+	name := lua.LVAsString(tbl.RawGetString("name"))
+	fn, ok := tbl.RawGetString("handler").(*lua.LFunction)
+	if name == "" || !ok {
+		L.ArgError(1, "commands need a name and a handler")
+	}
+
+	cmd := &core.Command{
+		Name:        name,
+		Usage:       lua.LVAsString(tbl.RawGetString("usage")),
+		Description: lua.LVAsString(tbl.RawGetString("description")),
+		Permission:  lua.LVAsString(tbl.RawGetString("permission")),
+	}
+	if aliases, ok := tbl.RawGetString("aliases").(*lua.LTable); ok {
+		cmd.Aliases = stringsFromTable(aliases)
+	}
+
+	// Plugins can't take over commands from the server or other plugins
+	for _, n := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if other := core.FindCommand(n); other != nil && !pl.ownsCommand(other) {
+			L.RaiseError("command '/%v' already exists", n)
+		}
+	}
+
+	cmd.Handler = func(s *core.Server, sender core.CommandSender, args []string) error {
+		var cmdErr error
+
+		err := pl.call(fn, func() []lua.LValue {
+			return []lua.LValue{senderValue(pl.L, sender), stringsTable(pl.L, args)}
+		}, func(result lua.LValue) {
+			switch result := result.(type) {
+			case lua.LString:
+				cmdErr = errors.New(string(result))
+			case lua.LBool:
+				if !result {
+					cmdErr = core.ErrCommandUsage
+				}
+			}
+		})
+		if err != nil {
+			pl.logError("/"+cmd.Name, err)
+			return errors.New("something went wrong running this command")
+		}
+
+		return cmdErr
+	}
+
+	core.RegisterCommand(cmd)
+	pl.commands = append(pl.commands, cmd)
+	return 0
+}
+
+func (pl *Plugin) ownsCommand(cmd *core.Command) bool {
+	for _, own := range pl.commands {
+		if own == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *Plugin) luaBroadcast(L *lua.LState) int {
+	msg := L.CheckString(1)
+	for _, p := range pl.host.s.Players() {
+		p.SendMessage(msg)
+	}
+	return 0
+}
+
+func (pl *Plugin) luaLog(L *lua.LState) int {
+	log.Printf("[Plugin %v] %v", pl.Name, L.CheckString(1))
+	return 0
+}
+
+func (pl *Plugin) luaPlayer(L *lua.LState) int {
+	p := pl.host.s.Player(L.CheckString(1))
+	if p == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(playerValue(L, p))
+	}
+	return 1
+}
+
+func (pl *Plugin) luaPlayers(L *lua.LState) int {
+	L.Push(playersTable(L, pl.host.s.Players()))
+	return 1
+}
+
+func (pl *Plugin) luaLevel(L *lua.LState) int {
+	l := pl.host.s.Level(L.CheckString(1))
+	if l == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(levelValue(L, l))
+	}
+	return 1
+}
+
+func (pl *Plugin) luaLevels(L *lua.LState) int {
+	tbl := L.NewTable()
+	for _, l := range pl.host.s.Levels() {
+		tbl.Append(levelValue(L, l))
+	}
+	L.Push(tbl)
+	return 1
+}
+
+func luaBlock(L *lua.LState) int {
+	if block, found := core.FindBlock(L.CheckString(1)); found {
+		L.Push(lua.LNumber(block))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+func luaBlockName(L *lua.LState) int {
+	L.Push(lua.LString(core.BlockName(byte(L.CheckInt(1)))))
+	return 1
+}
+
+// Players
+
+func playerValue(L *lua.LState, p *core.Player) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = p
+	L.SetMetatable(ud, L.GetTypeMetatable(playerType))
+	return ud
+}
+
+func checkPlayer(L *lua.LState, n int) *core.Player {
+	if p, ok := L.CheckUserData(n).Value.(*core.Player); ok {
+		return p
+	}
+	L.ArgError(n, "player expected")
+	return nil
+}
+
+func playersTable(L *lua.LState, players []*core.Player) *lua.LTable {
+	tbl := L.NewTable()
+	for _, p := range players {
+		tbl.Append(playerValue(L, p))
+	}
+	return tbl
+}
+
+func playerName(L *lua.LState) int {
+	L.Push(lua.LString(checkPlayer(L, 1).Username))
+	return 1
+}
+
+func playerMessage(L *lua.LState) int {
+	checkPlayer(L, 1).SendMessage(L.CheckString(2))
+	return 0
+}
+
+func playerHasPermission(L *lua.LState) int {
+	L.Push(lua.LBool(checkPlayer(L, 1).HasPermission(L.CheckString(2))))
+	return 1
+}
+
+func playerPosition(L *lua.LState) int {
+	pos := checkPlayer(L, 1).Position()
+	L.Push(lua.LNumber(pos.X))
+	L.Push(lua.LNumber(pos.Y))
+	L.Push(lua.LNumber(pos.Z))
+	L.Push(lua.LNumber(pos.Yaw))
+	L.Push(lua.LNumber(pos.Pitch))
+	return 5
+}
+
+func playerTeleport(L *lua.LState) int {
+	p := checkPlayer(L, 1)
+	pos := p.Position()
+
+	pos.X = float32(L.CheckNumber(2))
+	pos.Y = float32(L.CheckNumber(3))
+	pos.Z = float32(L.CheckNumber(4))
+	pos.Yaw = byte(L.OptInt(5, int(pos.Yaw)))
+	pos.Pitch = byte(L.OptInt(6, int(pos.Pitch)))
+
+	p.Teleport(pos)
+	return 0
+}
+
+func playerLevel(L *lua.LState) int {
+	if l := checkPlayer(L, 1).Level(); l != nil {
+		L.Push(levelValue(L, l))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// Levels
+
+func levelValue(L *lua.LState, l *core.Level) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = l
+	L.SetMetatable(ud, L.GetTypeMetatable(levelType))
+	return ud
+}
+
+func checkLevel(L *lua.LState, n int) *core.Level {
+	if l, ok := L.CheckUserData(n).Value.(*core.Level); ok {
+		return l
+	}
+	L.ArgError(n, "level expected")
+	return nil
+}
+
+func levelName(L *lua.LState) int {
+	L.Push(lua.LString(checkLevel(L, 1).Name))
+	return 1
+}
+
+func levelSize(L *lua.LState) int {
+	l := checkLevel(L, 1)
+	L.Push(lua.LNumber(l.Size.X))
+	L.Push(lua.LNumber(l.Size.Y))
+	L.Push(lua.LNumber(l.Size.Z))
+	return 3
+}
+
+// Returns the position given by the arguments starting at n, raising an error if it's outside the level.
+func checkPosition(L *lua.LState, l *core.Level, n int) (x, y, z int16) {
+	ix, iy, iz := L.CheckInt(n), L.CheckInt(n+1), L.CheckInt(n+2)
+	if ix < 0 || iy < 0 || iz < 0 || ix >= int(l.Size.X) || iy >= int(l.Size.Y) || iz >= int(l.Size.Z) {
+		L.RaiseError("position %v, %v, %v is outside level '%v'", ix, iy, iz, l.Name)
+	}
+	return int16(ix), int16(iy), int16(iz)
+}
+
+func checkBlock(L *lua.LState, n int) byte {
+	block, found := core.FindBlock(L.CheckAny(n).String())
+	if !found {
+		L.ArgError(n, "unknown block")
+	}
+	return block
+}
+
+func levelGetBlock(L *lua.LState) int {
+	l := checkLevel(L, 1)
+	x, y, z := checkPosition(L, l, 2)
+
+	L.Push(lua.LNumber(l.GetBlock(x, y, z)))
+	return 1
+}
+
+func levelSetBlock(L *lua.LState) int {
+	l := checkLevel(L, 1)
+	x, y, z := checkPosition(L, l, 2)
+	block := checkBlock(L, 5)
+
+	l.ChangeBlock(block, util.Vector3i16{X: x, Y: y, Z: z}, "")
+	return 0
+}
+
+func levelPlayers(L *lua.LState) int {
+	L.Push(playersTable(L, checkLevel(L, 1).Players()))
+	return 1
+}
+
+// Command senders. Players are passed as players; Anything else, like the console, as a sender.
+
+func senderValue(L *lua.LState, sender core.CommandSender) lua.LValue {
+	if p, isPlayer := sender.(*core.Player); isPlayer {
+		return playerValue(L, p)
+	}
+
+	ud := L.NewUserData()
+	ud.Value = sender
+	L.SetMetatable(ud, L.GetTypeMetatable(senderType))
+	return ud
+}
+
+func checkSender(L *lua.LState, n int) core.CommandSender {
+	if sender, ok := L.CheckUserData(n).Value.(core.CommandSender); ok {
+		return sender
+	}
+	L.ArgError(n, "sender expected")
+	return nil
+}
+
+func senderName(L *lua.LState) int {
+	L.Push(lua.LString(checkSender(L, 1).Name()))
+	return 1
+}
+
+func senderMessage(L *lua.LState) int {
+	checkSender(L, 1).SendMessage(L.CheckString(2))
+	return 0
+}
+
+func senderHasPermission(L *lua.LState) int {
+	L.Push(lua.LBool(checkSender(L, 1).HasPermission(L.CheckString(2))))
+	return 1
+}
+
+func stringsTable(L *lua.LState, strs []string) *lua.LTable {
+	tbl := L.NewTable()
+	for _, str := range strs {
+		tbl.Append(lua.LString(str))
+	}
+	return tbl
+}
+
+func stringsFromTable(tbl *lua.LTable) []string {
+	strs := make([]string, 0, tbl.Len())
+	for i := 1; i <= tbl.Len(); i++ {
+		strs = append(strs, lua.LVAsString(tbl.RawGetInt(i)))
+	}
+	return strs
+}
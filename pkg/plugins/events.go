@@ -0,0 +1,152 @@
+package plugins
+
+import (
+	"midnight/pkg/core"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Events are passed to handlers as tables. Every event has "type", and events that can be cancelled
+// have "cancelled". The other fields are, with the ones handlers can change marked *:
+//
+//	PlayerPreLogin:  username, addr, reason*
+//	PlayerJoin:      player, level*
+//	PlayerQuit:      player, reason
+//	PlayerChat:      player, message*
+//	PlayerMove:      player, from, to*  Positions are tables with x, y, z, yaw and pitch.
+//	BlockPlace:      player, level, x, y, z, block*, old
+//	BlockBreak:      player, level, x, y, z, block
+//	LevelLoad:       level
+//	CommandExecute:  sender, command, args*
+
+// Returns the table passed to handlers for an event.
+func eventTable(L *lua.LState, e core.Event) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("type", lua.LString(e.Type()))
+
+	if c, ok := e.(core.Cancellable); ok {
+		tbl.RawSetString("cancelled", lua.LBool(c.Cancelled()))
+	}
+
+	switch e := e.(type) {
+	case *core.PlayerPreLoginEvent:
+		tbl.RawSetString("username", lua.LString(e.Username))
+		tbl.RawSetString("addr", lua.LString(e.Addr))
+		tbl.RawSetString("reason", lua.LString(e.Reason))
+
+	case *core.PlayerJoinEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("level", levelValue(L, e.Level))
+
+	case *core.PlayerQuitEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("reason", lua.LString(e.Reason))
+
+	case *core.PlayerChatEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("message", lua.LString(e.Message))
+
+	case *core.PlayerMoveEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("from", positionTable(L, e.From))
+		tbl.RawSetString("to", positionTable(L, e.To))
+
+	case *core.BlockPlaceEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("level", levelValue(L, e.Level))
+		setCoords(tbl, e.X, e.Y, e.Z)
+		tbl.RawSetString("block", lua.LNumber(e.Block))
+		tbl.RawSetString("old", lua.LNumber(e.Old))
+
+	case *core.BlockBreakEvent:
+		tbl.RawSetString("player", playerValue(L, e.Player))
+		tbl.RawSetString("level", levelValue(L, e.Level))
+		setCoords(tbl, e.X, e.Y, e.Z)
+		tbl.RawSetString("block", lua.LNumber(e.Block))
+
+	case *core.LevelLoadEvent:
+		tbl.RawSetString("level", levelValue(L, e.Level))
+
+	case *core.CommandExecuteEvent:
+		tbl.RawSetString("sender", senderValue(L, e.Sender))
+		tbl.RawSetString("command", lua.LString(e.Command.Name))
+		tbl.RawSetString("args", stringsTable(L, e.Args))
+	}
+
+	return tbl
+}
+
+// Copies the fields a handler may change from its table back into the event.
+// Fields that were set to something invalid are ignored.
+func applyEventTable(e core.Event, tbl *lua.LTable) {
+	if c, ok := e.(core.Cancellable); ok {
+		c.SetCancelled(lua.LVAsBool(tbl.RawGetString("cancelled")))
+	}
+
+	switch e := e.(type) {
+	case *core.PlayerPreLoginEvent:
+		e.Reason = lua.LVAsString(tbl.RawGetString("reason"))
+
+	case *core.PlayerJoinEvent:
+		if ud, ok := tbl.RawGetString("level").(*lua.LUserData); ok {
+			if l, ok := ud.Value.(*core.Level); ok {
+				e.Level = l
+			}
+		}
+
+	case *core.PlayerChatEvent:
+		e.Message = lua.LVAsString(tbl.RawGetString("message"))
+
+	case *core.PlayerMoveEvent:
+		if to, ok := tbl.RawGetString("to").(*lua.LTable); ok {
+			e.To = tablePosition(to, e.To)
+		}
+
+	case *core.BlockPlaceEvent:
+		if block, found := core.FindBlock(tbl.RawGetString("block").String()); found {
+			e.Block = block
+		}
+
+	case *core.CommandExecuteEvent:
+		if args, ok := tbl.RawGetString("args").(*lua.LTable); ok {
+			e.Args = stringsFromTable(args)
+		}
+	}
+}
+
+func setCoords(tbl *lua.LTable, x, y, z int16) {
+	tbl.RawSetString("x", lua.LNumber(x))
+	tbl.RawSetString("y", lua.LNumber(y))
+	tbl.RawSetString("z", lua.LNumber(z))
+}
+
+func positionTable(L *lua.LState, pos core.Position) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("x", lua.LNumber(pos.X))
+	tbl.RawSetString("y", lua.LNumber(pos.Y))
+	tbl.RawSetString("z", lua.LNumber(pos.Z))
+	tbl.RawSetString("yaw", lua.LNumber(pos.Yaw))
+	tbl.RawSetString("pitch", lua.LNumber(pos.Pitch))
+	return tbl
+}
+
+// Returns the position in a table, keeping the fields of def that it doesn't have.
+func tablePosition(tbl *lua.LTable, def core.Position) core.Position {
+	pos := def
+	if v, ok := tbl.RawGetString("x").(lua.LNumber); ok {
+		pos.X = float32(v)
+	}
+	if v, ok := tbl.RawGetString("y").(lua.LNumber); ok {
+		pos.Y = float32(v)
+	}
+	if v, ok := tbl.RawGetString("z").(lua.LNumber); ok {
+		pos.Z = float32(v)
+	}
+	if v, ok := tbl.RawGetString("yaw").(lua.LNumber); ok {
+		pos.Yaw = byte(v)
+	}
+	if v, ok := tbl.RawGetString("pitch").(lua.LNumber); ok {
+		pos.Pitch = byte(v)
+	}
+	return pos
+}
@@ -0,0 +1,279 @@
+// Package plugins runs Lua scripts from the plugins folder. Scripts use the "midnight" table to
+// handle events, register commands and work with players and levels; See api.go for what it offers.
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"midnight/pkg/core"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const PluginsDir = "plugins"
+
+// How long a script may run at a time before it's stopped, e.g. when it's stuck in a loop
+const callTimeout = 2 * time.Second
+
+var errUnloaded = errors.New("plugin has been unloaded")
+
+type Host struct {
+	s   *core.Server
+	dir string
+
+	mu      sync.Mutex         // Guards plugins; Held while plugins are loaded and unloaded
+	plugins map[string]*Plugin // Loaded plugins by lowercase name
+}
+
+// A loaded script. Its name is the file name without ".lua".
+type Plugin struct {
+	Name string
+	host *Host
+
+	// Guards everything below. A Lua state can only be used by one goroutine at a time, and
+	// events are fired from many, so every call into the script holds mu.
+	mu       sync.Mutex
+	L        *lua.LState
+	handlers []*core.EventHandler
+	commands []*core.Command
+	unloaded bool
+}
+
+// Loads every script in the plugins folder and registers /plugins, which reloads them.
+// Scripts that fail to load are logged and skipped.
+func Start(s *core.Server) *Host {
+	h := &Host{s: s, dir: PluginsDir, plugins: make(map[string]*Plugin)}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		log.Printf("Could not create the plugins folder: %v", err)
+	}
+
+	h.LoadAll()
+
+	core.RegisterCommand(&core.Command{
+		Name:        "plugins",
+		Aliases:     []string{"pl"},
+		Usage:       "[reload [plugin]]",
+		Description: "Lists the plugins, or reloads one or all of them from the plugins folder.",
+		Permission:  "command.plugins",
+		Handler:     h.cmdPlugins,
+	})
+
+	return h
+}
+
+// Unloads every plugin, then loads every script in the plugins folder. Returns the number of plugins loaded.
+func (h *Host) LoadAll() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, pl := range h.plugins {
+		pl.unload()
+	}
+	h.plugins = make(map[string]*Plugin)
+
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("Could not read the plugins folder: %v", err)
+		return 0
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".lua") {
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), ".lua")
+		if _, err := h.loadLocked(name); err != nil {
+			log.Printf("Could not load plugin '%v': %v", name, err)
+		}
+	}
+
+	return len(h.plugins)
+}
+
+// Unloads a plugin if it's loaded, then loads it again from the plugins folder.
+func (h *Host) Reload(name string) (*Plugin, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if pl := h.plugins[strings.ToLower(name)]; pl != nil {
+		pl.unload()
+		delete(h.plugins, strings.ToLower(name))
+		name = pl.Name
+	}
+
+	return h.loadLocked(name)
+}
+
+// Returns the loaded plugins, sorted by name.
+func (h *Host) Plugins() []*Plugin {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	plugins := make([]*Plugin, 0, len(h.plugins))
+	for _, pl := range h.plugins {
+		plugins = append(plugins, pl)
+	}
+
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+// The caller must hold h.mu.
+func (h *Host) loadLocked(name string) (*Plugin, error) {
+	if !isValidPluginName(name) {
+		return nil, fmt.Errorf("plugin names can only contain letters, digits, '_' and '-'")
+	}
+
+	path := filepath.Join(h.dir, name+".lua")
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	pl := &Plugin{Name: name, host: h}
+	pl.L = lua.NewState()
+	openAPI(pl)
+
+	// Held while the script runs, so events fired meanwhile wait until it has finished loading
+	pl.mu.Lock()
+	err := pl.run(func() error { return pl.L.DoFile(path) })
+	pl.mu.Unlock()
+
+	if err != nil {
+		pl.unload()
+		return nil, err
+	}
+
+	h.plugins[strings.ToLower(name)] = pl
+	log.Printf("Loaded plugin '%v'", name)
+	return pl, nil
+}
+
+func isValidPluginName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the plugin's event handlers and commands and closes its Lua state.
+func (pl *Plugin) unload() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.unloaded {
+		return
+	}
+	pl.unloaded = true
+
+	for _, eh := range pl.handlers {
+		core.UnregisterEventHandler(eh)
+	}
+	for _, cmd := range pl.commands {
+		core.UnregisterCommand(cmd)
+	}
+	pl.handlers, pl.commands = nil, nil
+
+	pl.L.Close()
+}
+
+// Runs fn, which calls into the script, stopping the script if it takes longer than callTimeout.
+// The caller must hold pl.mu.
+func (pl *Plugin) run(fn func() error) error {
+	if pl.unloaded {
+		return errUnloaded
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	pl.L.SetContext(ctx)
+	defer pl.L.RemoveContext()
+
+	return fn()
+}
+
+// Calls a Lua function with the arguments made by args, then passes its first result to done.
+// Both run while the plugin is locked, so they can use its Lua state. Errors in the script are
+// returned, never raised.
+func (pl *Plugin) call(fn *lua.LFunction, args func() []lua.LValue, done func(result lua.LValue)) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	return pl.run(func() error {
+		if err := pl.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args()...); err != nil {
+			return err
+		}
+
+		result := pl.L.Get(-1)
+		pl.L.Pop(1)
+
+		if done != nil {
+			done(result)
+		}
+		return nil
+	})
+}
+
+// Logs an error from the script.
+func (pl *Plugin) logError(where string, err error) {
+	if err != errUnloaded {
+		log.Printf("[Plugin %v] Error in %v: %v", pl.Name, where, err)
+	}
+}
+
+func (h *Host) cmdPlugins(s *core.Server, sender core.CommandSender, args []string) error {
+	if len(args) == 0 {
+		var names []string
+		for _, pl := range h.Plugins() {
+			names = append(names, pl.Name)
+		}
+
+		if len(names) == 0 {
+			sender.SendMessage("&eNo plugins are loaded.")
+		} else {
+			sender.SendMessage("&ePlugins: &f" + strings.Join(names, ", "))
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(args[0], "reload") || len(args) > 2 {
+		return core.ErrCommandUsage
+	}
+
+	if len(args) == 1 {
+		n := h.LoadAll()
+		sender.SendMessage(fmt.Sprintf("&eReloaded %v plugins.", n))
+		log.Printf("%v reloaded the plugins", sender.Name())
+		return nil
+	}
+
+	pl, err := h.Reload(args[1])
+	if os.IsNotExist(err) {
+		return fmt.Errorf("there is no plugin named '%v'", args[1])
+	} else if err != nil {
+		sender.SendMessage("&cCould not load plugin '" + args[1] + "'; See the log for details.")
+		log.Printf("Could not load plugin '%v': %v", args[1], err)
+		return nil
+	}
+
+	sender.SendMessage("&eReloaded plugin '" + pl.Name + "'.")
+	log.Printf("%v reloaded plugin '%v'", sender.Name(), pl.Name)
+	return nil
+}
@@ -0,0 +1,452 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+)
+
+// Positions are fixed-point numbers with 5 fractional bits (1/32 of a block).
+// Angles are fractions of a full turn, from 0 to 255.
+
+// 0x00 - Sent by the client to join
+type PlayerIdentification struct {
+	ProtocolVersion byte
+	Username        string
+	VerificationKey string
+	Padding         byte // 0x42 if the client supports CPE
+}
+
+func (p *PlayerIdentification) Id() byte { return IdIdentification }
+
+func (p *PlayerIdentification) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.byte(p.ProtocolVersion)
+	pw.string(p.Username)
+	pw.string(p.VerificationKey)
+	pw.byte(p.Padding)
+	return pw.err
+}
+
+func (p *PlayerIdentification) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.ProtocolVersion = pr.byte()
+	p.Username = pr.string()
+	p.VerificationKey = pr.string()
+	p.Padding = pr.byte()
+	return pr.err
+}
+
+// 0x00 - Sent by the server in response to PlayerIdentification
+type ServerIdentification struct {
+	ProtocolVersion byte
+	Name            string
+	MOTD            string
+	UserType        byte // 0x64 for operators, who can break bedrock
+}
+
+func (p *ServerIdentification) Id() byte { return IdIdentification }
+
+func (p *ServerIdentification) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.byte(p.ProtocolVersion)
+	pw.string(p.Name)
+	pw.string(p.MOTD)
+	pw.byte(p.UserType)
+	return pw.err
+}
+
+func (p *ServerIdentification) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.ProtocolVersion = pr.byte()
+	p.Name = pr.string()
+	p.MOTD = pr.string()
+	p.UserType = pr.byte()
+	return pr.err
+}
+
+// 0x01
+type Ping struct{}
+
+func (p *Ping) Id() byte                 { return IdPing }
+func (p *Ping) Encode(w io.Writer) error { return nil }
+func (p *Ping) Decode(r io.Reader) error { return nil }
+
+// 0x02
+type LevelInitialize struct{}
+
+func (p *LevelInitialize) Id() byte                 { return IdLevelInitialize }
+func (p *LevelInitialize) Encode(w io.Writer) error { return nil }
+func (p *LevelInitialize) Decode(r io.Reader) error { return nil }
+
+// 0x03 - Up to 1024 bytes of the gzipped level
+type LevelDataChunk struct {
+	Data            []byte
+	PercentComplete byte
+}
+
+func (p *LevelDataChunk) Id() byte { return IdLevelDataChunk }
+
+func (p *LevelDataChunk) Encode(w io.Writer) error {
+	if len(p.Data) > 1024 {
+		return fmt.Errorf("level data chunk of %v bytes is longer than 1024 bytes", len(p.Data))
+	}
+
+	var chunk [1024]byte
+	copy(chunk[:], p.Data)
+
+	pw := writer{w: w}
+	pw.short(int16(len(p.Data)))
+	pw.bytes(chunk[:])
+	pw.byte(p.PercentComplete)
+	return pw.err
+}
+
+func (p *LevelDataChunk) Decode(r io.Reader) error {
+	var chunk [1024]byte
+
+	pr := reader{r: r}
+	length := pr.short()
+	pr.bytes(chunk[:])
+	p.PercentComplete = pr.byte()
+
+	if pr.err != nil {
+		return pr.err
+	}
+	if length < 0 || length > 1024 {
+		return fmt.Errorf("invalid level data chunk length [%v]", length)
+	}
+
+	p.Data = append([]byte(nil), chunk[:length]...)
+	return nil
+}
+
+// 0x04
+type LevelFinalize struct {
+	X, Y, Z int16
+}
+
+func (p *LevelFinalize) Id() byte { return IdLevelFinalize }
+
+func (p *LevelFinalize) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.short(p.X)
+	pw.short(p.Y)
+	pw.short(p.Z)
+	return pw.err
+}
+
+func (p *LevelFinalize) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.X = pr.short()
+	p.Y = pr.short()
+	p.Z = pr.short()
+	return pr.err
+}
+
+// 0x05 - Sent by the client when it places or breaks a block
+type SetBlockClient struct {
+	X, Y, Z   int16
+	Mode      byte // 0x00 when a block is broken, 0x01 when it's placed
+	BlockType byte
+}
+
+func (p *SetBlockClient) Id() byte { return IdSetBlockClient }
+
+func (p *SetBlockClient) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.short(p.X)
+	pw.short(p.Y)
+	pw.short(p.Z)
+	pw.byte(p.Mode)
+	pw.byte(p.BlockType)
+	return pw.err
+}
+
+func (p *SetBlockClient) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.X = pr.short()
+	p.Y = pr.short()
+	p.Z = pr.short()
+	p.Mode = pr.byte()
+	p.BlockType = pr.byte()
+	return pr.err
+}
+
+// 0x06 - Sent by the server when a block changes
+type SetBlock struct {
+	X, Y, Z   int16
+	BlockType byte
+}
+
+func (p *SetBlock) Id() byte { return IdSetBlock }
+
+func (p *SetBlock) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.short(p.X)
+	pw.short(p.Y)
+	pw.short(p.Z)
+	pw.byte(p.BlockType)
+	return pw.err
+}
+
+func (p *SetBlock) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.X = pr.short()
+	p.Y = pr.short()
+	p.Z = pr.short()
+	p.BlockType = pr.byte()
+	return pr.err
+}
+
+// 0x07
+type SpawnPlayer struct {
+	PlayerId   int8 // -1 spawns the receiving player themselves
+	PlayerName string
+	X, Y, Z    int16
+	Yaw, Pitch byte
+}
+
+func (p *SpawnPlayer) Id() byte { return IdSpawnPlayer }
+
+func (p *SpawnPlayer) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.string(p.PlayerName)
+	pw.short(p.X)
+	pw.short(p.Y)
+	pw.short(p.Z)
+	pw.byte(p.Yaw)
+	pw.byte(p.Pitch)
+	return pw.err
+}
+
+func (p *SpawnPlayer) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.PlayerName = pr.string()
+	p.X = pr.short()
+	p.Y = pr.short()
+	p.Z = pr.short()
+	p.Yaw = pr.byte()
+	p.Pitch = pr.byte()
+	return pr.err
+}
+
+// 0x08 - Sent by the client when it moves, and by the server to teleport a player
+type PositionOrientation struct {
+	PlayerId   int8 // Always -1 when sent by the client
+	X, Y, Z    int16
+	Yaw, Pitch byte
+}
+
+func (p *PositionOrientation) Id() byte { return IdPositionOrientation }
+
+func (p *PositionOrientation) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.short(p.X)
+	pw.short(p.Y)
+	pw.short(p.Z)
+	pw.byte(p.Yaw)
+	pw.byte(p.Pitch)
+	return pw.err
+}
+
+func (p *PositionOrientation) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.X = pr.short()
+	p.Y = pr.short()
+	p.Z = pr.short()
+	p.Yaw = pr.byte()
+	p.Pitch = pr.byte()
+	return pr.err
+}
+
+// 0x09 - Relative movement and orientation
+type PositionOrientationUpdate struct {
+	PlayerId   int8
+	DX, DY, DZ int8
+	Yaw, Pitch byte
+}
+
+func (p *PositionOrientationUpdate) Id() byte { return IdPositionOrientationUpdate }
+
+func (p *PositionOrientationUpdate) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.sbyte(p.DX)
+	pw.sbyte(p.DY)
+	pw.sbyte(p.DZ)
+	pw.byte(p.Yaw)
+	pw.byte(p.Pitch)
+	return pw.err
+}
+
+func (p *PositionOrientationUpdate) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.DX = pr.sbyte()
+	p.DY = pr.sbyte()
+	p.DZ = pr.sbyte()
+	p.Yaw = pr.byte()
+	p.Pitch = pr.byte()
+	return pr.err
+}
+
+// 0x0A - Relative movement
+type PositionUpdate struct {
+	PlayerId   int8
+	DX, DY, DZ int8
+}
+
+func (p *PositionUpdate) Id() byte { return IdPositionUpdate }
+
+func (p *PositionUpdate) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.sbyte(p.DX)
+	pw.sbyte(p.DY)
+	pw.sbyte(p.DZ)
+	return pw.err
+}
+
+func (p *PositionUpdate) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.DX = pr.sbyte()
+	p.DY = pr.sbyte()
+	p.DZ = pr.sbyte()
+	return pr.err
+}
+
+// 0x0B
+type OrientationUpdate struct {
+	PlayerId   int8
+	Yaw, Pitch byte
+}
+
+func (p *OrientationUpdate) Id() byte { return IdOrientationUpdate }
+
+func (p *OrientationUpdate) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.byte(p.Yaw)
+	pw.byte(p.Pitch)
+	return pw.err
+}
+
+func (p *OrientationUpdate) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.Yaw = pr.byte()
+	p.Pitch = pr.byte()
+	return pr.err
+}
+
+// 0x0C
+type DespawnPlayer struct {
+	PlayerId int8
+}
+
+func (p *DespawnPlayer) Id() byte { return IdDespawnPlayer }
+
+func (p *DespawnPlayer) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	return pw.err
+}
+
+func (p *DespawnPlayer) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	return pr.err
+}
+
+// 0x0D - A chat message. The message keeps its space padding, since with LongerMessages
+// a message sent in parts can have spaces at the end of a part.
+type Message struct {
+	// Sent by the server: the ID of the player who sent the message, or -1.
+	// Sent by the client: unused (0xFF), or with LongerMessages non-zero if more parts follow.
+	PlayerId int8
+	Message  string
+}
+
+func (p *Message) Id() byte { return IdMessage }
+
+func (p *Message) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.sbyte(p.PlayerId)
+	pw.string(p.Message)
+	return pw.err
+}
+
+func (p *Message) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.PlayerId = pr.sbyte()
+	p.Message = pr.rawString()
+	return pr.err
+}
+
+// 0x0E
+type DisconnectPlayer struct {
+	Reason string
+}
+
+func (p *DisconnectPlayer) Id() byte { return IdDisconnectPlayer }
+
+func (p *DisconnectPlayer) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.string(p.Reason)
+	return pw.err
+}
+
+func (p *DisconnectPlayer) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.Reason = pr.string()
+	return pr.err
+}
+
+// 0x0F
+type UpdateUserType struct {
+	UserType byte
+}
+
+func (p *UpdateUserType) Id() byte { return IdUpdateUserType }
+
+func (p *UpdateUserType) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.byte(p.UserType)
+	return pw.err
+}
+
+func (p *UpdateUserType) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.UserType = pr.byte()
+	return pr.err
+}
+
+// A packet with a known length that isn't decoded; Data holds the bytes after the ID.
+type Raw struct {
+	PacketId byte
+	Data     []byte
+}
+
+func (p *Raw) Id() byte { return p.PacketId }
+
+func (p *Raw) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.bytes(p.Data)
+	return pw.err
+}
+
+func (p *Raw) Decode(r io.Reader) error {
+	if Lengths[p.PacketId] == 0 {
+		return fmt.Errorf("%w [%v]", ErrUnknownPacket, p.PacketId)
+	}
+	p.Data = make([]byte, Lengths[p.PacketId]-1)
+
+	pr := reader{r: r}
+	pr.bytes(p.Data)
+	return pr.err
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"io"
+	"strings"
+)
+
+// Reads protocol data types. The first error is kept and every later read is skipped,
+// so a packet's fields can be read in a row and the error checked once at the end.
+type reader struct {
+	r   io.Reader
+	buf [64]byte
+	err error
+}
+
+func (r *reader) read(n int) []byte {
+	if r.err != nil {
+		return r.buf[:n]
+	}
+
+	_, r.err = io.ReadFull(r.r, r.buf[:n])
+	return r.buf[:n]
+}
+
+func (r *reader) byte() byte {
+	return r.read(1)[0]
+}
+
+func (r *reader) sbyte() int8 {
+	return int8(r.read(1)[0])
+}
+
+func (r *reader) short() int16 {
+	b := r.read(2)
+	return int16(b[0])<<8 | int16(b[1])
+}
+
+func (r *reader) int() int32 {
+	b := r.read(4)
+	return int32(b[0])<<24 | int32(b[1])<<16 | int32(b[2])<<8 | int32(b[3])
+}
+
+// Reads a 64-byte string, removing its space padding.
+func (r *reader) string() string {
+	return strings.TrimRight(r.rawString(), " ")
+}
+
+// Reads a 64-byte string, keeping its space padding.
+func (r *reader) rawString() string {
+	return string(r.read(64))
+}
+
+func (r *reader) bytes(dst []byte) {
+	if r.err != nil {
+		return
+	}
+
+	_, r.err = io.ReadFull(r.r, dst)
+}
+
+// Writes protocol data types, keeping the first error like reader.
+type writer struct {
+	w   io.Writer
+	err error
+}
+
+func (w *writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = w.w.Write(b)
+}
+
+func (w *writer) byte(v byte) {
+	w.write([]byte{v})
+}
+
+func (w *writer) sbyte(v int8) {
+	w.write([]byte{byte(v)})
+}
+
+func (w *writer) short(v int16) {
+	w.write([]byte{byte(v >> 8), byte(v)})
+}
+
+func (w *writer) int(v int32) {
+	w.write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// Writes a string padded with spaces to 64 bytes. Longer strings are cut off.
+func (w *writer) string(s string) {
+	w.write(PadString(s))
+}
+
+func (w *writer) bytes(b []byte) {
+	w.write(b)
+}
+
+// Returns a string as the 64 bytes sent over the protocol, padded with spaces.
+func PadString(s string) []byte {
+	var raw [64]byte
+	copy(raw[:], s)
+
+	for i := len(s); i < 64; i++ {
+		raw[i] = 0x20 // ASCII space padding
+	}
+
+	return raw[:]
+}
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Returns Data of the given length, filled with a pattern so that misplaced bytes show up.
+func rawData(id byte) []byte {
+	data := make([]byte, Lengths[id]-1)
+	for i := range data {
+		data[i] = byte(i*7 + int(id))
+	}
+	return data
+}
+
+// A packet of every ID in Lengths. IDs that aren't decoded into their own type are sent as Raw packets.
+func testPackets() []Packet {
+	packets := []Packet{
+		&PlayerIdentification{ProtocolVersion: ProtocolVersion, Username: "Player_1", VerificationKey: "0123456789abcdef0123456789abcdef", Padding: 0x42},
+		&ServerIdentification{ProtocolVersion: ProtocolVersion, Name: "Midnight", MOTD: "-hax +fly", UserType: 0x64},
+		&Ping{},
+		&LevelInitialize{},
+		&LevelDataChunk{Data: []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0x00, 0x7f}, PercentComplete: 42},
+		&LevelFinalize{X: 64, Y: 128, Z: 512},
+		&SetBlockClient{X: 1, Y: -2, Z: 300, Mode: 0x01, BlockType: 49},
+		&SetBlock{X: 511, Y: 0, Z: -1, BlockType: 65},
+		&SpawnPlayer{PlayerId: -1, PlayerName: "&cAdmin", X: -32, Y: 1024, Z: 16383, Yaw: 255, Pitch: 128},
+		&PositionOrientation{PlayerId: 12, X: 100, Y: -100, Z: 32767, Yaw: 1, Pitch: 254},
+		&PositionOrientationUpdate{PlayerId: 3, DX: -128, DY: 127, DZ: 0, Yaw: 64, Pitch: 192},
+		&PositionUpdate{PlayerId: 126, DX: 5, DY: -5, DZ: 1},
+		&OrientationUpdate{PlayerId: 0, Yaw: 10, Pitch: 20},
+		&DespawnPlayer{PlayerId: 7},
+		&Message{PlayerId: -1, Message: string(PadString("&eHello, world! 1234567890 ~!@#$%^&*()_+{}|:<>?"))}, // Messages keep their padding
+		&DisconnectPlayer{Reason: "Kicked: too many messages"},
+		&UpdateUserType{UserType: 0x64},
+
+		&ExtInfo{AppName: "ClassiCube 1.3.6", ExtensionCount: 42},
+		&ExtEntry{ExtName: "LongerMessages", Version: 1},
+		&CustomBlockSupportLevel{SupportLevel: 1},
+	}
+
+	covered := make(map[byte]bool)
+	for _, p := range packets {
+		covered[p.Id()] = true
+	}
+
+	for id := 0; id < 256; id++ {
+		if Lengths[id] != 0 && !covered[byte(id)] {
+			packets = append(packets, &Raw{PacketId: byte(id), Data: rawData(byte(id))})
+		}
+	}
+
+	return packets
+}
+
+// Returns an empty packet of the same type, ready to be decoded into.
+func emptyPacket(p Packet) Packet {
+	if raw, ok := p.(*Raw); ok {
+		return &Raw{PacketId: raw.PacketId}
+	}
+	return reflect.New(reflect.TypeOf(p).Elem()).Interface().(Packet)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, p := range testPackets() {
+		data, err := Marshal(p)
+		if err != nil {
+			t.Errorf("[%v] %T: could not encode: %v", p.Id(), p, err)
+			continue
+		}
+
+		if len(data) != Lengths[p.Id()] {
+			t.Errorf("[%v] %T: encoded to %v bytes; Expected %v", p.Id(), p, len(data), Lengths[p.Id()])
+			continue
+		}
+		if data[0] != p.Id() {
+			t.Errorf("[%v] %T: encoded with ID %v", p.Id(), p, data[0])
+		}
+
+		decoded := emptyPacket(p)
+		if err := decoded.Decode(bytes.NewReader(data[1:])); err != nil {
+			t.Errorf("[%v] %T: could not decode: %v", p.Id(), p, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, p) {
+			t.Errorf("[%v] %T: decoded to %+v; Expected %+v", p.Id(), p, decoded, p)
+		}
+	}
+}
+
+// Read decodes packets sent by clients into their own types, and reads other packets as Raw packets.
+func TestRead(t *testing.T) {
+	for _, p := range testPackets() {
+		if _, isServerIdentification := p.(*ServerIdentification); isServerIdentification {
+			continue
+		}
+
+		data, err := Marshal(p)
+		if err != nil {
+			t.Errorf("[%v] %T: could not encode: %v", p.Id(), p, err)
+			continue
+		}
+
+		r := bytes.NewReader(append(data, 0xAB)) // A byte of the next packet, which must be left unread
+		read, err := Read(r)
+		if err != nil {
+			t.Errorf("[%v] %T: could not read: %v", p.Id(), p, err)
+			continue
+		}
+		if r.Len() != 1 {
+			t.Errorf("[%v] %T: read %v bytes; Expected %v", p.Id(), p, len(data)+1-r.Len(), len(data))
+		}
+
+		expected := p
+		if _, isClientPacket := clientPackets[p.Id()]; !isClientPacket {
+			expected = &Raw{PacketId: p.Id(), Data: data[1:]}
+		}
+		if !reflect.DeepEqual(read, expected) {
+			t.Errorf("[%v] %T: read %+v; Expected %+v", p.Id(), p, read, expected)
+		}
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	for _, p := range testPackets() {
+		data, err := Marshal(p)
+		if err != nil {
+			t.Errorf("[%v] %T: could not encode: %v", p.Id(), p, err)
+			continue
+		}
+
+		if len(data) == 1 {
+			continue // Nothing after the ID to leave out
+		}
+
+		for _, n := range []int{1, len(data) / 2, len(data) - 1} {
+			if _, err := Read(bytes.NewReader(data[:n])); err != io.ErrUnexpectedEOF {
+				t.Errorf("[%v] %T: reading %v of %v bytes returned %v; Expected %v", p.Id(), p, n, len(data), err, io.ErrUnexpectedEOF)
+			}
+
+			if err := emptyPacket(p).Decode(bytes.NewReader(data[1:n])); err == nil {
+				t.Errorf("[%v] %T: decoding %v of %v bytes succeeded", p.Id(), p, n-1, len(data)-1)
+			}
+		}
+	}
+
+	if _, err := Read(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("reading nothing returned %v; Expected %v", err, io.EOF)
+	}
+}
+
+func TestUnknownIds(t *testing.T) {
+	for id := 0; id < 256; id++ {
+		if Lengths[id] != 0 {
+			continue
+		}
+
+		data := append([]byte{byte(id)}, make([]byte, 128)...)
+		if _, err := Read(bytes.NewReader(data)); !errors.Is(err, ErrUnknownPacket) {
+			t.Errorf("[%v] reading returned %v; Expected %v", id, err, ErrUnknownPacket)
+		}
+
+		if err := Write(ioutil.Discard, &Raw{PacketId: byte(id), Data: []byte{1, 2, 3}}); err == nil {
+			t.Errorf("[%v] writing succeeded", id)
+		}
+
+		if err := (&Raw{PacketId: byte(id)}).Decode(bytes.NewReader(data[1:])); !errors.Is(err, ErrUnknownPacket) {
+			t.Errorf("[%v] decoding returned %v; Expected %v", id, err, ErrUnknownPacket)
+		}
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet Packet
+	}{
+		{"level data chunk over 1024 bytes", &LevelDataChunk{Data: make([]byte, 1025)}},
+		{"raw packet too short", &Raw{PacketId: IdBulkBlockUpdate, Data: make([]byte, 10)}},
+		{"raw packet too long", &Raw{PacketId: IdPing, Data: []byte{0}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := Marshal(tt.packet); err == nil {
+			t.Errorf("%v: encoding succeeded", tt.name)
+		}
+	}
+}
+
+// Strings are padded with spaces to 64 bytes, and cut off after 64 bytes.
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"Hello", "Hello"},
+		{"Trailing spaces   ", "Trailing spaces"},
+		{string(bytes.Repeat([]byte("a"), 64)), string(bytes.Repeat([]byte("a"), 64))},
+		{string(bytes.Repeat([]byte("b"), 80)), string(bytes.Repeat([]byte("b"), 64))},
+	}
+
+	for _, tt := range tests {
+		data, err := Marshal(&DisconnectPlayer{Reason: tt.in})
+		if err != nil {
+			t.Errorf("%q: could not encode: %v", tt.in, err)
+			continue
+		}
+
+		var p DisconnectPlayer
+		if err := p.Decode(bytes.NewReader(data[1:])); err != nil {
+			t.Errorf("%q: could not decode: %v", tt.in, err)
+			continue
+		}
+		if p.Reason != tt.out {
+			t.Errorf("%q: decoded to %q; Expected %q", tt.in, p.Reason, tt.out)
+		}
+
+		// Messages keep the padding, which matters for the parts of a LongerMessages message
+		var m Message
+		if err := m.Decode(bytes.NewReader(append([]byte{0xFF}, data[1:]...))); err != nil {
+			t.Errorf("%q: could not decode message: %v", tt.in, err)
+			continue
+		}
+		if m.Message != string(PadString(tt.in)) {
+			t.Errorf("%q: message decoded to %q; Expected it padded to 64 bytes", tt.in, m.Message)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import "io"
+
+// 0x10 - Sent by both sides to start extension negotiation
+type ExtInfo struct {
+	AppName        string
+	ExtensionCount int16
+}
+
+func (p *ExtInfo) Id() byte { return IdExtInfo }
+
+func (p *ExtInfo) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.string(p.AppName)
+	pw.short(p.ExtensionCount)
+	return pw.err
+}
+
+func (p *ExtInfo) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.AppName = pr.string()
+	p.ExtensionCount = pr.short()
+	return pr.err
+}
+
+// 0x11 - One per extension, following ExtInfo
+type ExtEntry struct {
+	ExtName string
+	Version int32
+}
+
+func (p *ExtEntry) Id() byte { return IdExtEntry }
+
+func (p *ExtEntry) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.string(p.ExtName)
+	pw.int(p.Version)
+	return pw.err
+}
+
+func (p *ExtEntry) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.ExtName = pr.string()
+	p.Version = pr.int()
+	return pr.err
+}
+
+// 0x13 - CustomBlocks; Sent by the server with the highest support level, and echoed by the client
+type CustomBlockSupportLevel struct {
+	SupportLevel byte
+}
+
+func (p *CustomBlockSupportLevel) Id() byte { return IdCustomBlockSupportLevel }
+
+func (p *CustomBlockSupportLevel) Encode(w io.Writer) error {
+	pw := writer{w: w}
+	pw.byte(p.SupportLevel)
+	return pw.err
+}
+
+func (p *CustomBlockSupportLevel) Decode(r io.Reader) error {
+	pr := reader{r: r}
+	p.SupportLevel = pr.byte()
+	return pr.err
+}
@@ -0,0 +1,220 @@
+// Package protocol encodes and decodes the packets of the Classic protocol (version 7)
+// and the Classic Protocol Extension.
+//
+// Every packet starts with a one-byte ID and has a fixed length, listed in Lengths.
+// A packet's Encode and Decode methods handle the fields after the ID; Read and Write
+// handle whole packets including the ID.
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const ProtocolVersion byte = 0x07
+
+// Classic packet IDs
+const (
+	IdIdentification            byte = 0x00
+	IdPing                      byte = 0x01
+	IdLevelInitialize           byte = 0x02
+	IdLevelDataChunk            byte = 0x03
+	IdLevelFinalize             byte = 0x04
+	IdSetBlockClient            byte = 0x05
+	IdSetBlock                  byte = 0x06
+	IdSpawnPlayer               byte = 0x07
+	IdPositionOrientation       byte = 0x08
+	IdPositionOrientationUpdate byte = 0x09
+	IdPositionUpdate            byte = 0x0A
+	IdOrientationUpdate         byte = 0x0B
+	IdDespawnPlayer             byte = 0x0C
+	IdMessage                   byte = 0x0D
+	IdDisconnectPlayer          byte = 0x0E
+	IdUpdateUserType            byte = 0x0F
+)
+
+// CPE packet IDs
+const (
+	IdExtInfo                 byte = 0x10
+	IdExtEntry                byte = 0x11
+	IdSetClickDistance        byte = 0x12
+	IdCustomBlockSupportLevel byte = 0x13
+	IdHoldThis                byte = 0x14
+	IdSetTextHotKey           byte = 0x15
+	IdExtAddPlayerName        byte = 0x16
+	IdExtAddEntity            byte = 0x17
+	IdExtRemovePlayerName     byte = 0x18
+	IdEnvSetColor             byte = 0x19
+	IdMakeSelection           byte = 0x1A
+	IdRemoveSelection         byte = 0x1B
+	IdSetBlockPermission      byte = 0x1C
+	IdChangeModel             byte = 0x1D
+	IdEnvSetMapAppearance     byte = 0x1E
+	IdEnvSetWeatherType       byte = 0x1F
+	IdHackControl             byte = 0x20
+	IdExtAddEntity2           byte = 0x21
+	IdPlayerClicked           byte = 0x22
+	IdDefineBlock             byte = 0x23
+	IdRemoveBlockDefinition   byte = 0x24
+	IdDefineBlockExt          byte = 0x25
+	IdBulkBlockUpdate         byte = 0x26
+	IdSetTextColor            byte = 0x27
+	IdSetMapEnvUrl            byte = 0x28
+	IdSetMapEnvProperty       byte = 0x29
+	IdSetEntityProperty       byte = 0x2A
+	IdTwoWayPing              byte = 0x2B
+	IdSetInventoryOrder       byte = 0x2C
+	IdSetHotbar               byte = 0x2D
+	IdSetSpawnpoint           byte = 0x2E
+	IdVelocityControl         byte = 0x2F
+	IdDefineEffect            byte = 0x30
+	IdSpawnEffect             byte = 0x31
+	IdDefineModel             byte = 0x32
+	IdDefineModelPart         byte = 0x33
+	IdUndefineModel           byte = 0x34
+	IdPluginMessage           byte = 0x35
+	IdExtEntityTeleport       byte = 0x36
+)
+
+// Lengths of packets in bytes, including the ID, by packet ID. Unknown IDs have a length of 0.
+// CPE packets whose length depends on the extension version use the length of version 1.
+var Lengths = [256]int{
+	IdIdentification:            131,
+	IdPing:                      1,
+	IdLevelInitialize:           1,
+	IdLevelDataChunk:            1028,
+	IdLevelFinalize:             7,
+	IdSetBlockClient:            9,
+	IdSetBlock:                  8,
+	IdSpawnPlayer:               74,
+	IdPositionOrientation:       10,
+	IdPositionOrientationUpdate: 7,
+	IdPositionUpdate:            5,
+	IdOrientationUpdate:         4,
+	IdDespawnPlayer:             2,
+	IdMessage:                   66,
+	IdDisconnectPlayer:          65,
+	IdUpdateUserType:            2,
+
+	IdExtInfo:                 67,
+	IdExtEntry:                69,
+	IdSetClickDistance:        3,
+	IdCustomBlockSupportLevel: 2,
+	IdHoldThis:                3,
+	IdSetTextHotKey:           134,
+	IdExtAddPlayerName:        196,
+	IdExtAddEntity:            130,
+	IdExtRemovePlayerName:     3,
+	IdEnvSetColor:             8,
+	IdMakeSelection:           86,
+	IdRemoveSelection:         2,
+	IdSetBlockPermission:      4,
+	IdChangeModel:             66,
+	IdEnvSetMapAppearance:     69,
+	IdEnvSetWeatherType:       2,
+	IdHackControl:             8,
+	IdExtAddEntity2:           138,
+	IdPlayerClicked:           15,
+	IdDefineBlock:             80,
+	IdRemoveBlockDefinition:   2,
+	IdDefineBlockExt:          85,
+	IdBulkBlockUpdate:         1282,
+	IdSetTextColor:            6,
+	IdSetMapEnvUrl:            65,
+	IdSetMapEnvProperty:       6,
+	IdSetEntityProperty:       7,
+	IdTwoWayPing:              4,
+	IdSetInventoryOrder:       3,
+	IdSetHotbar:               3,
+	IdSetSpawnpoint:           9,
+	IdVelocityControl:         16,
+	IdDefineEffect:            36,
+	IdSpawnEffect:             26,
+	IdDefineModel:             116,
+	IdDefineModelPart:         104,
+	IdUndefineModel:           2,
+	IdPluginMessage:           66,
+	IdExtEntityTeleport:       11,
+}
+
+type Packet interface {
+	Id() byte
+	Encode(w io.Writer) error // Writes the fields after the packet ID
+	Decode(r io.Reader) error // Reads the fields after the packet ID
+}
+
+var ErrUnknownPacket = errors.New("unknown packet ID")
+
+// Packets sent by clients, by packet ID. Other packets with a known length are read as Raw packets.
+var clientPackets = map[byte]func() Packet{
+	IdIdentification:          func() Packet { return new(PlayerIdentification) },
+	IdSetBlockClient:          func() Packet { return new(SetBlockClient) },
+	IdPositionOrientation:     func() Packet { return new(PositionOrientation) },
+	IdMessage:                 func() Packet { return new(Message) },
+	IdExtInfo:                 func() Packet { return new(ExtInfo) },
+	IdExtEntry:                func() Packet { return new(ExtEntry) },
+	IdCustomBlockSupportLevel: func() Packet { return new(CustomBlockSupportLevel) },
+}
+
+// Reads a packet sent by a client. The whole packet is read before it's decoded, so a
+// packet is never left half-read.
+func Read(r io.Reader) (Packet, error) {
+	var id [1]byte
+	if _, err := io.ReadFull(r, id[:]); err != nil {
+		return nil, err
+	}
+
+	length := Lengths[id[0]]
+	if length == 0 {
+		return nil, fmt.Errorf("%w [%v]", ErrUnknownPacket, id[0])
+	}
+
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	newPacket, found := clientPackets[id[0]]
+	if !found {
+		return &Raw{PacketId: id[0], Data: body}, nil
+	}
+
+	p := newPacket()
+	if err := p.Decode(bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Writes a whole packet, including its ID, with a single call to w.Write.
+func Write(w io.Writer, p Packet) error {
+	var buf bytes.Buffer
+	buf.WriteByte(p.Id())
+
+	if err := p.Encode(&buf); err != nil {
+		return err
+	}
+
+	if buf.Len() != Lengths[p.Id()] {
+		return fmt.Errorf("packet [%v] encoded to %v bytes; Expected %v", p.Id(), buf.Len(), Lengths[p.Id()])
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Returns a packet encoded with Write.
+func Marshal(p Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Write(&buf, p); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
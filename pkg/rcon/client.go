@@ -0,0 +1,188 @@
+package rcon
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAuthFailed = errors.New("rcon: wrong password")
+	ErrClosed     = errors.New("rcon: connection closed")
+)
+
+// A connection to a remote console.
+type Client struct {
+	conn net.Conn
+
+	execMu sync.Mutex // Held while a command runs; Only one runs at a time
+	wmu    sync.Mutex
+
+	mu       sync.Mutex // Guards the fields below, which the reader goroutine uses
+	nextId   int32
+	waitId   int32 // Id of the command whose response is being read
+	response strings.Builder
+	ended    chan struct{} // Closed when the response has ended
+	onLog    func(line string)
+	err      error // Set once the connection has failed
+
+	closed chan struct{} // Closed once the reader goroutine has stopped
+}
+
+// Connects to a remote console and logs in.
+func Dial(addr, password string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := writePacket(conn, packet{Id: 1, Type: typeAuth, Body: password}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Some servers send an empty response before the auth response
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if p.Type != typeAuthResponse {
+			continue
+		}
+		if p.Id == authFailedId {
+			conn.Close()
+			return nil, ErrAuthFailed
+		}
+		break
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{conn: conn, nextId: 2, closed: make(chan struct{})}
+	go c.readLoop(r)
+	return c, nil
+}
+
+// Runs a command and returns what it sent back, e.g. Execute("kick someone").
+func (c *Client) Execute(command string) (string, error) {
+	return c.request(typeExecCommand, command)
+}
+
+// Asks the server to send every log line from now on. fn is called for each line,
+// on the goroutine that reads from the connection.
+func (c *Client) FollowLogs(fn func(line string)) error {
+	c.mu.Lock()
+	c.onLog = fn
+	c.mu.Unlock()
+
+	_, err := c.request(typeFollowLogs, "")
+	return err
+}
+
+// Sends a request and waits for its response.
+func (c *Client) request(typ int32, body string) (string, error) {
+	c.execMu.Lock()
+	defer c.execMu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return "", c.err
+	}
+	id := c.nextId
+	c.nextId += 2
+	c.waitId = id
+	c.response.Reset()
+	c.ended = make(chan struct{})
+	ended := c.ended
+	c.mu.Unlock()
+
+	// The server echoes the empty packet after the response, so its echo marks the end.
+	// Both are sent at once so the server has received the second if the first shuts it down.
+	var buf bytes.Buffer
+	writePacket(&buf, packet{Id: id, Type: typ, Body: body})
+	writePacket(&buf, packet{Id: id + 1, Type: typeResponseValue})
+
+	if err := c.write(buf.Bytes()); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-ended:
+	case <-c.closed:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.response.String(), nil
+}
+
+// Waits until the connection is closed, e.g. while following the log. Returns why it was closed.
+func (c *Client) Wait() error {
+	<-c.closed
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.closed
+	return err
+}
+
+func (c *Client) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	defer close(c.closed)
+
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			c.mu.Lock()
+			c.err = ErrClosed
+			c.mu.Unlock()
+			return
+		}
+
+		if p.Type == typeLogLine {
+			c.mu.Lock()
+			onLog := c.onLog
+			c.mu.Unlock()
+
+			if onLog != nil {
+				onLog(p.Body)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		switch {
+		case p.Id == c.waitId:
+			c.response.WriteString(p.Body)
+		case p.Id == c.waitId+1 && c.ended != nil:
+			close(c.ended)
+			c.ended = nil
+		}
+		c.mu.Unlock()
+	}
+}
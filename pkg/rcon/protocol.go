@@ -0,0 +1,76 @@
+// Package rcon is a remote console for the server. It uses the Source RCON protocol, so existing
+// RCON tools can connect, and adds packets for following the server log. Client is a small client
+// for it, used by midnight-cli.
+package rcon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types. Auth responses and commands share a value, as in the Source protocol.
+const (
+	typeResponseValue = 0
+	typeExecCommand   = 2
+	typeAuthResponse  = 2
+	typeAuth          = 3
+
+	// Not part of the Source protocol: A client sends typeFollowLogs to receive every log line
+	// from then on in typeLogLine packets, which have id 0.
+	typeFollowLogs = 100
+	typeLogLine    = 101
+)
+
+// Id the server responds to a failed login with
+const authFailedId = -1
+
+// Longest body in one packet. Longer responses are split over several packets.
+const maxBodyLength = 4096
+
+var errPacketTooLarge = errors.New("rcon: packet too large")
+
+type packet struct {
+	Id   int32
+	Type int32
+	Body string
+}
+
+// Packets are the little-endian length of the rest of the packet, the id, the type,
+// then the body followed by two null bytes.
+func writePacket(w io.Writer, p packet) error {
+	buf := make([]byte, 12+len(p.Body)+2)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)-4))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(p.Id))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(p.Type))
+	copy(buf[12:], p.Body)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return packet{}, err
+	}
+	if length < 10 {
+		return packet{}, fmt.Errorf("rcon: invalid packet length [%v]", length)
+	}
+	if length > maxBodyLength+10 {
+		return packet{}, errPacketTooLarge
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return packet{}, err
+	}
+
+	return packet{
+		Id:   int32(binary.LittleEndian.Uint32(buf[0:])),
+		Type: int32(binary.LittleEndian.Uint32(buf[4:])),
+		Body: string(buf[8 : length-2]),
+	}, nil
+}
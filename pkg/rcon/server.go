@@ -0,0 +1,286 @@
+package rcon
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io"
+	"log"
+	"midnight/pkg/core"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a failed login waits before the connection is closed, to slow down guessing
+const authFailedDelay = time.Second
+
+// Log lines waiting to be sent to a client that follows the log. Lines are dropped while it's full.
+const logQueueLength = 256
+
+const writeTimeout = 10 * time.Second
+
+// How long Close waits for requests that are on their way
+const closeGracePeriod = 500 * time.Millisecond
+
+type Server struct {
+	s        *core.Server
+	listener net.Listener
+	password [sha256.Size]byte // Hashed so comparing it doesn't reveal its length
+	logOut   io.Writer         // Log output before the server was started
+
+	mu     sync.Mutex // Guards conns. Held while log lines are queued, so nothing may log while holding it.
+	conns  map[*conn]bool
+	closed bool
+
+	handlers sync.WaitGroup
+}
+
+type conn struct {
+	net.Conn
+	addr string
+
+	wmu  sync.Mutex // Guards writes, which come from both the connection's goroutine and its log goroutine
+	logs chan string
+}
+
+// Starts accepting remote console connections on addr. Clients must log in with the password.
+// Every log line is also sent to clients that follow the log.
+func Listen(s *core.Server, addr, password string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		s:        s,
+		listener: listener,
+		password: sha256.Sum256([]byte(password)),
+		logOut:   log.Writer(),
+		conns:    make(map[*conn]bool),
+	}
+	log.SetOutput(io.MultiWriter(srv.logOut, srv))
+
+	log.Printf("Started RCON on %v", listener.Addr())
+	go srv.acceptLoop()
+	return srv, nil
+}
+
+// Stops accepting connections and disconnects every client once it has been sent the response
+// to the request it's handling, e.g. the command that shut down the server.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	for c := range srv.conns {
+		c.SetReadDeadline(time.Now().Add(closeGracePeriod))
+	}
+	srv.mu.Unlock()
+
+	err := srv.listener.Close()
+	srv.handlers.Wait()
+
+	log.SetOutput(srv.logOut)
+	return err
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+func (srv *Server) acceptLoop() {
+	for {
+		nc, err := srv.listener.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return
+			}
+
+			log.Printf("Could not accept RCON client: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go srv.handle(&conn{Conn: nc, addr: nc.RemoteAddr().String()})
+	}
+}
+
+func (srv *Server) handle(c *conn) {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		c.Close()
+		return
+	}
+	srv.conns[c] = true
+	srv.handlers.Add(1)
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, c)
+		if c.logs != nil {
+			close(c.logs)
+		}
+		srv.mu.Unlock()
+
+		c.Close()
+		srv.handlers.Done()
+	}()
+
+	r := bufio.NewReader(c)
+
+	if !srv.authenticate(c, r) {
+		return
+	}
+
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			if err != io.EOF && !srv.isClosed() {
+				log.Printf("[RCON %v] Disconnected: %v", c.addr, err)
+			}
+			return
+		}
+
+		switch p.Type {
+		case typeExecCommand:
+			if err := c.respond(p.Id, srv.execute(c, p.Body)); err != nil {
+				return
+			}
+
+		case typeFollowLogs:
+			srv.followLogs(c)
+			if err := c.respond(p.Id, ""); err != nil {
+				return
+			}
+
+		case typeResponseValue:
+			// Clients send an empty response after a command; Echoing it tells them the command's response has ended
+			if err := c.respond(p.Id, ""); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads the login packet. Returns true if the password was right.
+func (srv *Server) authenticate(c *conn, r *bufio.Reader) bool {
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p, err := readPacket(r)
+	c.SetReadDeadline(time.Time{})
+
+	if err != nil || p.Type != typeAuth {
+		return false
+	}
+
+	password := sha256.Sum256([]byte(p.Body))
+	if subtle.ConstantTimeCompare(password[:], srv.password[:]) != 1 {
+		log.Printf("[RCON %v] Login failed", c.addr)
+
+		time.Sleep(authFailedDelay)
+		c.write(packet{Id: authFailedId, Type: typeAuthResponse})
+		return false
+	}
+
+	log.Printf("[RCON %v] Logged in", c.addr)
+	return c.write(packet{Id: p.Id, Type: typeAuthResponse}) == nil
+}
+
+// Runs a command, returning what it sent back without color codes.
+func (srv *Server) execute(c *conn, line string) string {
+	sender := &sender{}
+	srv.s.ExecuteCommand(sender, line)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return strings.Join(sender.lines, "\n")
+}
+
+// Starts sending every log line to the client.
+func (srv *Server) followLogs(c *conn) {
+	srv.mu.Lock()
+	if c.logs != nil {
+		srv.mu.Unlock()
+		return
+	}
+	c.logs = make(chan string, logQueueLength)
+	srv.mu.Unlock()
+
+	go func() {
+		for line := range c.logs {
+			if c.write(packet{Type: typeLogLine, Body: line}) != nil {
+				c.Close()
+			}
+		}
+	}()
+}
+
+// Queues a log line for the clients that follow the log. It's called by the log package, so it must not log.
+func (srv *Server) Write(b []byte) (int, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	if len(line) > maxBodyLength {
+		line = line[:maxBodyLength]
+	}
+
+	srv.mu.Lock()
+	for c := range srv.conns {
+		if c.logs == nil {
+			continue
+		}
+
+		select {
+		case c.logs <- line:
+		default: // The client isn't keeping up
+		}
+	}
+	srv.mu.Unlock()
+
+	return len(b), nil
+}
+
+// Sends a response, split over several packets if it's too long for one.
+func (c *conn) respond(id int32, body string) error {
+	for {
+		chunk := body
+		if len(chunk) > maxBodyLength {
+			chunk = chunk[:maxBodyLength]
+		}
+		body = body[len(chunk):]
+
+		if err := c.write(packet{Id: id, Type: typeResponseValue, Body: chunk}); err != nil {
+			return err
+		}
+		if body == "" {
+			return nil
+		}
+	}
+}
+
+func (c *conn) write(p packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writePacket(c, p)
+}
+
+// Runs commands for a remote console client. Like the server console, it can use every command.
+type sender struct {
+	mu    sync.Mutex // Commands may send messages from other goroutines
+	lines []string
+}
+
+func (*sender) Name() string { return "RCON" }
+
+func (s *sender) SendMessage(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lines = append(s.lines, core.StripColorCodes(msg))
+}
+
+func (*sender) HasPermission(permission string) bool { return true }
@@ -2,14 +2,22 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
+	"fmt"
 	"log"
 	"midnight/pkg/core"
+	"midnight/pkg/httpapi"
+	_ "midnight/pkg/importer"
 	"midnight/pkg/logging"
+	"midnight/pkg/metrics"
+	"midnight/pkg/plugins"
+	"midnight/pkg/protocol"
+	"midnight/pkg/rcon"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
 func main() {
@@ -19,21 +27,49 @@ func main() {
 		core.SaveConfigToFile(conf)
 	}
 
-	var s *core.Server
+	ch, err := core.BeginClientHandling(conf.IP, strconv.FormatInt(int64(conf.Port), 10))
+	if err != nil {
+		log.Fatalf("Could not start server: %v", err)
+	}
 
-	go func() {
-		ch, err := core.BeginClientHandling(conf.IP, strconv.FormatInt(int64(conf.Port), 10))
-		if err != nil {
-			log.Fatalf("Could not start server: %v", err)
-			return
+	s := core.StartServer(ch, conf)
+	plugins.Start(s)
+
+	var rc *rcon.Server
+	if conf.RCON.Enabled {
+		addr := net.JoinHostPort(conf.RCON.IP, strconv.FormatInt(int64(conf.RCON.Port), 10))
+		if rc, err = rcon.Listen(s, addr, conf.RCON.Password); err != nil {
+			log.Printf("Could not start RCON: %v", err)
 		}
+	}
 
-		s = core.StartServer(ch, conf)
-		log.Println("Started server. Accepting clients.")
+	var api *httpapi.Server
+	if conf.HTTPAPI.Enabled {
+		addr := net.JoinHostPort(conf.HTTPAPI.IP, strconv.FormatInt(int64(conf.HTTPAPI.Port), 10))
+		if api, err = httpapi.Listen(s, conf, addr); err != nil {
+			log.Printf("Could not start the HTTP API: %v", err)
+		}
+	}
 
+	if conf.Metrics.Enabled {
+		addr := net.JoinHostPort(conf.Metrics.IP, strconv.FormatInt(int64(conf.Metrics.Port), 10))
+		if _, err := metrics.Listen(addr); err != nil {
+			log.Printf("Could not start serving metrics: %v", err)
+		} else {
+			log.Printf("Serving metrics on %v/metrics", addr)
+		}
+	}
+
+	log.Println("Started server. Accepting clients.")
+
+	go func() {
 		for {
 			conn, err := ch.Listener.Accept()
 			if err != nil {
+				if s.Stopping() {
+					return // The listener was closed
+				}
+
 				log.Println("Could not accept client:")
 				log.Println(err)
 				continue
@@ -43,100 +79,123 @@ func main() {
 		}
 	}()
 
-	scanner := bufio.NewScanner(os.Stdin)
+	// The first SIGINT/SIGTERM shuts down the server; A second one exits without waiting
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		go s.Shutdown("Server shutting down", false)
 
-	for scanner.Scan() {
-		s.SendAnnouncement(scanner.Text())
+		<-signals
+		log.Println("Exiting without finishing shutdown")
+		os.Exit(core.ExitError)
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+
+		// Console lines starting with a slash are commands; Anything else is announced to all players
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			if strings.HasPrefix(line, "/") {
+				s.ExecuteCommand(core.Console, line)
+			} else if line != "" {
+				s.SendAnnouncement(line)
+			}
+		}
+	}()
+
+	code := s.Wait()
+	if rc != nil {
+		rc.Close()
 	}
+	if api != nil {
+		api.Close()
+	}
+	log.Printf("Server stopped [exit code %v]", code)
+	os.Exit(code)
 }
 
 func newConnection(conn net.Conn, server *core.Server) {
 	log.Println("Connected [" + conn.RemoteAddr().String() + "]")
 
-	c := core.Client{
-		Conn:   conn,
-		Reader: bufio.NewReader(conn),
-		Writer: bufio.NewWriter(conn),
-	}
+	c := core.NewClient(conn)
 
 	// Read Player Identification (0x00)
-	packet, protocol, username, verify, ext, err := c.ReadPacket_PlayerIdentification()
+	packet, err := c.ReadPacket()
 
 	if err != nil {
 		log.Println("Error while reading from client [" + conn.RemoteAddr().String() + "]")
 		log.Println(err)
-		c.Conn.Close()
+		c.Close()
 		return
 	}
 
 	// Validate Player Identification
-	if packet != 0x00 {
+	ident, ok := packet.(*protocol.PlayerIdentification)
+	if !ok {
 		log.Println("[" + conn.RemoteAddr().String() + "] Invalid Player Identification Packet ID. Disconnecting client.")
-		c.Conn.Close()
+		core.CountRejectedConnection(core.RejectBadProtocol)
+		c.Close()
 		return
 	}
-	if protocol != 0x07 {
+	if ident.ProtocolVersion != protocol.ProtocolVersion {
 		log.Println("[" + conn.RemoteAddr().String() + "] Invalid Player Identification Protocol. Disconnecting client.")
-		c.Conn.Close()
+		core.CountRejectedConnection(core.RejectBadProtocol)
+		c.Close()
 		return
 	}
-	if ext != 0x42 {
-		log.Println("[" + conn.RemoteAddr().String() + "] Invalid Player Identification Padding Byte. Disconnecting client.")
-		c.Conn.Close()
+	username := ident.Username
+	if !core.ValidUsername(username) {
+		log.Printf("[%v] Invalid username %q. Disconnecting client.", conn.RemoteAddr().String(), username)
+		core.CountRejectedConnection(core.RejectBadUsername)
+		c.WritePacket_DisconnectPlayer("Invalid username.")
+		c.Close()
 		return
 	}
 
-	// Write ExtInfo/ExtEntry
-	c.WritePacket_ExtInfo("Midnight", 2)
-	c.WritePacket_ExtEntry("EmoteFix", 1)
-	c.WritePacket_ExtEntry("LongerMessages", 1)
-
-	// Read ExtInfo/ExtEntry
-	packet, appName, extCount, err := c.ReadPacket_ExtInfo()
+	// Clients that don't speak CPE send 0x00 as the padding byte; CPE clients send 0x42
+	appName := "Classic 0.30"
+	if ident.Padding == 0x42 {
+		c.CPE = true
 
-	if err != nil {
-		log.Println("Error while reading from client [" + conn.RemoteAddr().String() + "]")
-		log.Println(err)
-		c.Conn.Close()
-		return
+		appName, err = negotiateExtensions(c)
+		if err != nil {
+			log.Println("Error while negotiating extensions with client [" + conn.RemoteAddr().String() + "]")
+			log.Println(err)
+			c.Close()
+			return
+		}
 	}
 
-	if packet != 0x10 {
-		log.Println("[" + conn.RemoteAddr().String() + "] Invalid ExtInfo Packet ID. Disconnecting client.")
-		c.Conn.Close()
+	if missing := core.MissingExtensions(c, server.RequiredExtensions); len(missing) > 0 {
+		log.Printf("[%v] Client is missing required extensions %v. Disconnecting client.", conn.RemoteAddr().String(), missing)
+		core.CountRejectedConnection(core.RejectMissingExtensions)
+		c.WritePacket_DisconnectPlayer("Missing required extensions: " + strings.Join(missing, ", "))
+		c.Close()
 		return
 	}
 
-	logging.Log_Debugf("[%v] Client supports %v protocol extensions:", conn.RemoteAddr().String(), extCount)
-	for i := int16(0); i < extCount; i++ {
-		// TODO: Note the supported client extensions and internally enable those extensions for the client
-		// Config will be able to be modified by admin to reject/kick users if they don't support the required extensions
+	// Send Handshake
+	c.WritePacket_ServerIdentification("Midnight Station", "This is Fullerton. This is a Red Line train to 95th.", server.PlayerRank(username).IsOp())
 
-		extName, version, err := c.ReadPacket_ExtEntry()
-		if err != nil {
-			log.Println("Error while reading from client [" + conn.RemoteAddr().String() + "]")
-			log.Println(err)
-			c.Conn.Close()
-			return
-		}
-		logging.Log_Debugf("[Ext %v] '%v' v%v", i+1, extName, version)
+	if !server.VerifyMppass(username, ident.VerificationKey, conn.RemoteAddr().String()) {
+		core.CountRejectedConnection(core.RejectBadMppass)
+		c.WritePacket_DisconnectPlayer("Invalid Mppass. Please authenticate.")
+		c.Close()
+		return
 	}
 
-	// Send Handshake
-	c.WritePacket_ServerIdentification("Midnight Station", "This is Fullerton. This is a Red Line train to 95th.", true)
-
-	if server.VerifyLogin {
-		vHash := md5.New()
-		vHash.Write([]byte(server.Salt + username))
-		if verify != hex.EncodeToString(vHash.Sum(nil)) {
-			c.WritePacket_DisconnectPlayer("Invalid Mppass. Please authenticate.")
-			c.Conn.Close()
-			return
-		}
+	if allowed, msg := server.CheckLogin(username, conn.RemoteAddr().String()); !allowed {
+		log.Printf("[%v] Rejected %v: %v", conn.RemoteAddr().String(), username, msg)
+		c.WritePacket_DisconnectPlayer(msg)
+		c.Close()
+		return
 	}
 
 	// Create player & join user to server instance
-	p := core.Player{
+	p := &core.Player{
 		Cli:             c,
 		Username:        username,
 		IP:              c.Conn.RemoteAddr().String(),
@@ -145,3 +204,42 @@ func newConnection(conn net.Conn, server *core.Server) {
 
 	server.JoinUser(p)
 }
+
+// Exchanges ExtInfo/ExtEntry packets with a CPE client and records the extensions it supports.
+func negotiateExtensions(c core.Client) (appName string, err error) {
+	// Write ExtInfo/ExtEntry
+	extensions := core.RegisteredExtensions()
+	c.WritePacket_ExtInfo("Midnight", int16(len(extensions)))
+	for _, ext := range extensions {
+		c.WritePacket_ExtEntry(ext.Name, ext.Version)
+	}
+
+	// Read ExtInfo/ExtEntry
+	packet, err := c.ReadPacket()
+	if err != nil {
+		return "", err
+	}
+
+	info, ok := packet.(*protocol.ExtInfo)
+	if !ok {
+		return "", fmt.Errorf("invalid ExtInfo packet ID [%v]", packet.Id())
+	}
+
+	logging.Log_Debugf("[%v] Client supports %v protocol extensions:", c.Conn.RemoteAddr().String(), info.ExtensionCount)
+	for i := int16(0); i < info.ExtensionCount; i++ {
+		packet, err := c.ReadPacket()
+		if err != nil {
+			return "", err
+		}
+
+		entry, ok := packet.(*protocol.ExtEntry)
+		if !ok {
+			return "", fmt.Errorf("invalid ExtEntry packet ID [%v]", packet.Id())
+		}
+		logging.Log_Debugf("[Ext %v] '%v' v%v", i+1, entry.ExtName, entry.Version)
+
+		c.Extensions[entry.ExtName] = entry.Version
+	}
+
+	return info.AppName, nil
+}
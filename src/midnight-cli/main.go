@@ -0,0 +1,65 @@
+// midnight-cli sends commands to a server's remote console, e.g.
+//
+//	midnight-cli -addr 127.0.0.1:25575 kick someone griefing
+//
+// Without a command, it runs a command from each line of stdin. The password is read from
+// MIDNIGHT_RCON_PASSWORD unless -password is given.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"midnight/pkg/rcon"
+	"os"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:25575", "address of the server's remote console")
+	password := flag.String("password", os.Getenv("MIDNIGHT_RCON_PASSWORD"), "remote console password")
+	follow := flag.Bool("follow", false, "print the server log until the connection is closed")
+	flag.Parse()
+
+	c, err := rcon.Dial(*addr, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to %v: %v\n", *addr, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	if *follow {
+		err := c.FollowLogs(func(line string) { fmt.Println(line) })
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		run(c, strings.Join(flag.Args(), " "))
+	} else if !*follow {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				run(c, line)
+			}
+		}
+	}
+
+	if *follow {
+		c.Wait()
+	}
+}
+
+func run(c *rcon.Client, command string) {
+	response, err := c.Execute(command)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if response != "" {
+		fmt.Println(response)
+	}
+}